@@ -1,66 +1,388 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"log"
+	"net"
+	"net/url"
 	"os"
-	"path/filepath"
+	"strings"
 	"text/template"
 
+	"github.com/nik-johnson-net/rackdirector/pkg/bmc"
+	"github.com/nik-johnson-net/rackdirector/pkg/config"
+	"github.com/nik-johnson-net/rackdirector/pkg/console"
 	"github.com/nik-johnson-net/rackdirector/pkg/dhcpd"
+	"github.com/nik-johnson-net/rackdirector/pkg/history"
 	"github.com/nik-johnson-net/rackdirector/pkg/httpd"
 	"github.com/nik-johnson-net/rackdirector/pkg/ipam"
 	"github.com/nik-johnson-net/rackdirector/pkg/pxe"
+	"github.com/nik-johnson-net/rackdirector/pkg/syslogd"
 	"github.com/nik-johnson-net/rackdirector/pkg/tftpd"
 )
 
+// credentialProvider picks where BMC credentials come from, as configured.
+func credentialProvider(cfg config.BMCConfig) (bmc.CredentialProvider, error) {
+	if cfg.Credentials == "env" {
+		return bmc.EnvCredentials{Prefix: "RACKDIRECTOR_BMC"}, nil
+	}
+
+	provider := &bmc.FileCredentials{Path: cfg.Credentials}
+	if cfg.KeyFile != "" {
+		key, err := bmc.LoadKey(cfg.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		provider.Key = key
+	}
+	return provider, nil
+}
+
+// encryptCredentials handles `rackdirector encrypt-credentials <plaintext>`,
+// which encrypts a plaintext credentials file into the configured one.
+func encryptCredentials(cfg config.BMCConfig, source string) error {
+	provider, err := credentialProvider(cfg)
+	if err != nil {
+		return err
+	}
+	file, ok := provider.(*bmc.FileCredentials)
+	if !ok || file.Key == nil {
+		return fmt.Errorf("bmc.key_file must be set to encrypt credentials")
+	}
+	return bmc.EncryptCredentials(source, file.Path, file.Key)
+}
+
+// dhcpNetworks says how DHCP requests on each configured network are matched
+// to hosts. The networks have already been validated.
+func dhcpNetworks(cfg config.Config) []ipam.NetworkMatch {
+	networks := make([]ipam.NetworkMatch, 0, len(cfg.DHCP.Networks))
+	for _, network := range cfg.DHCP.Networks {
+		_, ipNet, _ := net.ParseCIDR(network.Network)
+		networks = append(networks, ipam.NetworkMatch{Network: *ipNet, Match: network.Match})
+	}
+	return networks
+}
+
+// openIPAM loads the hosts from the configured backend.
+func openIPAM(cfg config.IPAMConfig) (ipam.Store, error) {
+	switch cfg.Backend {
+	case config.IPAMNetBox:
+		return openNetBox(cfg.NetBox)
+	case config.IPAMSQLite:
+		database, err := ipam.OpenSQLite(cfg.Database)
+		if err != nil {
+			return nil, err
+		}
+		return database, nil
+	default:
+		static, err := ipam.Load(cfg.Hosts)
+		if err != nil {
+			return nil, err
+		}
+		return static, nil
+	}
+}
+
+// openNetBox fetches the hosts from NetBox.
+func openNetBox(cfg config.NetBoxConfig) (*ipam.NetBox, error) {
+	netbox, err := newNetBox(cfg)
+	if err != nil {
+		return nil, err
+	}
+	diff, err := netbox.Refresh()
+	if err != nil {
+		return nil, fmt.Errorf("netbox: %w", err)
+	}
+	log.Printf("Loaded hosts from netbox: %v\n", diff)
+	return netbox, nil
+}
+
+func newNetBox(cfg config.NetBoxConfig) (*ipam.NetBox, error) {
+	filter, err := url.ParseQuery(cfg.Filter)
+	if err != nil {
+		return nil, err
+	}
+	circuitID, err := template.New("circuit_id").Parse(cfg.CircuitID)
+	if err != nil {
+		return nil, err
+	}
+	netbox := &ipam.NetBox{
+		URL:       cfg.URL,
+		Token:     cfg.Token,
+		Filter:    filter,
+		CircuitID: circuitID,
+		Interval:  cfg.Refresh,
+	}
+	if cfg.RemoteID != "" {
+		netbox.RemoteID, err = template.New("remote_id").Parse(cfg.RemoteID)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return netbox, nil
+}
+
+// importHosts handles `rackdirector ipam import <hosts.json>`, which adds
+// the hosts in a hosts.json file to the configured SQLite database.
+func importHosts(cfg config.IPAMConfig, file string) error {
+	if cfg.Backend != config.IPAMSQLite {
+		return fmt.Errorf("ipam.backend must be %q to import hosts", config.IPAMSQLite)
+	}
+	database, err := ipam.OpenSQLite(cfg.Database)
+	if err != nil {
+		return err
+	}
+	defer database.Close()
+	diff, err := database.Import(file)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Imported %v hosts into %v\n", len(diff.Added), cfg.Database)
+	return nil
+}
+
+// lintHosts handles `rackdirector ipam lint [hosts.json]`, which prints
+// every problem with the given hosts file, or with the configured hosts if
+// none is given. It fails if any problem is an error.
+func lintHosts(cfg config.IPAMConfig, args []string) error {
+	var problems []ipam.Problem
+	var err error
+	switch {
+	case len(args) == 1:
+		problems, err = ipam.LintFile(args[0])
+	case cfg.Backend == config.IPAMSQLite:
+		problems, err = ipam.LintSQLite(cfg.Database)
+	case cfg.Backend == config.IPAMNetBox:
+		var netbox *ipam.NetBox
+		netbox, err = newNetBox(cfg.NetBox)
+		if err == nil {
+			problems, err = netbox.Lint()
+		}
+	default:
+		problems, err = ipam.LintFile(cfg.Hosts)
+	}
+	if err != nil {
+		return err
+	}
+
+	failed := 0
+	for _, problem := range problems {
+		fmt.Println(problem)
+		if !problem.Warning {
+			failed++
+		}
+	}
+	fmt.Printf("%v errors, %v warnings\n", failed, len(problems)-failed)
+	if failed != 0 {
+		return fmt.Errorf("hosts are invalid")
+	}
+	return nil
+}
+
+// printError prints err, listing each problem on its own line if it is
+// invalid hosts.
+func printError(err error) {
+	var invalid *ipam.ValidationError
+	if !errors.As(err, &invalid) {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		return
+	}
+	// Keep whatever err adds to say where the hosts came from.
+	prefix := strings.TrimSuffix(err.Error(), invalid.Error())
+	fmt.Fprintf(os.Stderr, "%vinvalid hosts:\n", prefix)
+	for _, problem := range invalid.Problems {
+		fmt.Fprintf(os.Stderr, "  %v\n", problem)
+	}
+}
+
 func main() {
-	templateFiles, err := filepath.Glob("templates/*.template")
+	cfg, args, err := config.Parse(os.Args[1:])
 	if err != nil {
-		panic(err)
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		os.Exit(2)
 	}
 
-	templates, err := template.ParseFiles(templateFiles...)
+	if len(args) == 2 && args[0] == "encrypt-credentials" {
+		if err := encryptCredentials(cfg.BMC, args[1]); err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+			os.Exit(1)
+		}
+		return
+	}
+	if len(args) == 3 && args[0] == "ipam" && args[1] == "import" {
+		if err := importHosts(cfg.IPAM, args[2]); err != nil {
+			printError(err)
+			os.Exit(1)
+		}
+		return
+	}
+	if len(args) >= 2 && len(args) <= 3 && args[0] == "ipam" && args[1] == "lint" {
+		if err := lintHosts(cfg.IPAM, args[2:]); err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	if err := run(cfg); err != nil {
+		printError(err)
+		os.Exit(1)
+	}
+}
+
+// run serves until told to stop or until a server fails.
+func run(cfg config.Config) error {
+	bmcCredentials, err := credentialProvider(cfg.BMC)
 	if err != nil {
-		panic(err)
+		return err
 	}
 
+	templates, err := pxe.LoadTemplates(cfg.PXE.Templates)
+	if err != nil {
+		return err
+	}
 	fmt.Fprintf(os.Stdout, "%s\n", templates.DefinedTemplates())
 
-	ipamConfig := ipam.NewFromFile("hosts.json")
-	dhcpServer := dhcpd.DHCPD{
-		DHCPv4Handler: ipamConfig,
+	eventLog := &history.Log{
+		Directory: cfg.History.Directory,
 	}
-	err = dhcpServer.ListenAndServe()
+
+	ipamConfig, err := openIPAM(cfg.IPAM)
 	if err != nil {
-		panic(err)
+		return err
 	}
 
-	tftpd := tftpd.Tftpd{
-		Basedir: "tftp",
+	bmcConnector := &bmc.Manager{
+		Credentials: bmcCredentials,
+	}
+	bmcPoller := &bmc.Poller{
+		BMC:  bmcConnector,
+		IPAM: ipamConfig,
 	}
-	tftpd.ListenAndServe()
 
-	controller := pxe.Pxe{
-		StageTemplates: templates,
-		IPAM:           ipamConfig,
+	controller := &pxe.Pxe{
+		StageTemplates:  templates,
+		IPAM:            ipamConfig,
+		Store:           &pxe.FileStore{Path: cfg.PXE.State},
+		PlanDirectory:   cfg.PXE.Plans,
+		History:         eventLog,
+		Server:          cfg.Server.Address,
+		HTTPServer:      cfg.HTTPServer(),
+		OSServer:        cfg.Server.OSServer,
+		Nameservers:     cfg.NameserverIPs(),
+		Interface:       cfg.PXE.Interface,
+		UnknownHostname: cfg.PXE.UnknownHostname,
+		SyslogPort:      cfg.SyslogPort(),
+		NetconsolePort:  cfg.NetconsolePort(),
+		BMC:             bmcConnector,
+		BMCStatus:       bmcPoller,
+		LogDirectory:    cfg.PXE.LogDirectory,
+		FailPatterns:    cfg.PXE.FailPatterns,
+	}
+	if err := controller.ReloadPlans(); err != nil {
+		return err
+	}
+	if err := controller.Restore(); err != nil {
+		return err
 	}
 
-	httpd := httpd.HTTPD{
-		Controller:    &controller,
-		FileDirectory: "http",
+	consoles := &console.Capturer{
+		BMC:       bmcConnector,
+		IPAM:      ipamConfig,
+		Plans:     controller,
+		Directory: cfg.Console.Directory,
+	}
+
+	dhcpServer := &dhcpd.DHCPD{
+		DHCPv4Handler: &ipam.DHCPHandler{
+			Store:       ipamConfig,
+			Nameservers: cfg.NameserverIPs(),
+			Lease:       cfg.DHCP.Lease,
+			TFTPServer:  cfg.Server.Address,
+			Networks:    dhcpNetworks(cfg),
+			Match:       cfg.DHCP.Match,
+		},
+		History:  eventLog,
+		Listen:   cfg.DHCP.Listen,
+		ServerIP: cfg.ServerIP(),
+		HTTPPort: cfg.HTTPPort(),
+	}
+	tftpServer := &tftpd.Tftpd{
+		Basedir: cfg.TFTP.Directory,
+		Listen:  cfg.TFTP.Listen,
+	}
+	reloads := newReloader(&cfg, ipamConfig, controller)
+	httpServer := &httpd.HTTPD{
+		Controller:    controller,
+		FileDirectory: cfg.HTTP.Directory,
+		Listen:        cfg.HTTP.Listen,
 		IPAM:          ipamConfig,
+		History:       eventLog,
+		BMCStatus:     bmcPoller,
+		Consoles:      consoles,
+		Reloader:      reloads,
+	}
+	syslogServer := &syslogd.Server{
+		Handler:        controller,
+		UDPAddr:        cfg.Syslog.Listen,
+		TCPAddr:        cfg.Syslog.Listen,
+		NetconsoleAddr: cfg.Syslog.Netconsole,
 	}
 
-	httpDone, err := httpd.ListenAndServe()
+	s := newSupervisor()
+	s.reload = reloads.Reload
+	err = s.open(
+		service{
+			name:  "dhcp",
+			open:  dhcpServer.Open,
+			serve: dhcpServer.Serve,
+			stop:  func(ctx context.Context) error { return dhcpServer.Close() },
+		},
+		service{
+			name:  "tftp",
+			open:  tftpServer.Open,
+			serve: tftpServer.Serve,
+			stop:  func(ctx context.Context) error { return tftpServer.Close() },
+		},
+		service{
+			name: "syslog",
+			open: syslogServer.ListenAndServe,
+			serve: func() error {
+				<-s.ctx.Done()
+				return nil
+			},
+			stop: func(ctx context.Context) error { return syslogServer.Close() },
+		},
+		service{
+			name:  "http",
+			open:  httpServer.Open,
+			serve: httpServer.Serve,
+			stop:  httpServer.Shutdown,
+		},
+	)
 	if err != nil {
-		panic(err)
+		return err
 	}
+	s.loop(bmcPoller.Run)
+	s.loop(controller.Watch)
+	s.loop(consoles.Run)
+	s.loop(reloads.Watch)
+	if netbox, ok := ipamConfig.(*ipam.NetBox); ok {
+		s.loop(netbox.Run)
+	}
+	s.serve()
 
-	for {
-		select {
-		case <-httpDone:
-			fmt.Fprintf(os.Stdout, "HTTPD done")
-			return
+	err = s.wait()
+	if flushErr := controller.Flush(); flushErr != nil {
+		log.Printf("Failed to save plans: %v\n", flushErr)
+		if err == nil {
+			err = flushErr
 		}
 	}
+	if database, ok := ipamConfig.(*ipam.SQLite); ok {
+		database.Close()
+	}
+	return err
 }
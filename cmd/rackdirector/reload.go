@@ -0,0 +1,220 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/nik-johnson-net/rackdirector/pkg/config"
+	"github.com/nik-johnson-net/rackdirector/pkg/ipam"
+	"github.com/nik-johnson-net/rackdirector/pkg/pxe"
+)
+
+// settleTime is how long the hosts file and templates must go unchanged
+// before they are reloaded, so an editor's burst of writes or a checkout
+// touching many templates causes one reload.
+const settleTime = time.Second
+
+// reloader applies the settings which can change while running. Reloads
+// from SIGHUP, the API and the file watcher are serialized.
+type reloader struct {
+	mu         sync.Mutex
+	cfg        *config.Config
+	ipam       ipam.Store
+	controller *pxe.Pxe
+	// moved is signalled when a reload changes the paths being watched.
+	moved chan struct{}
+}
+
+func newReloader(cfg *config.Config, ipamConfig ipam.Store, controller *pxe.Pxe) *reloader {
+	return &reloader{
+		cfg:        cfg,
+		ipam:       ipamConfig,
+		controller: controller,
+		moved:      make(chan struct{}, 1),
+	}
+}
+
+// Reload reads the config file again, and reloads the IPAM hosts, templates,
+// fail patterns and plans. Each is kept as it was if its new version is
+// invalid.
+func (r *reloader) Reload() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	next, _, err := config.Parse(os.Args[1:])
+	if err != nil {
+		return err
+	}
+	if changed := r.cfg.RestartRequired(next); len(changed) != 0 {
+		log.Printf("Changes to %v take effect on restart\n", strings.Join(changed, ", "))
+	}
+	hosts, templates := r.cfg.IPAM.Hosts, r.cfg.PXE.Templates
+
+	problems := make([]string, 0)
+	if err := r.reloadHosts(next.IPAM.Hosts); err != nil {
+		problems = append(problems, fmt.Sprintf("ipam: %v", err))
+	} else {
+		r.cfg.IPAM.Hosts = next.IPAM.Hosts
+	}
+	if err := r.reloadTemplates(next.PXE.Templates); err != nil {
+		problems = append(problems, fmt.Sprintf("templates: %v", err))
+	} else {
+		r.cfg.PXE.Templates = next.PXE.Templates
+	}
+	if err := r.controller.SetFailPatterns(next.PXE.FailPatterns); err != nil {
+		problems = append(problems, fmt.Sprintf("fail patterns: %v", err))
+	} else {
+		r.cfg.PXE.FailPatterns = next.PXE.FailPatterns
+	}
+	if err := r.controller.ReloadPlans(); err != nil {
+		problems = append(problems, fmt.Sprintf("plans: %v", err))
+	}
+
+	if hosts != r.cfg.IPAM.Hosts || templates != r.cfg.PXE.Templates {
+		select {
+		case r.moved <- struct{}{}:
+		default:
+		}
+	}
+	if len(problems) != 0 {
+		return fmt.Errorf("%v", strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+// reloadHosts reloads the hosts file, or refreshes the hosts from NetBox or
+// the database.
+func (r *reloader) reloadHosts(file string) error {
+	var diff ipam.HostDiff
+	var err error
+	source := file
+	switch store := r.ipam.(type) {
+	case *ipam.StaticIpam:
+		diff, err = store.Reload(file)
+	case *ipam.NetBox:
+		diff, err = store.Refresh()
+		source = "netbox"
+	case *ipam.SQLite:
+		diff, err = store.Refresh()
+		source = r.cfg.IPAM.Database
+	default:
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	log.Printf("Reloaded hosts from %v: %v\n", source, diff)
+	return nil
+}
+
+func (r *reloader) reloadTemplates(dir string) error {
+	templates, err := pxe.LoadTemplates(dir)
+	if err == nil {
+		err = r.controller.SetTemplates(templates)
+	}
+	if err != nil {
+		return err
+	}
+	log.Printf("Reloaded templates from %v\n", dir)
+	return nil
+}
+
+// paths returns the hosts file and templates directory currently in use.
+// The hosts file is empty unless hosts come from one.
+func (r *reloader) paths() (string, string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	templates := filepath.Clean(r.cfg.PXE.Templates)
+	if _, ok := r.ipam.(*ipam.StaticIpam); !ok {
+		return "", templates
+	}
+	return filepath.Clean(r.cfg.IPAM.Hosts), templates
+}
+
+// Watch reloads the hosts file or templates when they change on disk, until
+// ctx is done. The hosts file's directory is watched rather than the file so
+// it is still seen after editors replace it by renaming.
+func (r *reloader) Watch(ctx context.Context) {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		log.Printf("Not watching hosts or templates: %v\n", err)
+		return
+	}
+	defer watcher.Close()
+
+	watched := make(map[string]bool)
+	var hosts, templates string
+	watch := func() {
+		hosts, templates = r.paths()
+		dirs := map[string]bool{templates: true}
+		if hosts != "" {
+			dirs[filepath.Dir(hosts)] = true
+		}
+		for dir := range watched {
+			if !dirs[dir] {
+				watcher.Remove(dir)
+				delete(watched, dir)
+			}
+		}
+		for dir := range dirs {
+			if watched[dir] {
+				continue
+			}
+			if err := watcher.Add(dir); err != nil {
+				log.Printf("Not watching %v: %v\n", dir, err)
+				continue
+			}
+			watched[dir] = true
+		}
+	}
+	watch()
+
+	settle := time.NewTimer(settleTime)
+	settle.Stop()
+	var hostsChanged, templatesChanged bool
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-r.moved:
+			watch()
+		case err := <-watcher.Errors:
+			log.Printf("Watching hosts and templates: %v\n", err)
+		case event := <-watcher.Events:
+			if event.Op == fsnotify.Chmod {
+				continue
+			}
+			name := filepath.Clean(event.Name)
+			switch {
+			case name == hosts:
+				hostsChanged = true
+			case filepath.Dir(name) == templates && filepath.Ext(name) == ".template":
+				templatesChanged = true
+			default:
+				continue
+			}
+			settle.Reset(settleTime)
+		case <-settle.C:
+			r.mu.Lock()
+			if hostsChanged {
+				if err := r.reloadHosts(r.cfg.IPAM.Hosts); err != nil {
+					log.Printf("Keeping current hosts: %v\n", err)
+				}
+			}
+			if templatesChanged {
+				if err := r.reloadTemplates(r.cfg.PXE.Templates); err != nil {
+					log.Printf("Keeping current templates: %v\n", err)
+				}
+			}
+			r.mu.Unlock()
+			hostsChanged, templatesChanged = false, false
+		}
+	}
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// shutdownTimeout bounds how long in-flight requests and transfers are given
+// to finish on shutdown.
+const shutdownTimeout = 30 * time.Second
+
+// service is a server the supervisor opens, serves and stops.
+type service struct {
+	name string
+	// open binds the service's ports. It must not block.
+	open func() error
+	// serve blocks until the service is stopped, returning nil if it was
+	// stopped on purpose.
+	serve func() error
+	// stop stops the service, draining requests in flight until ctx is done.
+	stop func(ctx context.Context) error
+}
+
+// supervisor runs services and background loops with a shared context. The
+// first service to fail, or SIGINT or SIGTERM, stops them all.
+type supervisor struct {
+	ctx    context.Context
+	cancel context.CancelFunc
+	// reload is called on SIGHUP.
+	reload func() error
+
+	services []service
+	errs     chan error
+	loops    sync.WaitGroup
+}
+
+func newSupervisor() *supervisor {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &supervisor{
+		ctx:    ctx,
+		cancel: cancel,
+		errs:   make(chan error, 1),
+	}
+}
+
+// open binds each service in turn. If one fails, those already opened are
+// stopped and the error returned.
+func (s *supervisor) open(services ...service) error {
+	for _, svc := range services {
+		if err := svc.open(); err != nil {
+			s.stop()
+			return fmt.Errorf("starting %v: %v", svc.name, err)
+		}
+		s.services = append(s.services, svc)
+	}
+	return nil
+}
+
+// serve runs every opened service in the background.
+func (s *supervisor) serve() {
+	for _, svc := range s.services {
+		go func(svc service) {
+			if err := svc.serve(); err != nil {
+				s.fail(fmt.Errorf("%v: %v", svc.name, err))
+			}
+		}(svc)
+	}
+}
+
+// loop runs fn in the background until the supervisor's context is done.
+func (s *supervisor) loop(fn func(ctx context.Context)) {
+	s.loops.Add(1)
+	go func() {
+		defer s.loops.Done()
+		fn(s.ctx)
+	}()
+}
+
+func (s *supervisor) fail(err error) {
+	select {
+	case s.errs <- err:
+	default:
+	}
+}
+
+// wait blocks until a service fails or the process is told to stop,
+// reloading on every SIGHUP, then stops everything. The error of the failed
+// service is returned.
+func (s *supervisor) wait() error {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+	defer signal.Stop(signals)
+
+	for {
+		select {
+		case err := <-s.errs:
+			log.Printf("Shutting down: %v\n", err)
+			s.stop()
+			return err
+		case sig := <-signals:
+			if sig == syscall.SIGHUP {
+				log.Printf("Reloading\n")
+				if err := s.reload(); err != nil {
+					log.Printf("Reload failed: %v\n", err)
+				}
+				continue
+			}
+			log.Printf("Shutting down on %v\n", sig)
+			s.stop()
+			return nil
+		}
+	}
+}
+
+// stop cancels the background loops and stops the services, last opened
+// first. Loops and services are given until shutdownTimeout between them to
+// finish, so the plans are saved before systemd gives up on us.
+func (s *supervisor) stop() {
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+
+	s.cancel()
+	loops := make(chan struct{})
+	go func() {
+		s.loops.Wait()
+		close(loops)
+	}()
+	select {
+	case <-loops:
+	case <-ctx.Done():
+		log.Printf("Stopping background loops: %v\n", ctx.Err())
+	}
+	for i := len(s.services) - 1; i >= 0; i-- {
+		svc := s.services[i]
+		done := make(chan error, 1)
+		go func() {
+			done <- svc.stop(ctx)
+		}()
+		select {
+		case err := <-done:
+			if err != nil {
+				log.Printf("Stopping %v: %v\n", svc.name, err)
+			}
+		case <-ctx.Done():
+			log.Printf("Stopping %v: %v\n", svc.name, ctx.Err())
+		}
+	}
+	s.services = nil
+}
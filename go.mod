@@ -6,12 +6,15 @@ require (
 	github.com/coreos/etcd v3.3.18+incompatible
 	github.com/coreos/go-systemd v0.0.0-20191104093116-d3cd4ed1dbcf // indirect
 	github.com/coreos/pkg v0.0.0-20180928190104-399ea9e2e55f // indirect
+	github.com/fsnotify/fsnotify v1.4.9
 	github.com/golang/protobuf v1.3.3 // indirect
 	github.com/insomniacslk/dhcp v0.0.0-20200210095418-45e5f320b2f0
+	github.com/mattn/go-sqlite3 v1.14.6
 	github.com/mdlayher/ethernet v0.0.0-20190606142754-0394541c37b7 // indirect
 	github.com/mdlayher/raw v0.0.0-20191009151244-50f2db8cc065 // indirect
 	github.com/pin/tftp v2.1.0+incompatible
 	github.com/stretchr/testify v1.5.1 // indirect
 	github.com/u-root/u-root v6.0.0+incompatible // indirect
 	golang.org/x/sys v0.0.0-20200219091948-cb0a6d8edb6c // indirect
+	gopkg.in/yaml.v2 v2.4.0
 )
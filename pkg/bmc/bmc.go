@@ -0,0 +1,226 @@
+package bmc
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"time"
+
+	"github.com/nik-johnson-net/rackdirector/pkg/ipam"
+)
+
+// PowerState is the power state of a host as reported by its BMC.
+type PowerState string
+
+const (
+	PowerOn      PowerState = "on"
+	PowerOff     PowerState = "off"
+	PowerUnknown PowerState = "unknown"
+)
+
+// BootDevice is a device a host can be told to boot from next.
+type BootDevice string
+
+const (
+	BootPXE  BootDevice = "pxe"
+	BootDisk BootDevice = "disk"
+	BootBIOS BootDevice = "bios"
+)
+
+// Boot modes as set in IPAM.
+const (
+	BootModeUEFI   = "uefi"
+	BootModeLegacy = "legacy"
+)
+
+// BMC types as set in IPAM.
+const (
+	TypeIPMI    = "ipmi"
+	TypeRedfish = "redfish"
+)
+
+// DefaultTimeout bounds each request made to a BMC.
+const DefaultTimeout = 10 * time.Second
+
+// Driver controls a single host through its BMC.
+type Driver interface {
+	PowerOn() error
+	PowerOff() error
+	PowerCycle() error
+	PowerStatus() (PowerState, error)
+	// SetNextBoot overrides the boot device for the next boot only.
+	SetNextBoot(device BootDevice) error
+	// SetPassword changes the password of the BMC user username.
+	SetPassword(username string, password string) error
+}
+
+// Health is the overall health of a system and a summary of its system event
+// log.
+type Health struct {
+	Status string
+	SEL    *SELSummary
+}
+
+// SELSummary counts system event log entries by severity.
+type SELSummary struct {
+	Entries    int
+	Warning    int
+	Critical   int
+	Latest     string `json:",omitempty"`
+	LatestTime time.Time
+}
+
+// HealthReporter is implemented by Drivers which can report system health.
+type HealthReporter interface {
+	Health() (Health, error)
+}
+
+// Connector opens a Driver for the BMC of a host.
+type Connector interface {
+	Connect(host ipam.Host) (Driver, error)
+}
+
+// Consoler opens the serial console of a host.
+type Consoler interface {
+	Console(host ipam.Host) (io.ReadCloser, error)
+}
+
+// Rotator replaces the password of a host's BMC with a new random one.
+type Rotator interface {
+	Rotate(host ipam.Host) error
+}
+
+// Manager is a Connector which picks a driver from the BMC type in IPAM,
+// defaulting to IPMI, and authenticates with credentials from Credentials.
+type Manager struct {
+	Credentials CredentialProvider
+	Timeout     time.Duration
+}
+
+// Connect returns a driver for the BMC of host.
+func (m *Manager) Connect(host ipam.Host) (Driver, error) {
+	if m.Credentials == nil {
+		return nil, fmt.Errorf("no bmc credentials configured")
+	}
+	credentials, err := m.Credentials.Credentials(host)
+	if err != nil {
+		return nil, err
+	}
+	return m.driver(host.Bmc, credentials)
+}
+
+// Console opens the serial console of host over IPMI SOL. Redfish BMCs are
+// reached through their IPMI interface too, as Redfish only offers serial
+// consoles over SSH.
+func (m *Manager) Console(host ipam.Host) (io.ReadCloser, error) {
+	if m.Credentials == nil {
+		return nil, fmt.Errorf("no bmc credentials configured")
+	}
+	credentials, err := m.Credentials.Credentials(host)
+	if err != nil {
+		return nil, err
+	}
+	address, err := bmcAddress(host.Bmc)
+	if err != nil {
+		return nil, err
+	}
+	if hostname, _, err := net.SplitHostPort(address); err == nil && host.Bmc.Type == TypeRedfish {
+		// The port is the Redfish one.
+		address = hostname
+	}
+	ipmi := &IPMI{
+		Address:     address,
+		Credentials: credentials,
+		Timeout:     m.timeout(),
+	}
+	return ipmi.Console()
+}
+
+// Rotate sets a new random password for the BMC user of host and records it
+// in the credential store. The password is recorded before it is set so it
+// can't be lost, and restored if the BMC rejects the change.
+func (m *Manager) Rotate(host ipam.Host) error {
+	store, ok := m.Credentials.(CredentialStore)
+	if !ok {
+		return fmt.Errorf("bmc credentials can't be rotated: provider is read-only")
+	}
+	current, err := store.Credentials(host)
+	if err != nil {
+		return err
+	}
+	driver, err := m.driver(host.Bmc, current)
+	if err != nil {
+		return err
+	}
+	password, err := randomPassword()
+	if err != nil {
+		return err
+	}
+	rotated := Credentials{
+		Username: current.Username,
+		Password: password,
+	}
+
+	if err := store.SetCredentials(host.Hostname, rotated); err != nil {
+		return fmt.Errorf("recording new bmc password for %v: %v", host.Hostname, err)
+	}
+	err = driver.SetPassword(current.Username, password)
+	if err == nil {
+		return nil
+	}
+
+	// The BMC may have applied the change even though the request failed, in
+	// which case the new password is the one to keep.
+	if check, checkErr := m.driver(host.Bmc, rotated); checkErr == nil {
+		if _, checkErr := check.PowerStatus(); checkErr == nil {
+			return nil
+		}
+	}
+	if restoreErr := store.SetCredentials(host.Hostname, current); restoreErr != nil {
+		return fmt.Errorf("setting bmc password for %v: %v (restoring old password: %v)", host.Hostname, err, restoreErr)
+	}
+	return fmt.Errorf("setting bmc password for %v: %v", host.Hostname, err)
+}
+
+func (m *Manager) driver(b ipam.BMC, credentials Credentials) (Driver, error) {
+	address, err := bmcAddress(b)
+	if err != nil {
+		return nil, err
+	}
+
+	switch b.Type {
+	case "", TypeIPMI:
+		return &IPMI{
+			Address:     address,
+			Credentials: credentials,
+			Timeout:     m.timeout(),
+			BootMode:    b.BootMode,
+		}, nil
+	case TypeRedfish:
+		return &Redfish{
+			Endpoint:    "https://" + address,
+			Credentials: credentials,
+			Timeout:     m.timeout(),
+			BootMode:    b.BootMode,
+		}, nil
+	}
+	return nil, fmt.Errorf("unknown bmc type %q", b.Type)
+}
+
+func (m *Manager) timeout() time.Duration {
+	if m.Timeout == 0 {
+		return DefaultTimeout
+	}
+	return m.Timeout
+}
+
+func bmcAddress(b ipam.BMC) (string, error) {
+	address := b.Hostname
+	if address == "" && b.Ipv4 != nil {
+		address = b.Ipv4.String()
+	}
+	if address == "" {
+		return "", fmt.Errorf("bmc has no hostname or address")
+	}
+	return address, nil
+}
@@ -0,0 +1,277 @@
+package bmc
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/nik-johnson-net/rackdirector/pkg/ipam"
+)
+
+// Credentials authenticate to a BMC.
+type Credentials struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+}
+
+// CredentialProvider resolves the credentials of a host's BMC.
+type CredentialProvider interface {
+	Credentials(host ipam.Host) (Credentials, error)
+}
+
+// CredentialStore is a CredentialProvider which can also record new
+// credentials for a single host, as needed to rotate passwords.
+type CredentialStore interface {
+	CredentialProvider
+	SetCredentials(hostname string, credentials Credentials) error
+}
+
+// credentialSet holds credentials for individual hosts, for groups of hosts
+// sharing a tag and a default for everything else. Host credentials win over
+// tag credentials, which are tried in the order the host lists its tags.
+type credentialSet struct {
+	Default *Credentials           `json:"default,omitempty"`
+	Tags    map[string]Credentials `json:"tags,omitempty"`
+	Hosts   map[string]Credentials `json:"hosts,omitempty"`
+}
+
+func (c credentialSet) lookup(host ipam.Host) (Credentials, error) {
+	if credentials, ok := c.Hosts[host.Hostname]; ok {
+		return credentials, nil
+	}
+	for _, tag := range host.Tags {
+		if credentials, ok := c.Tags[tag]; ok {
+			return credentials, nil
+		}
+	}
+	if c.Default != nil {
+		return *c.Default, nil
+	}
+	return Credentials{}, fmt.Errorf("no bmc credentials for %v", host.Hostname)
+}
+
+// FileCredentials is a CredentialStore backed by a JSON file of the form
+//
+//	{
+//	  "default": {"username": "...", "password": "..."},
+//	  "tags": {"compute": {"username": "...", "password": "..."}},
+//	  "hosts": {"echo-1.echo.jnstw.net": {"username": "...", "password": "..."}}
+//	}
+//
+// The file is read on every lookup so edits apply without a restart. If Key is
+// set the file is encrypted at rest with AES-256-GCM; EncryptCredentials
+// produces such a file from a plaintext one.
+type FileCredentials struct {
+	Path string
+	Key  []byte
+	mu   sync.Mutex
+}
+
+func (f *FileCredentials) Credentials(host ipam.Host) (Credentials, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	set, err := f.load()
+	if err != nil {
+		return Credentials{}, err
+	}
+	return set.lookup(host)
+}
+
+// SetCredentials records credentials for hostname, creating the file if it
+// doesn't exist.
+func (f *FileCredentials) SetCredentials(hostname string, credentials Credentials) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	set, err := f.load()
+	if err != nil {
+		return err
+	}
+	if set.Hosts == nil {
+		set.Hosts = make(map[string]Credentials)
+	}
+	set.Hosts[hostname] = credentials
+	return f.save(set)
+}
+
+func (f *FileCredentials) load() (credentialSet, error) {
+	var set credentialSet
+	data, err := ioutil.ReadFile(f.Path)
+	if os.IsNotExist(err) {
+		return set, nil
+	} else if err != nil {
+		return set, err
+	}
+	if f.Key != nil {
+		data, err = decrypt(f.Key, data)
+		if err != nil {
+			return set, fmt.Errorf("decrypting %v: %v", f.Path, err)
+		}
+	}
+	if err := json.Unmarshal(data, &set); err != nil {
+		return set, fmt.Errorf("parsing %v: %v", f.Path, err)
+	}
+	return set, nil
+}
+
+func (f *FileCredentials) save(set credentialSet) error {
+	data, err := json.MarshalIndent(set, "", "  ")
+	if err != nil {
+		return err
+	}
+	if f.Key != nil {
+		data, err = encrypt(f.Key, data)
+		if err != nil {
+			return err
+		}
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(f.Path), filepath.Base(f.Path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), f.Path)
+}
+
+// EncryptCredentials writes the plaintext credentials file source to
+// destination, encrypted with key.
+func EncryptCredentials(source string, destination string, key []byte) error {
+	plain := FileCredentials{Path: source}
+	set, err := plain.load()
+	if err != nil {
+		return err
+	}
+	encrypted := FileCredentials{Path: destination, Key: key}
+	return encrypted.save(set)
+}
+
+// LoadKey reads a 256 bit key stored hex encoded in path, such as one made by
+// `openssl rand -hex 32`.
+func LoadKey(path string) ([]byte, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	key, err := hex.DecodeString(strings.TrimSpace(string(data)))
+	if err != nil {
+		return nil, fmt.Errorf("parsing key %v: %v", path, err)
+	}
+	if len(key) != 32 {
+		return nil, fmt.Errorf("key %v is %d bytes, expected 32", path, len(key))
+	}
+	return key, nil
+}
+
+// encrypt seals data with AES-256-GCM, prefixing the random nonce.
+func encrypt(key []byte, data []byte) ([]byte, error) {
+	aead, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return aead.Seal(nonce, nonce, data, nil), nil
+}
+
+func decrypt(key []byte, data []byte) ([]byte, error) {
+	aead, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) < aead.NonceSize() {
+		return nil, fmt.Errorf("ciphertext too short")
+	}
+	return aead.Open(nil, data[:aead.NonceSize()], data[aead.NonceSize():], nil)
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// EnvCredentials is a read-only CredentialProvider reading credentials from
+// environment variables. For a host tagged compute with Prefix RACKDIRECTOR_BMC
+// it tries, in order,
+//
+//	RACKDIRECTOR_BMC_HOST_ECHO_1_ECHO_JNSTW_NET_USERNAME and _PASSWORD
+//	RACKDIRECTOR_BMC_TAG_COMPUTE_USERNAME and _PASSWORD
+//	RACKDIRECTOR_BMC_USERNAME and _PASSWORD
+//
+// where anything but letters and digits in a name becomes an underscore.
+type EnvCredentials struct {
+	Prefix string
+}
+
+func (e EnvCredentials) Credentials(host ipam.Host) (Credentials, error) {
+	names := []string{e.Prefix + "_HOST_" + envName(host.Hostname)}
+	for _, tag := range host.Tags {
+		names = append(names, e.Prefix+"_TAG_"+envName(tag))
+	}
+	names = append(names, e.Prefix)
+
+	for _, name := range names {
+		username, ok := os.LookupEnv(name + "_USERNAME")
+		if !ok {
+			continue
+		}
+		return Credentials{
+			Username: username,
+			Password: os.Getenv(name + "_PASSWORD"),
+		}, nil
+	}
+	return Credentials{}, fmt.Errorf("no bmc credentials for %v in the environment", host.Hostname)
+}
+
+func envName(name string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z':
+			return r - 'a' + 'A'
+		case r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+			return r
+		}
+		return '_'
+	}, name)
+}
+
+const passwordCharset = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789"
+
+// passwordLength fits the 16 byte limit of IPMI v1.5 passwords.
+const passwordLength = 16
+
+func randomPassword() (string, error) {
+	password := make([]byte, passwordLength)
+	max := big.NewInt(int64(len(passwordCharset)))
+	for i := range password {
+		n, err := rand.Int(rand.Reader, max)
+		if err != nil {
+			return "", err
+		}
+		password[i] = passwordCharset[n.Int64()]
+	}
+	return string(password), nil
+}
@@ -0,0 +1,596 @@
+package bmc
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"time"
+)
+
+// DefaultIPMIPort is the RMCP port BMCs listen on.
+const DefaultIPMIPort = "623"
+
+const (
+	rmcpVersion   = 0x06
+	rmcpClassIPMI = 0x07
+	authTypeRMCPP = 0x06
+
+	payloadIPMI              = 0x00
+	payloadOpenSessionReq    = 0x10
+	payloadOpenSessionResp   = 0x11
+	payloadRAKP1             = 0x12
+	payloadRAKP2             = 0x13
+	payloadRAKP3             = 0x14
+	payloadRAKP4             = 0x15
+	payloadFlagEncrypted     = 0x80
+	payloadFlagAuthenticated = 0x40
+
+	privilegeAdministrator = 0x04
+	// roleNameOnlyLookup makes the BMC look the user up by name alone.
+	roleNameOnlyLookup = 0x10
+
+	addressBMC    = 0x20
+	addressRemote = 0x81
+
+	netFnChassis = 0x00
+	netFnApp     = 0x06
+
+	cmdGetChassisStatus         = 0x01
+	cmdGetDeviceID              = 0x01
+	cmdChassisControl           = 0x02
+	cmdSetSystemBootOptions     = 0x08
+	cmdSetSessionPrivilegeLevel = 0x3b
+	cmdCloseSession             = 0x3c
+	cmdGetUserAccess            = 0x44
+	cmdGetUserName              = 0x46
+	cmdSetUserPassword          = 0x47
+
+	chassisPowerDown  = 0x00
+	chassisPowerUp    = 0x01
+	chassisPowerCycle = 0x02
+
+	bootParameterFlags = 0x05
+	bootFlagsValid     = 0x80
+	bootFlagsEFI       = 0x20
+
+	channelCurrent      = 0x0e
+	passwordOpSet       = 0x02
+	passwordSize20      = 0x80
+	maxPasswordLength   = 20
+	shortPasswordLength = 16
+)
+
+var ipmiBootDevices = map[BootDevice]byte{
+	BootPXE:  0x04,
+	BootDisk: 0x08,
+	BootBIOS: 0x18,
+}
+
+// IPMI is a Driver speaking IPMI v2.0 over LAN (RMCP+) with cipher suite 3:
+// RAKP-HMAC-SHA1 authentication, HMAC-SHA1-96 integrity and AES-CBC-128
+// confidentiality. Each operation runs in its own session.
+type IPMI struct {
+	// Address is the BMC host, optionally with a port.
+	Address     string
+	Credentials Credentials
+	Timeout     time.Duration
+	// BootMode is the firmware mode the boot override applies to. Legacy
+	// BIOS is assumed if it is empty.
+	BootMode string
+}
+
+func (i *IPMI) PowerOn() error {
+	return i.chassisControl(chassisPowerUp)
+}
+
+func (i *IPMI) PowerOff() error {
+	return i.chassisControl(chassisPowerDown)
+}
+
+// PowerCycle power cycles the host, or powers it on if it is off, as BMCs
+// refuse to cycle a host which is off.
+func (i *IPMI) PowerCycle() error {
+	return i.withSession(func(s *ipmiSession) error {
+		on, err := s.powerOn()
+		if err != nil {
+			return err
+		}
+		if !on {
+			_, err = s.command(netFnChassis, cmdChassisControl, []byte{chassisPowerUp})
+			return err
+		}
+		_, err = s.command(netFnChassis, cmdChassisControl, []byte{chassisPowerCycle})
+		return err
+	})
+}
+
+func (i *IPMI) PowerStatus() (PowerState, error) {
+	state := PowerUnknown
+	err := i.withSession(func(s *ipmiSession) error {
+		on, err := s.powerOn()
+		if err != nil {
+			return err
+		}
+		state = PowerOff
+		if on {
+			state = PowerOn
+		}
+		return nil
+	})
+	return state, err
+}
+
+func (i *IPMI) SetNextBoot(device BootDevice) error {
+	selector, ok := ipmiBootDevices[device]
+	if !ok {
+		return fmt.Errorf("unsupported boot device %v", device)
+	}
+	flags := byte(bootFlagsValid)
+	switch i.BootMode {
+	case BootModeUEFI:
+		flags |= bootFlagsEFI
+	case "", BootModeLegacy:
+	default:
+		return fmt.Errorf("unsupported boot mode %v", i.BootMode)
+	}
+	return i.withSession(func(s *ipmiSession) error {
+		_, err := s.command(netFnChassis, cmdSetSystemBootOptions, []byte{
+			bootParameterFlags, flags, selector, 0, 0, 0,
+		})
+		return err
+	})
+}
+
+// SetPassword looks up the user ID of username and sets its password.
+// Passwords longer than 16 bytes are stored in the IPMI v2.0 20 byte form.
+func (i *IPMI) SetPassword(username string, password string) error {
+	if len(password) > maxPasswordLength {
+		return fmt.Errorf("password longer than %d bytes", maxPasswordLength)
+	}
+	return i.withSession(func(s *ipmiSession) error {
+		userID, err := s.userID(username)
+		if err != nil {
+			return err
+		}
+		size := shortPasswordLength
+		if len(password) > shortPasswordLength {
+			size = maxPasswordLength
+			userID |= passwordSize20
+		}
+		data := []byte{userID, passwordOpSet}
+		data = append(data, password...)
+		data = append(data, make([]byte, size-len(password))...)
+		_, err = s.command(netFnApp, cmdSetUserPassword, data)
+		return err
+	})
+}
+
+func (i *IPMI) chassisControl(control byte) error {
+	return i.withSession(func(s *ipmiSession) error {
+		_, err := s.command(netFnChassis, cmdChassisControl, []byte{control})
+		return err
+	})
+}
+
+// withSession opens a session, runs fn in it and closes it again.
+func (i *IPMI) withSession(fn func(s *ipmiSession) error) error {
+	s, err := i.open()
+	if err != nil {
+		return fmt.Errorf("ipmi %v: %v", i.Address, err)
+	}
+	defer s.close()
+
+	if err := fn(s); err != nil {
+		return fmt.Errorf("ipmi %v: %v", i.Address, err)
+	}
+	return nil
+}
+
+type ipmiSession struct {
+	conn      net.Conn
+	timeout   time.Duration
+	consoleID uint32
+	managedID uint32
+	sequence  uint32
+	rqSeq     byte
+	k1        []byte
+	k2        []byte
+}
+
+func (i *IPMI) open() (*ipmiSession, error) {
+	address := i.Address
+	if _, _, err := net.SplitHostPort(address); err != nil {
+		address = net.JoinHostPort(address, DefaultIPMIPort)
+	}
+	timeout := i.Timeout
+	if timeout == 0 {
+		timeout = DefaultTimeout
+	}
+
+	conn, err := net.DialTimeout("udp", address, timeout)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &ipmiSession{
+		conn:    conn,
+		timeout: timeout,
+	}
+	if err := s.establish(i.Credentials); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if _, err := s.command(netFnApp, cmdSetSessionPrivilegeLevel, []byte{privilegeAdministrator}); err != nil {
+		s.close()
+		return nil, err
+	}
+	return s, nil
+}
+
+// establish runs the RMCP+ open session and RAKP handshake, deriving the
+// session integrity and confidentiality keys.
+func (s *ipmiSession) establish(credentials Credentials) error {
+	var consoleID [4]byte
+	if _, err := rand.Read(consoleID[:]); err != nil {
+		return err
+	}
+	s.consoleID = binary.LittleEndian.Uint32(consoleID[:])
+
+	request := []byte{0, privilegeAdministrator, 0, 0}
+	request = append(request, consoleID[:]...)
+	request = append(request,
+		0x00, 0, 0, 0x08, 0x01, 0, 0, 0, // RAKP-HMAC-SHA1
+		0x01, 0, 0, 0x08, 0x01, 0, 0, 0, // HMAC-SHA1-96
+		0x02, 0, 0, 0x08, 0x01, 0, 0, 0, // AES-CBC-128
+	)
+	response, err := s.exchange(payloadOpenSessionReq, payloadOpenSessionResp, request)
+	if err != nil {
+		return err
+	}
+	if len(response) < 12 {
+		return fmt.Errorf("short open session response")
+	}
+	if response[1] != 0 {
+		return fmt.Errorf("open session rejected: %v", rakpStatus(response[1]))
+	}
+	s.managedID = binary.LittleEndian.Uint32(response[8:12])
+	managedID := response[8:12]
+
+	username := []byte(credentials.Username)
+	if len(username) > 16 {
+		return fmt.Errorf("username longer than 16 bytes")
+	}
+	role := byte(privilegeAdministrator | roleNameOnlyLookup)
+	var consoleRandom [16]byte
+	if _, err := rand.Read(consoleRandom[:]); err != nil {
+		return err
+	}
+
+	request = []byte{0, 0, 0, 0}
+	request = append(request, managedID...)
+	request = append(request, consoleRandom[:]...)
+	request = append(request, role, 0, 0, byte(len(username)))
+	request = append(request, username...)
+	response, err = s.exchange(payloadRAKP1, payloadRAKP2, request)
+	if err != nil {
+		return err
+	}
+	if len(response) >= 2 && response[1] != 0 {
+		return fmt.Errorf("rakp 2 rejected: %v", rakpStatus(response[1]))
+	}
+	if len(response) < 60 {
+		return fmt.Errorf("short rakp 2 response")
+	}
+	managedRandom := response[8:24]
+	managedGUID := response[24:40]
+
+	key := []byte(credentials.Password)
+	expected := hmacSHA1(key, consoleID[:], managedID, consoleRandom[:], managedRandom, managedGUID,
+		[]byte{role, byte(len(username))}, username)
+	if !hmac.Equal(expected, response[40:60]) {
+		return fmt.Errorf("bmc rejected the credentials for %v", credentials.Username)
+	}
+
+	request = []byte{0, 0, 0, 0}
+	request = append(request, managedID...)
+	request = append(request, hmacSHA1(key, managedRandom, consoleID[:], []byte{role, byte(len(username))}, username)...)
+	response, err = s.exchange(payloadRAKP3, payloadRAKP4, request)
+	if err != nil {
+		return err
+	}
+	if len(response) >= 2 && response[1] != 0 {
+		return fmt.Errorf("rakp 4 rejected: %v", rakpStatus(response[1]))
+	}
+	if len(response) < 20 {
+		return fmt.Errorf("short rakp 4 response")
+	}
+
+	sik := hmacSHA1(key, consoleRandom[:], managedRandom, []byte{role, byte(len(username))}, username)
+	if !hmac.Equal(hmacSHA1(sik, consoleRandom[:], managedID, managedGUID)[:12], response[8:20]) {
+		return fmt.Errorf("rakp 4 integrity check failed")
+	}
+	s.k1 = hmacSHA1(sik, bytes.Repeat([]byte{0x01}, 20))
+	s.k2 = hmacSHA1(sik, bytes.Repeat([]byte{0x02}, 20))
+	return nil
+}
+
+// exchange sends a session-less payload and returns the payload of the reply.
+func (s *ipmiSession) exchange(payloadType byte, responseType byte, payload []byte) ([]byte, error) {
+	packet := rmcpPacket(payloadType, 0, 0, payload)
+	return s.roundTrip(packet, func(reply []byte) ([]byte, bool, error) {
+		replyType, _, replyPayload, err := parseRMCPPacket(reply)
+		if err != nil {
+			return nil, false, err
+		}
+		if replyType&0x3f != responseType {
+			return nil, false, nil
+		}
+		return replyPayload, true, nil
+	})
+}
+
+// command runs an IPMI command in the session and returns the response data.
+func (s *ipmiSession) command(netFn byte, cmd byte, data []byte) ([]byte, error) {
+	message := s.message(netFn, cmd, data)
+	rqSeq := s.rqSeq
+
+	packet, err := s.seal(payloadIPMI, message)
+	if err != nil {
+		return nil, err
+	}
+	return s.roundTrip(packet, func(reply []byte) ([]byte, bool, error) {
+		replyType, response, ok, err := s.unseal(reply)
+		if !ok || err != nil || replyType != payloadIPMI {
+			return nil, false, err
+		}
+		if len(response) < 8 || response[4]>>2 != rqSeq || response[5] != cmd {
+			return nil, false, nil
+		}
+		if response[6] != 0 {
+			return nil, true, completionError{cmd: cmd, code: response[6]}
+		}
+		return response[7 : len(response)-1], true, nil
+	})
+}
+
+// message builds an IPMI request message with the next request sequence
+// number.
+func (s *ipmiSession) message(netFn byte, cmd byte, data []byte) []byte {
+	s.rqSeq = (s.rqSeq + 1) & 0x3f
+
+	message := []byte{addressBMC, netFn << 2}
+	message = append(message, checksum(message))
+	body := append([]byte{addressRemote, s.rqSeq << 2, cmd}, data...)
+	message = append(message, body...)
+	return append(message, checksum(body))
+}
+
+// completionError is a command which the BMC answered with a non-zero
+// completion code.
+type completionError struct {
+	cmd  byte
+	code byte
+}
+
+func (e completionError) Error() string {
+	return fmt.Sprintf("command %#02x failed with completion code %#02x", e.cmd, e.code)
+}
+
+// seal encrypts and signs payload as the next packet of the session.
+func (s *ipmiSession) seal(payloadType byte, payload []byte) ([]byte, error) {
+	s.sequence++
+	encrypted, err := s.encrypt(payload)
+	if err != nil {
+		return nil, err
+	}
+	packet := rmcpPacket(payloadType|payloadFlagEncrypted|payloadFlagAuthenticated, s.managedID, s.sequence, encrypted)
+	return s.sign(packet), nil
+}
+
+// unseal checks the integrity of a session packet and decrypts it. ok is
+// false for packets which don't belong to the session.
+func (s *ipmiSession) unseal(packet []byte) (byte, []byte, bool, error) {
+	if len(packet) < 16+12 {
+		return 0, nil, false, nil
+	}
+	expected := hmacSHA1(s.k1, packet[4:len(packet)-12])[:12]
+	if !hmac.Equal(expected, packet[len(packet)-12:]) {
+		return 0, nil, false, nil
+	}
+	payloadType, sessionID, payload, err := parseRMCPPacket(packet)
+	if err != nil {
+		return 0, nil, false, err
+	}
+	if sessionID != s.consoleID {
+		return 0, nil, false, nil
+	}
+	message, err := s.decrypt(payload)
+	if err != nil {
+		return 0, nil, false, err
+	}
+	return payloadType & 0x3f, message, true, nil
+}
+
+// roundTrip sends packet, retrying on timeout, until match accepts a reply.
+func (s *ipmiSession) roundTrip(packet []byte, match func(reply []byte) ([]byte, bool, error)) ([]byte, error) {
+	buffer := make([]byte, 1024)
+	for attempt := 0; attempt < 3; attempt++ {
+		if _, err := s.conn.Write(packet); err != nil {
+			return nil, err
+		}
+		s.conn.SetReadDeadline(time.Now().Add(s.timeout / 3))
+		for {
+			n, err := s.conn.Read(buffer)
+			if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+				break
+			} else if err != nil {
+				return nil, err
+			}
+			reply, ok, err := match(buffer[:n])
+			if err != nil {
+				return nil, err
+			}
+			if ok {
+				return append([]byte(nil), reply...), nil
+			}
+		}
+	}
+	return nil, fmt.Errorf("timed out waiting for bmc")
+}
+
+func (s *ipmiSession) powerOn() (bool, error) {
+	status, err := s.command(netFnChassis, cmdGetChassisStatus, nil)
+	if err != nil {
+		return false, err
+	}
+	if len(status) < 1 {
+		return false, fmt.Errorf("short chassis status response")
+	}
+	return status[0]&0x01 != 0, nil
+}
+
+// userID finds the user ID of username on the current channel.
+func (s *ipmiSession) userID(username string) (byte, error) {
+	access, err := s.command(netFnApp, cmdGetUserAccess, []byte{channelCurrent, 1})
+	if err != nil {
+		return 0, err
+	}
+	if len(access) < 1 {
+		return 0, fmt.Errorf("short user access response")
+	}
+	maxUsers := access[0] & 0x3f
+	for id := byte(1); id <= maxUsers; id++ {
+		name, err := s.command(netFnApp, cmdGetUserName, []byte{id})
+		if err != nil {
+			continue
+		}
+		if string(bytes.TrimRight(name, "\x00")) == username {
+			return id, nil
+		}
+	}
+	return 0, fmt.Errorf("no user %v", username)
+}
+
+func (s *ipmiSession) close() {
+	var managedID [4]byte
+	binary.LittleEndian.PutUint32(managedID[:], s.managedID)
+	if s.k1 != nil {
+		s.command(netFnApp, cmdCloseSession, managedID[:])
+	}
+	s.conn.Close()
+}
+
+// encrypt wraps message in the AES-CBC-128 confidentiality header and
+// trailer.
+func (s *ipmiSession) encrypt(message []byte) ([]byte, error) {
+	padLength := (aes.BlockSize - (len(message)+1)%aes.BlockSize) % aes.BlockSize
+	plaintext := append([]byte(nil), message...)
+	for i := 1; i <= padLength; i++ {
+		plaintext = append(plaintext, byte(i))
+	}
+	plaintext = append(plaintext, byte(padLength))
+
+	block, err := aes.NewCipher(s.k2[:16])
+	if err != nil {
+		return nil, err
+	}
+	payload := make([]byte, aes.BlockSize+len(plaintext))
+	iv := payload[:aes.BlockSize]
+	if _, err := rand.Read(iv); err != nil {
+		return nil, err
+	}
+	cipher.NewCBCEncrypter(block, iv).CryptBlocks(payload[aes.BlockSize:], plaintext)
+	return payload, nil
+}
+
+func (s *ipmiSession) decrypt(payload []byte) ([]byte, error) {
+	if len(payload) < 2*aes.BlockSize || len(payload)%aes.BlockSize != 0 {
+		return nil, fmt.Errorf("malformed encrypted payload")
+	}
+	block, err := aes.NewCipher(s.k2[:16])
+	if err != nil {
+		return nil, err
+	}
+	plaintext := make([]byte, len(payload)-aes.BlockSize)
+	cipher.NewCBCDecrypter(block, payload[:aes.BlockSize]).CryptBlocks(plaintext, payload[aes.BlockSize:])
+
+	padLength := int(plaintext[len(plaintext)-1])
+	if padLength+1 > len(plaintext) {
+		return nil, fmt.Errorf("malformed confidentiality trailer")
+	}
+	return plaintext[:len(plaintext)-1-padLength], nil
+}
+
+// sign appends the integrity trailer to an authenticated packet.
+func (s *ipmiSession) sign(packet []byte) []byte {
+	// The session header through the next header byte must be a multiple of
+	// four bytes long.
+	padLength := (4 - (len(packet)-4+2)%4) % 4
+	packet = append(packet, bytes.Repeat([]byte{0xff}, padLength)...)
+	packet = append(packet, byte(padLength), rmcpClassIPMI)
+	return append(packet, hmacSHA1(s.k1, packet[4:])[:12]...)
+}
+
+func rmcpPacket(payloadType byte, sessionID uint32, sequence uint32, payload []byte) []byte {
+	packet := []byte{rmcpVersion, 0x00, 0xff, rmcpClassIPMI, authTypeRMCPP, payloadType}
+	var header [10]byte
+	binary.LittleEndian.PutUint32(header[0:4], sessionID)
+	binary.LittleEndian.PutUint32(header[4:8], sequence)
+	binary.LittleEndian.PutUint16(header[8:10], uint16(len(payload)))
+	packet = append(packet, header[:]...)
+	return append(packet, payload...)
+}
+
+func parseRMCPPacket(packet []byte) (byte, uint32, []byte, error) {
+	if len(packet) < 16 || packet[0] != rmcpVersion || packet[3] != rmcpClassIPMI {
+		return 0, 0, nil, fmt.Errorf("malformed rmcp packet")
+	}
+	if packet[4] != authTypeRMCPP {
+		return 0, 0, nil, fmt.Errorf("unsupported auth type %#02x", packet[4])
+	}
+	length := int(binary.LittleEndian.Uint16(packet[14:16]))
+	if len(packet) < 16+length {
+		return 0, 0, nil, fmt.Errorf("truncated rmcp packet")
+	}
+	return packet[5], binary.LittleEndian.Uint32(packet[6:10]), packet[16 : 16+length], nil
+}
+
+func checksum(data []byte) byte {
+	var sum byte
+	for _, b := range data {
+		sum += b
+	}
+	return -sum
+}
+
+func hmacSHA1(key []byte, data ...[]byte) []byte {
+	mac := hmac.New(sha1.New, key)
+	for _, d := range data {
+		mac.Write(d)
+	}
+	return mac.Sum(nil)
+}
+
+var rakpStatusCodes = map[byte]string{
+	0x01: "insufficient resources to create a session",
+	0x02: "invalid session id",
+	0x05: "invalid role",
+	0x09: "invalid name length",
+	0x0d: "unauthorized name",
+	0x0f: "invalid integrity check value",
+	0x11: "no cipher suite match",
+	0x12: "invalid role",
+}
+
+func rakpStatus(code byte) string {
+	if status, ok := rakpStatusCodes[code]; ok {
+		return status
+	}
+	return fmt.Sprintf("status %#02x", code)
+}
@@ -0,0 +1,174 @@
+package bmc
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/nik-johnson-net/rackdirector/pkg/ipam"
+)
+
+// DefaultPollInterval is how often a Poller queries each BMC by default.
+const DefaultPollInterval = time.Minute
+
+// pollWorkers bounds how many BMCs are queried at once.
+const pollWorkers = 16
+
+// HostStatus is what a host's BMC last reported.
+type HostStatus struct {
+	Hostname  string
+	Reachable bool
+	Power     PowerState
+	// Health and SEL are only reported by BMCs which support them.
+	Health        string      `json:",omitempty"`
+	SEL           *SELSummary `json:",omitempty"`
+	Error         string      `json:",omitempty"`
+	LastPoll      time.Time
+	LastReachable time.Time
+}
+
+// Poller queries the BMC of every host in IPAM on an interval and keeps the
+// latest status of each.
+type Poller struct {
+	BMC      Connector
+	IPAM     ipam.Store
+	Interval time.Duration
+
+	mu       sync.Mutex
+	statuses map[string]HostStatus
+}
+
+// Run polls every BMC until ctx is done, starting immediately.
+func (p *Poller) Run(ctx context.Context) {
+	interval := p.Interval
+	if interval == 0 {
+		interval = DefaultPollInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		p.PollAll(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// PollAll queries every BMC once, giving up on those not yet polled once ctx
+// is done.
+func (p *Poller) PollAll(ctx context.Context) {
+	hosts := make(chan ipam.Host)
+	var wg sync.WaitGroup
+	for i := 0; i < pollWorkers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for host := range hosts {
+				p.Poll(ctx, host)
+			}
+		}()
+	}
+feed:
+	for _, host := range p.IPAM.Hosts() {
+		select {
+		case hosts <- host:
+		case <-ctx.Done():
+			break feed
+		}
+	}
+	close(hosts)
+	wg.Wait()
+}
+
+// Poll queries the BMC of host and returns its status. If ctx is done first
+// the query is left to time out in the background, and its result isn't kept.
+func (p *Poller) Poll(ctx context.Context, host ipam.Host) HostStatus {
+	status := HostStatus{
+		Hostname: host.Hostname,
+		Power:    PowerUnknown,
+		LastPoll: time.Now(),
+	}
+
+	p.mu.Lock()
+	previous, polled := p.statuses[host.Hostname]
+	p.mu.Unlock()
+	if polled {
+		status.LastReachable = previous.LastReachable
+	}
+
+	queried := make(chan error, 1)
+	result := status
+	go func() {
+		queried <- p.query(host, &result)
+	}()
+	var err error
+	select {
+	case err = <-queried:
+		status = result
+	case <-ctx.Done():
+		status.Error = ctx.Err().Error()
+		return status
+	}
+	if err != nil {
+		status.Error = err.Error()
+		if !polled || previous.Reachable {
+			log.Printf("BMC of %v is unreachable: %v\n", host.Hostname, err)
+		}
+	} else {
+		status.Reachable = true
+		status.LastReachable = status.LastPoll
+		if polled && !previous.Reachable {
+			log.Printf("BMC of %v is reachable again\n", host.Hostname)
+		}
+	}
+
+	p.mu.Lock()
+	if p.statuses == nil {
+		p.statuses = make(map[string]HostStatus)
+	}
+	p.statuses[host.Hostname] = status
+	p.mu.Unlock()
+	return status
+}
+
+// query fills in status from the BMC of host. Only failing to read the power
+// state makes the BMC unreachable; health is best effort.
+func (p *Poller) query(host ipam.Host, status *HostStatus) error {
+	driver, err := p.BMC.Connect(host)
+	if err != nil {
+		return err
+	}
+	status.Power, err = driver.PowerStatus()
+	if err != nil {
+		return err
+	}
+
+	reporter, ok := driver.(HealthReporter)
+	if !ok {
+		return nil
+	}
+	health, err := reporter.Health()
+	if err != nil {
+		log.Printf("Failed to read health of %v: %v\n", host.Hostname, err)
+		return nil
+	}
+	status.Health = health.Status
+	status.SEL = health.SEL
+	return nil
+}
+
+// Status returns the last polled status of hostname, if it has been polled.
+// A nil *Poller has polled nothing.
+func (p *Poller) Status(hostname string) (HostStatus, bool) {
+	if p == nil {
+		return HostStatus{}, false
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	status, ok := p.statuses[hostname]
+	return status, ok
+}
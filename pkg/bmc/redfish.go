@@ -0,0 +1,345 @@
+package bmc
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+)
+
+var redfishBootTargets = map[BootDevice]string{
+	BootPXE:  "Pxe",
+	BootDisk: "Hdd",
+	BootBIOS: "BiosSetup",
+}
+
+var redfishBootModes = map[string]string{
+	BootModeUEFI:   "UEFI",
+	BootModeLegacy: "Legacy",
+}
+
+// redfishTransport is shared by every Redfish driver without a Client of its
+// own. Drivers are made for each connection, and a transport each would
+// leave their keep-alive connections open behind them.
+var redfishTransport = &http.Transport{
+	TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+	IdleConnTimeout: 90 * time.Second,
+}
+
+// Redfish is a Driver for BMCs with a Redfish API. It controls the first
+// ComputerSystem the service lists.
+type Redfish struct {
+	// Endpoint is the base URL of the BMC, such as https://bmc.example.com.
+	Endpoint    string
+	Credentials Credentials
+	Timeout     time.Duration
+	// BootMode is the firmware mode the boot override applies to. The host's
+	// current mode is kept if it is empty.
+	BootMode string
+	// Client is used for requests if set. Otherwise a client which skips
+	// certificate verification is used, as BMCs almost always have
+	// self-signed certificates.
+	Client *http.Client
+
+	system string
+}
+
+type redfishLink struct {
+	ID string `json:"@odata.id"`
+}
+
+type redfishCollection struct {
+	Members []redfishLink
+}
+
+type redfishResetAction struct {
+	AllowableValues []string `json:"ResetType@Redfish.AllowableValues"`
+}
+
+type redfishSystem struct {
+	PowerState string
+	Status     struct {
+		Health       string
+		HealthRollup string
+	}
+	Actions struct {
+		Reset redfishResetAction `json:"#ComputerSystem.Reset"`
+	}
+}
+
+func (r *Redfish) PowerOn() error {
+	return r.reset("On")
+}
+
+func (r *Redfish) PowerOff() error {
+	return r.reset("ForceOff")
+}
+
+// PowerCycle power cycles the host, or powers it on if it is off. Services
+// which don't offer a PowerCycle reset are force restarted instead, or
+// failing that forced off and back on.
+func (r *Redfish) PowerCycle() error {
+	status, err := r.status()
+	if err != nil {
+		return err
+	}
+	if powerState(status.PowerState) == PowerOff {
+		return r.reset("On")
+	}
+
+	allowed := status.Actions.Reset.AllowableValues
+	switch {
+	case len(allowed) == 0 || contains(allowed, "PowerCycle"):
+		return r.reset("PowerCycle")
+	case contains(allowed, "ForceRestart"):
+		return r.reset("ForceRestart")
+	}
+	if err := r.reset("ForceOff"); err != nil {
+		return err
+	}
+	return r.reset("On")
+}
+
+func (r *Redfish) PowerStatus() (PowerState, error) {
+	status, err := r.status()
+	if err != nil {
+		return PowerUnknown, err
+	}
+	return powerState(status.PowerState), nil
+}
+
+func (r *Redfish) status() (redfishSystem, error) {
+	var status redfishSystem
+	system, err := r.systemPath()
+	if err != nil {
+		return status, err
+	}
+	err = r.do(http.MethodGet, system, nil, &status)
+	return status, err
+}
+
+type redfishLogEntries struct {
+	Members []struct {
+		Severity string
+		Message  string
+		Created  string
+	}
+}
+
+// Health reports the health rollup of the system and, if the system has a
+// log service named SEL, a summary of its entries.
+func (r *Redfish) Health() (Health, error) {
+	status, err := r.status()
+	if err != nil {
+		return Health{}, err
+	}
+	health := Health{Status: status.Status.HealthRollup}
+	if health.Status == "" {
+		health.Status = status.Status.Health
+	}
+	health.SEL = r.selSummary()
+	return health, nil
+}
+
+// selSummary returns nil if the SEL can't be read, as many services don't
+// expose one.
+func (r *Redfish) selSummary() *SELSummary {
+	system, err := r.systemPath()
+	if err != nil {
+		return nil
+	}
+	var services redfishCollection
+	if err := r.do(http.MethodGet, system+"/LogServices", nil, &services); err != nil {
+		return nil
+	}
+	for _, service := range services.Members {
+		if !strings.EqualFold(path.Base(service.ID), "SEL") {
+			continue
+		}
+		var entries redfishLogEntries
+		if err := r.do(http.MethodGet, service.ID+"/Entries", nil, &entries); err != nil {
+			return nil
+		}
+
+		summary := &SELSummary{Entries: len(entries.Members)}
+		for _, entry := range entries.Members {
+			switch entry.Severity {
+			case "Warning":
+				summary.Warning++
+			case "Critical":
+				summary.Critical++
+			}
+			created, err := time.Parse(time.RFC3339, entry.Created)
+			if err == nil && !created.Before(summary.LatestTime) {
+				summary.Latest = entry.Message
+				summary.LatestTime = created
+			}
+		}
+		return summary
+	}
+	return nil
+}
+
+func powerState(state string) PowerState {
+	switch state {
+	case "On", "PoweringOff":
+		return PowerOn
+	case "Off", "PoweringOn":
+		return PowerOff
+	}
+	return PowerUnknown
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *Redfish) SetNextBoot(device BootDevice) error {
+	target, ok := redfishBootTargets[device]
+	if !ok {
+		return fmt.Errorf("unsupported boot device %v", device)
+	}
+	boot := map[string]string{
+		"BootSourceOverrideEnabled": "Once",
+		"BootSourceOverrideTarget":  target,
+	}
+	if r.BootMode != "" {
+		mode, ok := redfishBootModes[r.BootMode]
+		if !ok {
+			return fmt.Errorf("unsupported boot mode %v", r.BootMode)
+		}
+		boot["BootSourceOverrideMode"] = mode
+	}
+
+	system, err := r.systemPath()
+	if err != nil {
+		return err
+	}
+	return r.do(http.MethodPatch, system, map[string]interface{}{
+		"Boot": boot,
+	}, nil)
+}
+
+type redfishAccount struct {
+	UserName string
+}
+
+// SetPassword finds the account of username in the AccountService and
+// changes its password. Later requests use the new password.
+func (r *Redfish) SetPassword(username string, password string) error {
+	var accounts redfishCollection
+	if err := r.do(http.MethodGet, "/redfish/v1/AccountService/Accounts", nil, &accounts); err != nil {
+		return err
+	}
+	for _, member := range accounts.Members {
+		var account redfishAccount
+		if err := r.do(http.MethodGet, member.ID, nil, &account); err != nil {
+			return err
+		}
+		if account.UserName != username {
+			continue
+		}
+		err := r.do(http.MethodPatch, member.ID, map[string]string{
+			"Password": password,
+		}, nil)
+		if err != nil {
+			return err
+		}
+		if r.Credentials.Username == username {
+			r.Credentials.Password = password
+		}
+		return nil
+	}
+	return fmt.Errorf("redfish %v: no account %v", r.Endpoint, username)
+}
+
+func (r *Redfish) reset(resetType string) error {
+	system, err := r.systemPath()
+	if err != nil {
+		return err
+	}
+	return r.do(http.MethodPost, system+"/Actions/ComputerSystem.Reset", map[string]string{
+		"ResetType": resetType,
+	}, nil)
+}
+
+// systemPath returns the path of the ComputerSystem to control.
+func (r *Redfish) systemPath() (string, error) {
+	if r.system != "" {
+		return r.system, nil
+	}
+
+	var systems redfishCollection
+	if err := r.do(http.MethodGet, "/redfish/v1/Systems", nil, &systems); err != nil {
+		return "", err
+	}
+	if len(systems.Members) == 0 {
+		return "", fmt.Errorf("redfish %v: no systems", r.Endpoint)
+	}
+	r.system = systems.Members[0].ID
+	return r.system, nil
+}
+
+// do sends a request with an optional JSON body and decodes the JSON
+// response into response if it is not nil.
+func (r *Redfish) do(method string, path string, body interface{}, response interface{}) error {
+	var reader io.Reader
+	if body != nil {
+		encoded, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(encoded)
+	}
+
+	url := strings.TrimSuffix(r.Endpoint, "/") + path
+	request, err := http.NewRequest(method, url, reader)
+	if err != nil {
+		return err
+	}
+	request.SetBasicAuth(r.Credentials.Username, r.Credentials.Password)
+	request.Header.Set("Accept", "application/json")
+	if body != nil {
+		request.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := r.client().Do(request)
+	if err != nil {
+		return fmt.Errorf("redfish %v %v: %v", method, url, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		message, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 4096))
+		return fmt.Errorf("redfish %v %v: %v: %s", method, url, resp.Status, bytes.TrimSpace(message))
+	}
+	if response == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(response)
+}
+
+func (r *Redfish) client() *http.Client {
+	if r.Client != nil {
+		return r.Client
+	}
+	timeout := r.Timeout
+	if timeout == 0 {
+		timeout = DefaultTimeout
+	}
+	return &http.Client{
+		Timeout:   timeout,
+		Transport: redfishTransport,
+	}
+}
@@ -0,0 +1,239 @@
+package bmc
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/nik-johnson-net/rackdirector/pkg/bmc/redfishmock"
+)
+
+type redfishRequest struct {
+	Method string
+	Path   string
+	Body   map[string]interface{}
+}
+
+// redfishRecorder records the requests the driver makes.
+type redfishRecorder struct {
+	base http.RoundTripper
+
+	mu       sync.Mutex
+	requests []redfishRequest
+}
+
+func (r *redfishRecorder) RoundTrip(request *http.Request) (*http.Response, error) {
+	recorded := redfishRequest{Method: request.Method, Path: request.URL.Path}
+	if request.Body != nil {
+		body, err := ioutil.ReadAll(request.Body)
+		if err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal(body, &recorded.Body); err != nil {
+			return nil, err
+		}
+		request.Body = ioutil.NopCloser(bytes.NewReader(body))
+	}
+	r.mu.Lock()
+	r.requests = append(r.requests, recorded)
+	r.mu.Unlock()
+	return r.base.RoundTrip(request)
+}
+
+// changes returns the requests which weren't GETs.
+func (r *redfishRecorder) changes() []redfishRequest {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	changes := make([]redfishRequest, 0)
+	for _, request := range r.requests {
+		if request.Method != http.MethodGet {
+			changes = append(changes, request)
+		}
+	}
+	return changes
+}
+
+func newTestRedfish(t *testing.T) (*Redfish, *redfishmock.Server, *redfishRecorder) {
+	server := redfishmock.New("admin", "password")
+	t.Cleanup(server.Close)
+	recorder := &redfishRecorder{base: server.Client().Transport}
+	r := &Redfish{
+		Endpoint:    server.URL,
+		Credentials: Credentials{Username: "admin", Password: "password"},
+		Client:      &http.Client{Transport: recorder},
+	}
+	return r, server, recorder
+}
+
+func TestRedfishSetNextBoot(t *testing.T) {
+	tests := []struct {
+		mode   string
+		device BootDevice
+		boot   map[string]interface{}
+		state  redfishmock.State
+	}{
+		{
+			mode:   "",
+			device: BootPXE,
+			boot:   map[string]interface{}{"BootSourceOverrideEnabled": "Once", "BootSourceOverrideTarget": "Pxe"},
+			state:  redfishmock.State{BootSourceOverrideEnabled: "Once", BootSourceOverrideTarget: "Pxe", BootSourceOverrideMode: "UEFI"},
+		},
+		{
+			mode:   BootModeLegacy,
+			device: BootPXE,
+			boot:   map[string]interface{}{"BootSourceOverrideEnabled": "Once", "BootSourceOverrideTarget": "Pxe", "BootSourceOverrideMode": "Legacy"},
+			state:  redfishmock.State{BootSourceOverrideEnabled: "Once", BootSourceOverrideTarget: "Pxe", BootSourceOverrideMode: "Legacy"},
+		},
+		{
+			mode:   BootModeUEFI,
+			device: BootDisk,
+			boot:   map[string]interface{}{"BootSourceOverrideEnabled": "Once", "BootSourceOverrideTarget": "Hdd", "BootSourceOverrideMode": "UEFI"},
+			state:  redfishmock.State{BootSourceOverrideEnabled: "Once", BootSourceOverrideTarget: "Hdd", BootSourceOverrideMode: "UEFI"},
+		},
+	}
+	for _, test := range tests {
+		r, server, recorder := newTestRedfish(t)
+		r.BootMode = test.mode
+		if err := r.SetNextBoot(test.device); err != nil {
+			t.Errorf("%v %v: %v", test.mode, test.device, err)
+			continue
+		}
+
+		want := []redfishRequest{{
+			Method: http.MethodPatch,
+			Path:   "/redfish/v1/Systems/1",
+			Body:   map[string]interface{}{"Boot": test.boot},
+		}}
+		if changes := recorder.changes(); !reflect.DeepEqual(changes, want) {
+			t.Errorf("%v %v sent %+v, want %+v", test.mode, test.device, changes, want)
+		}
+		state := server.State()
+		if state.BootSourceOverrideEnabled != test.state.BootSourceOverrideEnabled ||
+			state.BootSourceOverrideTarget != test.state.BootSourceOverrideTarget ||
+			state.BootSourceOverrideMode != test.state.BootSourceOverrideMode {
+			t.Errorf("%v %v left boot override %+v, want %+v", test.mode, test.device, state, test.state)
+		}
+		if len(state.Resets) != 0 {
+			t.Errorf("%v %v reset the system: %v", test.mode, test.device, state.Resets)
+		}
+	}
+
+	r, _, _ := newTestRedfish(t)
+	r.BootMode = "efi"
+	if err := r.SetNextBoot(BootPXE); err == nil {
+		t.Error("unknown boot mode accepted")
+	}
+}
+
+func TestRedfishPowerCycle(t *testing.T) {
+	tests := []struct {
+		name       string
+		power      string
+		resetTypes []string
+		resets     []string
+	}{
+		{"on", "On", nil, []string{"PowerCycle"}},
+		{"off", "Off", nil, []string{"On"}},
+		{"no power cycle", "On", []string{"On", "ForceOff", "ForceRestart"}, []string{"ForceRestart"}},
+		{"no restart", "On", []string{"On", "ForceOff"}, []string{"ForceOff", "On"}},
+	}
+	for _, test := range tests {
+		r, server, _ := newTestRedfish(t)
+		if test.resetTypes != nil {
+			server.ResetTypes = test.resetTypes
+		}
+		server.SetPowerState(test.power)
+
+		if err := r.PowerCycle(); err != nil {
+			t.Errorf("%v: %v", test.name, err)
+			continue
+		}
+		if resets := server.State().Resets; !reflect.DeepEqual(resets, test.resets) {
+			t.Errorf("%v reset with %v, want %v", test.name, resets, test.resets)
+		}
+		if state, err := r.PowerStatus(); err != nil || state != PowerOn {
+			t.Errorf("%v left power %v, %v", test.name, state, err)
+		}
+	}
+}
+
+func TestRedfishPower(t *testing.T) {
+	r, server, _ := newTestRedfish(t)
+	if err := r.PowerOff(); err != nil {
+		t.Fatal(err)
+	}
+	if state, err := r.PowerStatus(); err != nil || state != PowerOff {
+		t.Errorf("power is %v, %v after powering off", state, err)
+	}
+	if err := r.PowerOn(); err != nil {
+		t.Fatal(err)
+	}
+	if resets := server.State().Resets; !reflect.DeepEqual(resets, []string{"ForceOff", "On"}) {
+		t.Errorf("reset with %v", resets)
+	}
+}
+
+func TestRedfishSetPassword(t *testing.T) {
+	r, server, _ := newTestRedfish(t)
+	if err := r.SetPassword("admin", "changed"); err != nil {
+		t.Fatal(err)
+	}
+	if server.Password() != "changed" {
+		t.Errorf("password is %q", server.Password())
+	}
+	if _, err := r.PowerStatus(); err != nil {
+		t.Errorf("new password wasn't used: %v", err)
+	}
+	if err := r.SetPassword("nobody", "password"); err == nil {
+		t.Error("unknown account accepted")
+	}
+
+	r.Credentials.Password = "password"
+	if _, err := r.PowerStatus(); err == nil || !strings.Contains(err.Error(), "401") {
+		t.Errorf("old password gave %v", err)
+	}
+}
+
+func TestRedfishHealth(t *testing.T) {
+	r, server, _ := newTestRedfish(t)
+	server.SetHealth("Warning")
+	server.AddLogEntry(redfishmock.LogEntry{Severity: "Critical", Message: "fan failed", Created: "2020-01-02T00:00:00Z"})
+	server.AddLogEntry(redfishmock.LogEntry{Severity: "OK", Message: "fan replaced", Created: "2020-01-03T00:00:00Z"})
+
+	health, err := r.Health()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if health.Status != "Warning" {
+		t.Errorf("health is %v", health.Status)
+	}
+	if health.SEL == nil || health.SEL.Entries != 2 || health.SEL.Critical != 1 || health.SEL.Latest != "fan replaced" {
+		t.Errorf("sel summary is %+v", health.SEL)
+	}
+}
+
+// TestRedfishDefaultClient checks drivers without a Client reach BMCs with
+// self-signed certificates, and share one transport so the connections they
+// leave idle are reused.
+func TestRedfishDefaultClient(t *testing.T) {
+	server := redfishmock.New("admin", "password")
+	t.Cleanup(server.Close)
+
+	drivers := make([]*Redfish, 3)
+	for i := range drivers {
+		drivers[i] = &Redfish{Endpoint: server.URL, Credentials: Credentials{Username: "admin", Password: "password"}}
+		if state, err := drivers[i].PowerStatus(); err != nil || state != PowerOn {
+			t.Errorf("driver %d got power %v, %v", i, state, err)
+		}
+	}
+	for i, r := range drivers {
+		if r.client().Transport != redfishTransport {
+			t.Errorf("driver %d has a transport of its own", i)
+		}
+	}
+}
@@ -0,0 +1,322 @@
+// Package redfishmock is an in-process Redfish service with a single
+// ComputerSystem, for exercising the Redfish driver without hardware.
+package redfishmock
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+)
+
+const (
+	systemPath   = "/redfish/v1/Systems/1"
+	accountsPath = "/redfish/v1/AccountService/Accounts"
+	accountPath  = accountsPath + "/1"
+	selPath      = systemPath + "/LogServices/SEL"
+)
+
+// LogEntry is an entry in the system event log.
+type LogEntry struct {
+	Severity string
+	Message  string
+	Created  string
+}
+
+// State is the state of the mock ComputerSystem.
+type State struct {
+	PowerState                string
+	BootSourceOverrideEnabled string
+	BootSourceOverrideTarget  string
+	BootSourceOverrideMode    string
+	Health                    string
+	SEL                       []LogEntry
+	// Resets lists every ResetType received, oldest first.
+	Resets []string
+}
+
+// Server is a TLS Redfish service requiring basic auth. Use Client for a
+// client which trusts its certificate, or skip verification as the Redfish
+// driver does by default. Its one account can change its password through
+// the AccountService.
+type Server struct {
+	*httptest.Server
+	Username string
+	// ResetTypes are the reset types the system advertises and accepts. Set
+	// it before making requests.
+	ResetTypes []string
+
+	mu       sync.Mutex
+	password string
+	state    State
+}
+
+// New starts a mock Redfish service for a system which is powered on.
+func New(username string, password string) *Server {
+	s := &Server{
+		Username:   username,
+		password:   password,
+		ResetTypes: []string{"On", "ForceOff", "ForceRestart", "PowerCycle"},
+		state: State{
+			PowerState:                "On",
+			BootSourceOverrideEnabled: "Disabled",
+			BootSourceOverrideTarget:  "None",
+			BootSourceOverrideMode:    "UEFI",
+			Health:                    "OK",
+		},
+	}
+
+	muxer := http.NewServeMux()
+	muxer.HandleFunc("/redfish/v1/Systems", s.systems)
+	muxer.HandleFunc(systemPath, s.system)
+	muxer.HandleFunc(systemPath+"/Actions/ComputerSystem.Reset", s.reset)
+	muxer.HandleFunc(systemPath+"/LogServices", s.logServices)
+	muxer.HandleFunc(selPath+"/Entries", s.selEntries)
+	muxer.HandleFunc(accountsPath, s.accounts)
+	muxer.HandleFunc(accountPath, s.account)
+	s.Server = httptest.NewTLSServer(s.authenticate(muxer))
+	return s
+}
+
+// State returns the current state of the system.
+func (s *Server) State() State {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	state := s.state
+	state.Resets = append([]string(nil), s.state.Resets...)
+	state.SEL = append([]LogEntry(nil), s.state.SEL...)
+	return state
+}
+
+// SetHealth sets the health of the system, such as "OK" or "Critical".
+func (s *Server) SetHealth(health string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.state.Health = health
+}
+
+// AddLogEntry appends entry to the system event log.
+func (s *Server) AddLogEntry(entry LogEntry) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.state.SEL = append(s.state.SEL, entry)
+}
+
+// Password returns the current password of the account.
+func (s *Server) Password() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.password
+}
+
+// SetPowerState sets the power state of the system, such as "On" or "Off".
+func (s *Server) SetPowerState(state string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.state.PowerState = state
+}
+
+func (s *Server) authenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		username, password, ok := r.BasicAuth()
+		if !ok || username != s.Username || password != s.Password() {
+			writeError(w, http.StatusUnauthorized, "Base.1.0.InsufficientPrivilege")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (s *Server) systems(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "Base.1.0.ActionNotSupported")
+		return
+	}
+	writeJSON(w, map[string]interface{}{
+		"@odata.id":           "/redfish/v1/Systems",
+		"Members@odata.count": 1,
+		"Members": []map[string]string{
+			{"@odata.id": systemPath},
+		},
+	})
+}
+
+func (s *Server) system(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	switch r.Method {
+	case http.MethodGet:
+		writeJSON(w, map[string]interface{}{
+			"@odata.id":  systemPath,
+			"Id":         "1",
+			"PowerState": s.state.PowerState,
+			"Status": map[string]string{
+				"State":        "Enabled",
+				"Health":       s.state.Health,
+				"HealthRollup": s.state.Health,
+			},
+			"Boot": map[string]string{
+				"BootSourceOverrideEnabled": s.state.BootSourceOverrideEnabled,
+				"BootSourceOverrideTarget":  s.state.BootSourceOverrideTarget,
+				"BootSourceOverrideMode":    s.state.BootSourceOverrideMode,
+			},
+			"Actions": map[string]interface{}{
+				"#ComputerSystem.Reset": map[string]interface{}{
+					"target":                            systemPath + "/Actions/ComputerSystem.Reset",
+					"ResetType@Redfish.AllowableValues": s.ResetTypes,
+				},
+			},
+		})
+
+	case http.MethodPatch:
+		var patch struct {
+			Boot map[string]string
+		}
+		if err := json.NewDecoder(r.Body).Decode(&patch); err != nil {
+			writeError(w, http.StatusBadRequest, "Base.1.0.MalformedJSON")
+			return
+		}
+		for key, value := range patch.Boot {
+			switch key {
+			case "BootSourceOverrideEnabled":
+				s.state.BootSourceOverrideEnabled = value
+			case "BootSourceOverrideTarget":
+				s.state.BootSourceOverrideTarget = value
+			case "BootSourceOverrideMode":
+				s.state.BootSourceOverrideMode = value
+			default:
+				writeError(w, http.StatusBadRequest, "Base.1.0.PropertyUnknown")
+				return
+			}
+		}
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "Base.1.0.ActionNotSupported")
+	}
+}
+
+func (s *Server) reset(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, "Base.1.0.ActionNotSupported")
+		return
+	}
+
+	var request struct {
+		ResetType string
+	}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		writeError(w, http.StatusBadRequest, "Base.1.0.MalformedJSON")
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	allowed := false
+	for _, resetType := range s.ResetTypes {
+		allowed = allowed || resetType == request.ResetType
+	}
+	if !allowed {
+		writeError(w, http.StatusBadRequest, "Base.1.0.ActionParameterNotSupported")
+		return
+	}
+
+	s.state.Resets = append(s.state.Resets, request.ResetType)
+	switch request.ResetType {
+	case "On", "ForceRestart", "PowerCycle":
+		s.state.PowerState = "On"
+	case "ForceOff":
+		s.state.PowerState = "Off"
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) logServices(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "Base.1.0.ActionNotSupported")
+		return
+	}
+	writeJSON(w, map[string]interface{}{
+		"@odata.id":           systemPath + "/LogServices",
+		"Members@odata.count": 1,
+		"Members": []map[string]string{
+			{"@odata.id": selPath},
+		},
+	})
+}
+
+func (s *Server) selEntries(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "Base.1.0.ActionNotSupported")
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	members := make([]LogEntry, len(s.state.SEL))
+	copy(members, s.state.SEL)
+	writeJSON(w, map[string]interface{}{
+		"@odata.id":           selPath + "/Entries",
+		"Members@odata.count": len(members),
+		"Members":             members,
+	})
+}
+
+func (s *Server) accounts(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "Base.1.0.ActionNotSupported")
+		return
+	}
+	writeJSON(w, map[string]interface{}{
+		"@odata.id":           accountsPath,
+		"Members@odata.count": 1,
+		"Members": []map[string]string{
+			{"@odata.id": accountPath},
+		},
+	})
+}
+
+func (s *Server) account(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		writeJSON(w, map[string]interface{}{
+			"@odata.id": accountPath,
+			"Id":        "1",
+			"UserName":  s.Username,
+			"RoleId":    "Administrator",
+		})
+
+	case http.MethodPatch:
+		var patch struct {
+			Password string
+		}
+		if err := json.NewDecoder(r.Body).Decode(&patch); err != nil || patch.Password == "" {
+			writeError(w, http.StatusBadRequest, "Base.1.0.MalformedJSON")
+			return
+		}
+		s.mu.Lock()
+		s.password = patch.Password
+		s.mu.Unlock()
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "Base.1.0.ActionNotSupported")
+	}
+}
+
+func writeJSON(w http.ResponseWriter, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(body)
+}
+
+func writeError(w http.ResponseWriter, status int, messageID string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"error": map[string]string{
+			"code":    messageID,
+			"message": http.StatusText(status),
+		},
+	})
+}
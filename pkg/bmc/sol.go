@@ -0,0 +1,195 @@
+package bmc
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	payloadSOL = 0x01
+
+	cmdActivatePayload   = 0x48
+	cmdDeactivatePayload = 0x49
+
+	// completionPayloadActive is returned when activating SOL while another
+	// console already has it.
+	completionPayloadActive = 0x80
+
+	// solEncryptAuthenticate asks for SOL packets to be encrypted and
+	// authenticated like the rest of the session.
+	solEncryptAuthenticate = 0xc0
+
+	// solKeepalive is how often an idle console pokes the BMC so the session
+	// doesn't time out. The BMC is given up on after three unanswered
+	// keepalives.
+	solKeepalive = 20 * time.Second
+)
+
+// Console opens the host's serial console over SOL, taking it over if
+// another console has it. Console output is read from the returned stream
+// until it is closed or the session drops.
+func (i *IPMI) Console() (io.ReadCloser, error) {
+	s, err := i.open()
+	if err != nil {
+		return nil, fmt.Errorf("ipmi %v: %v", i.Address, err)
+	}
+
+	err = s.activateSOL()
+	if e, ok := err.(completionError); ok && e.code == completionPayloadActive {
+		s.deactivateSOL()
+		err = s.activateSOL()
+	}
+	if err != nil {
+		s.close()
+		return nil, fmt.Errorf("ipmi %v: activating sol: %v", i.Address, err)
+	}
+
+	reader, writer := io.Pipe()
+	console := &solConsole{
+		session: s,
+		address: i.Address,
+		reader:  reader,
+		stop:    make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+	go console.run(writer)
+	return console, nil
+}
+
+func (s *ipmiSession) activateSOL() error {
+	response, err := s.command(netFnApp, cmdActivatePayload, []byte{
+		payloadSOL, 1, solEncryptAuthenticate, 0, 0, 0,
+	})
+	if err != nil {
+		return err
+	}
+	if len(response) >= 10 {
+		port := binary.LittleEndian.Uint16(response[8:10])
+		if fmt.Sprint(port) != DefaultIPMIPort {
+			s.deactivateSOL()
+			return fmt.Errorf("sol on port %d is not supported", port)
+		}
+	}
+	return nil
+}
+
+func (s *ipmiSession) deactivateSOL() error {
+	_, err := s.command(netFnApp, cmdDeactivatePayload, []byte{payloadSOL, 1, 0, 0, 0, 0})
+	return err
+}
+
+// solConsole streams SOL output from a session. While it runs, its
+// goroutine owns the session connection.
+type solConsole struct {
+	session *ipmiSession
+	address string
+	reader  *io.PipeReader
+	stop    chan struct{}
+	done    chan struct{}
+	once    sync.Once
+}
+
+func (c *solConsole) Read(p []byte) (int, error) {
+	return c.reader.Read(p)
+}
+
+// Close stops the stream, releases SOL and closes the session.
+func (c *solConsole) Close() error {
+	c.once.Do(func() {
+		close(c.stop)
+		c.session.conn.SetReadDeadline(time.Now())
+		c.reader.Close()
+		<-c.done
+		c.session.deactivateSOL()
+		c.session.close()
+	})
+	return nil
+}
+
+// run acknowledges each packet of console output and copies its data to w,
+// sending keepalives while the console is idle.
+func (c *solConsole) run(w *io.PipeWriter) {
+	defer close(c.done)
+
+	s := c.session
+	buffer := make([]byte, 1024)
+	var lastSequence byte
+	lastPacket := time.Now()
+	for {
+		s.conn.SetReadDeadline(time.Now().Add(solKeepalive))
+		n, err := s.conn.Read(buffer)
+		if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+			select {
+			case <-c.stop:
+				w.Close()
+				return
+			default:
+			}
+			if time.Since(lastPacket) > 3*solKeepalive {
+				w.CloseWithError(fmt.Errorf("ipmi %v: sol session timed out", c.address))
+				return
+			}
+			if err := c.keepalive(); err != nil {
+				w.CloseWithError(fmt.Errorf("ipmi %v: %v", c.address, err))
+				return
+			}
+			continue
+		} else if err != nil {
+			w.CloseWithError(fmt.Errorf("ipmi %v: %v", c.address, err))
+			return
+		}
+
+		payloadType, payload, ok, err := s.unseal(buffer[:n])
+		if !ok || err != nil || len(payload) < 4 {
+			continue
+		}
+		lastPacket = time.Now()
+		if payloadType != payloadSOL {
+			continue
+		}
+
+		sequence := payload[0] & 0x0f
+		data := payload[4:]
+		if sequence == 0 {
+			// A bare acknowledgement carries no console data.
+			continue
+		}
+		if err := c.send(sequence, byte(len(data))); err != nil {
+			w.CloseWithError(fmt.Errorf("ipmi %v: %v", c.address, err))
+			return
+		}
+		if sequence == lastSequence {
+			// A retransmission of data already written.
+			continue
+		}
+		lastSequence = sequence
+		if _, err := w.Write(data); err != nil {
+			return
+		}
+	}
+}
+
+// keepalive sends a Get Device ID request. Its response is only used as a
+// sign of life, so run skips it.
+func (c *solConsole) keepalive() error {
+	packet, err := c.session.seal(payloadIPMI, c.session.message(netFnApp, cmdGetDeviceID, nil))
+	if err != nil {
+		return err
+	}
+	_, err = c.session.conn.Write(packet)
+	return err
+}
+
+// send acknowledges accepted bytes of the SOL packet numbered sequence.
+func (c *solConsole) send(sequence byte, accepted byte) error {
+	packet, err := c.session.seal(payloadSOL, []byte{0, sequence, accepted, 0})
+	if err != nil {
+		return err
+	}
+	_, err = c.session.conn.Write(packet)
+	return err
+}
@@ -0,0 +1,530 @@
+// Package config loads the rackdirector configuration file, which holds
+// everything specific to a site.
+package config
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+const (
+	// DefaultPath is the config file read when no other is given.
+	DefaultPath = "rackdirector.yaml"
+	// envPrefix prefixes the environment variable overriding each flag.
+	envPrefix = "RACKDIRECTOR_"
+)
+
+// Config is the whole rackdirector configuration.
+type Config struct {
+	Server  ServerConfig  `yaml:"server"`
+	DHCP    DHCPConfig    `yaml:"dhcp"`
+	TFTP    TFTPConfig    `yaml:"tftp"`
+	HTTP    HTTPConfig    `yaml:"http"`
+	Syslog  SyslogConfig  `yaml:"syslog"`
+	IPAM    IPAMConfig    `yaml:"ipam"`
+	PXE     PXEConfig     `yaml:"pxe"`
+	BMC     BMCConfig     `yaml:"bmc"`
+	History HistoryConfig `yaml:"history"`
+	Console ConsoleConfig `yaml:"console"`
+}
+
+// ServerConfig describes how hosts reach rackdirector and their OS images.
+type ServerConfig struct {
+	// Address is the IPv4 address hosts use to reach rackdirector.
+	Address string `yaml:"address"`
+	// OSServer is the host serving installer images and repositories.
+	OSServer string `yaml:"os_server"`
+	// Nameservers are handed to hosts over DHCP and in install seeds.
+	Nameservers []string `yaml:"nameservers"`
+}
+
+// DHCPConfig says where DHCP is served and how requests are matched to
+// hosts. Requests from each of Networks are matched as it says, and the rest
+// as Match says.
+type DHCPConfig struct {
+	Listen   string              `yaml:"listen"`
+	Lease    time.Duration       `yaml:"lease"`
+	Match    []string            `yaml:"match"`
+	Networks []DHCPNetworkConfig `yaml:"networks"`
+}
+
+// Ways DHCP requests are matched to hosts.
+const (
+	MatchRemoteID  = "remote_id"
+	MatchCircuitID = "circuit_id"
+	MatchMAC       = "mac"
+	MatchAny       = "any"
+)
+
+// DHCPNetworkConfig says how requests relayed from Network, or received on
+// it directly, are matched to hosts: by each of Match in turn.
+type DHCPNetworkConfig struct {
+	Network string   `yaml:"network"`
+	Match   []string `yaml:"match"`
+}
+
+type TFTPConfig struct {
+	Listen    string `yaml:"listen"`
+	Directory string `yaml:"directory"`
+}
+
+type HTTPConfig struct {
+	Listen    string `yaml:"listen"`
+	Directory string `yaml:"directory"`
+}
+
+// SyslogConfig holds the addresses logs are received on. Syslog is received
+// over both UDP and TCP.
+type SyslogConfig struct {
+	Listen     string `yaml:"listen"`
+	Netconsole string `yaml:"netconsole"`
+}
+
+// IPAM backends.
+const (
+	IPAMFile   = "file"
+	IPAMNetBox = "netbox"
+	IPAMSQLite = "sqlite"
+)
+
+// IPAMConfig says where hosts come from: the JSON file Hosts if Backend is
+// "file", NetBox if it is "netbox", or the SQLite database Database if it is
+// "sqlite".
+type IPAMConfig struct {
+	Backend  string       `yaml:"backend"`
+	Hosts    string       `yaml:"hosts"`
+	NetBox   NetBoxConfig `yaml:"netbox"`
+	Database string       `yaml:"database"`
+}
+
+// NetBoxConfig says which NetBox devices are hosts and how often to fetch
+// them. Gateways come from the "gateway" custom field of each network's
+// prefix, or are the network's first address.
+type NetBoxConfig struct {
+	URL   string `yaml:"url"`
+	Token string `yaml:"token"`
+	// Filter selects the devices, as query parameters such as
+	// "site=echo1&role=server".
+	Filter string `yaml:"filter"`
+	// CircuitID is a template giving the DHCP circuit ID of a switch port
+	// from its .Device, .Port and .VLAN names. RemoteID likewise gives the
+	// remote ID of its switch, if the switches are told apart by one.
+	CircuitID string        `yaml:"circuit_id"`
+	RemoteID  string        `yaml:"remote_id"`
+	Refresh   time.Duration `yaml:"refresh"`
+}
+
+type PXEConfig struct {
+	Templates string `yaml:"templates"`
+	Plans     string `yaml:"plans"`
+	// State is the file holding in-flight plans.
+	State string `yaml:"state"`
+	// Interface is the device installers configure when booted by hand.
+	Interface string `yaml:"interface"`
+	// UnknownHostname names hosts missing from IPAM, with the * replaced by
+	// random letters.
+	UnknownHostname string `yaml:"unknown_hostname"`
+	// LogDirectory holds the logs hosts send while running plans.
+	LogDirectory string `yaml:"log_directory"`
+	// FailPatterns fail the stage of any host logging a matching line.
+	FailPatterns []string `yaml:"fail_patterns"`
+}
+
+// BMCConfig says where BMC credentials come from: the environment if
+// Credentials is "env", and otherwise the file it names, encrypted with the
+// key in KeyFile if that is set.
+type BMCConfig struct {
+	Credentials string `yaml:"credentials"`
+	KeyFile     string `yaml:"key_file"`
+}
+
+type HistoryConfig struct {
+	Directory string `yaml:"directory"`
+}
+
+type ConsoleConfig struct {
+	Directory string `yaml:"directory"`
+}
+
+// Default returns the configuration used for anything the config file leaves
+// out. The server address, OS server and nameservers have no default.
+func Default() Config {
+	return Config{
+		DHCP: DHCPConfig{
+			Listen: ":67",
+			Lease:  24 * time.Hour,
+			Match:  []string{MatchCircuitID},
+		},
+		TFTP: TFTPConfig{
+			Listen:    ":69",
+			Directory: "tftp",
+		},
+		HTTP: HTTPConfig{
+			Listen:    ":80",
+			Directory: "http",
+		},
+		Syslog: SyslogConfig{
+			Listen:     ":514",
+			Netconsole: ":6666",
+		},
+		IPAM: IPAMConfig{
+			Backend: IPAMFile,
+			Hosts:   "hosts.json",
+			NetBox: NetBoxConfig{
+				CircuitID: "{{ .Port }}",
+				Refresh:   5 * time.Minute,
+			},
+			Database: "hosts.db",
+		},
+		PXE: PXEConfig{
+			Templates:       "templates",
+			Plans:           "plans",
+			State:           "planstate.json",
+			Interface:       "eth0",
+			UnknownHostname: "unknown-*",
+			LogDirectory:    "logs",
+		},
+		BMC: BMCConfig{
+			Credentials: "bmc-credentials.json",
+		},
+		History: HistoryConfig{
+			Directory: "history",
+		},
+		Console: ConsoleConfig{
+			Directory: "console",
+		},
+	}
+}
+
+// override is a setting which can be given as a flag or in the environment.
+type override struct {
+	name  string
+	usage string
+	set   func(c *Config, value string) error
+}
+
+func stringOverride(name string, usage string, field func(c *Config) *string) override {
+	return override{name, usage, func(c *Config, value string) error {
+		*field(c) = value
+		return nil
+	}}
+}
+
+var overrides = []override{
+	stringOverride("server-address", "address hosts reach rackdirector on", func(c *Config) *string { return &c.Server.Address }),
+	stringOverride("os-server", "host serving OS images", func(c *Config) *string { return &c.Server.OSServer }),
+	{"nameservers", "comma separated nameservers handed to hosts", func(c *Config, value string) error {
+		c.Server.Nameservers = strings.Split(value, ",")
+		return nil
+	}},
+	stringOverride("dhcp-listen", "DHCP listen address", func(c *Config) *string { return &c.DHCP.Listen }),
+	{"dhcp-lease", "DHCP lease time", func(c *Config, value string) error {
+		lease, err := time.ParseDuration(value)
+		c.DHCP.Lease = lease
+		return err
+	}},
+	stringOverride("tftp-listen", "TFTP listen address", func(c *Config) *string { return &c.TFTP.Listen }),
+	stringOverride("http-listen", "HTTP listen address", func(c *Config) *string { return &c.HTTP.Listen }),
+	stringOverride("syslog-listen", "syslog listen address", func(c *Config) *string { return &c.Syslog.Listen }),
+	stringOverride("netconsole-listen", "netconsole listen address", func(c *Config) *string { return &c.Syslog.Netconsole }),
+	stringOverride("ipam-backend", `where hosts come from, "file", "netbox" or "sqlite"`, func(c *Config) *string { return &c.IPAM.Backend }),
+	stringOverride("hosts", "IPAM hosts file", func(c *Config) *string { return &c.IPAM.Hosts }),
+	stringOverride("ipam-database", "IPAM SQLite database", func(c *Config) *string { return &c.IPAM.Database }),
+	stringOverride("netbox-url", "NetBox URL", func(c *Config) *string { return &c.IPAM.NetBox.URL }),
+	stringOverride("netbox-token", "NetBox API token", func(c *Config) *string { return &c.IPAM.NetBox.Token }),
+	stringOverride("plan-state", "file holding in-flight plans", func(c *Config) *string { return &c.PXE.State }),
+	stringOverride("bmc-credentials", `BMC credentials file, or "env"`, func(c *Config) *string { return &c.BMC.Credentials }),
+	stringOverride("bmc-key-file", "key encrypting the BMC credentials file", func(c *Config) *string { return &c.BMC.KeyFile }),
+}
+
+// Parse loads the configuration for the command line args. The config file
+// is named by -config or RACKDIRECTOR_CONFIG. Settings in the file are
+// overridden by RACKDIRECTOR_* environment variables, which are overridden by
+// flags. The arguments left after the flags are returned.
+func Parse(args []string) (Config, []string, error) {
+	flags := flag.NewFlagSet("rackdirector", flag.ContinueOnError)
+	path := flags.String("config", "", "config file (default "+DefaultPath+")")
+	values := make([]*string, len(overrides))
+	for i, o := range overrides {
+		values[i] = flags.String(o.name, "", o.usage+" (env "+envName(o.name)+")")
+	}
+	if err := flags.Parse(args); err != nil {
+		return Config{}, nil, err
+	}
+	set := make(map[string]bool)
+	flags.Visit(func(f *flag.Flag) {
+		set[f.Name] = true
+	})
+
+	if !set["config"] {
+		*path = os.Getenv(envName("config"))
+	}
+	config, err := Load(*path)
+	if err != nil {
+		return Config{}, nil, err
+	}
+
+	for i, o := range overrides {
+		value := os.Getenv(envName(o.name))
+		if set[o.name] {
+			value = *values[i]
+		} else if value == "" {
+			continue
+		}
+		if err := o.set(&config, value); err != nil {
+			return Config{}, nil, fmt.Errorf("%v: %v", o.name, err)
+		}
+	}
+
+	if err := config.Validate(); err != nil {
+		return Config{}, nil, err
+	}
+	return config, flags.Args(), nil
+}
+
+func envName(flag string) string {
+	return envPrefix + strings.ToUpper(strings.Replace(flag, "-", "_", -1))
+}
+
+// Load reads the config file at path over the defaults. An empty path reads
+// DefaultPath, which may be missing.
+func Load(path string) (Config, error) {
+	config := Default()
+	optional := path == ""
+	if optional {
+		path = DefaultPath
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) && optional {
+		return config, nil
+	} else if err != nil {
+		return Config{}, err
+	}
+	if err := yaml.UnmarshalStrict(data, &config); err != nil {
+		return Config{}, fmt.Errorf("%v: %v", path, err)
+	}
+	return config, nil
+}
+
+// Validate checks every setting, returning all problems found at once.
+func (c Config) Validate() error {
+	problems := make([]string, 0)
+	problem := func(format string, args ...interface{}) {
+		problems = append(problems, fmt.Sprintf(format, args...))
+	}
+
+	if ip := net.ParseIP(c.Server.Address); ip == nil || ip.To4() == nil {
+		problem("server.address %q is not an IPv4 address", c.Server.Address)
+	}
+	if c.Server.OSServer == "" {
+		problem("server.os_server is not set")
+	}
+	if len(c.Server.Nameservers) == 0 {
+		problem("server.nameservers is not set")
+	}
+	for _, nameserver := range c.Server.Nameservers {
+		if net.ParseIP(nameserver) == nil {
+			problem("server.nameservers: %q is not an IP address", nameserver)
+		}
+	}
+	if c.DHCP.Lease < time.Second || c.DHCP.Lease.Seconds() > float64(^uint32(0)) {
+		problem("dhcp.lease %v is out of range", c.DHCP.Lease)
+	}
+	checkMatch := func(name string, match []string) {
+		if len(match) == 0 {
+			problem("%v is not set", name)
+		}
+		for _, m := range match {
+			if m != MatchRemoteID && m != MatchCircuitID && m != MatchMAC && m != MatchAny {
+				problem("%v: %q is not %q, %q, %q or %q", name, m, MatchRemoteID, MatchCircuitID, MatchMAC, MatchAny)
+			}
+		}
+	}
+	checkMatch("dhcp.match", c.DHCP.Match)
+	for i, network := range c.DHCP.Networks {
+		if _, _, err := net.ParseCIDR(network.Network); err != nil {
+			problem("dhcp.networks[%d].network %q is not a network in CIDR notation", i, network.Network)
+		}
+		checkMatch(fmt.Sprintf("dhcp.networks[%d].match", i), network.Match)
+	}
+
+	listeners := []struct{ name, address string }{
+		{"dhcp.listen", c.DHCP.Listen},
+		{"tftp.listen", c.TFTP.Listen},
+		{"http.listen", c.HTTP.Listen},
+		{"syslog.listen", c.Syslog.Listen},
+		{"syslog.netconsole", c.Syslog.Netconsole},
+	}
+	for _, listener := range listeners {
+		if _, err := port(listener.address); err != nil {
+			problem("%v: %v", listener.name, err)
+		}
+	}
+
+	paths := []struct{ name, path string }{
+		{"tftp.directory", c.TFTP.Directory},
+		{"http.directory", c.HTTP.Directory},
+		{"pxe.templates", c.PXE.Templates},
+		{"pxe.plans", c.PXE.Plans},
+		{"pxe.state", c.PXE.State},
+		{"pxe.log_directory", c.PXE.LogDirectory},
+		{"bmc.credentials", c.BMC.Credentials},
+		{"history.directory", c.History.Directory},
+		{"console.directory", c.Console.Directory},
+	}
+	for _, path := range paths {
+		if path.path == "" {
+			problem("%v is not set", path.name)
+		}
+	}
+
+	switch c.IPAM.Backend {
+	case IPAMFile:
+		if c.IPAM.Hosts == "" {
+			problem("ipam.hosts is not set")
+		}
+	case IPAMNetBox:
+		netbox := c.IPAM.NetBox
+		if u, err := url.Parse(netbox.URL); err != nil || u.Host == "" {
+			problem("ipam.netbox.url %q is not a URL", netbox.URL)
+		}
+		if _, err := url.ParseQuery(netbox.Filter); err != nil {
+			problem("ipam.netbox.filter: %v", err)
+		}
+		if _, err := template.New("circuit_id").Parse(netbox.CircuitID); err != nil {
+			problem("ipam.netbox.circuit_id: %v", err)
+		}
+		if _, err := template.New("remote_id").Parse(netbox.RemoteID); err != nil {
+			problem("ipam.netbox.remote_id: %v", err)
+		}
+		if netbox.Refresh < time.Second {
+			problem("ipam.netbox.refresh %v is too short", netbox.Refresh)
+		}
+	case IPAMSQLite:
+		if c.IPAM.Database == "" {
+			problem("ipam.database is not set")
+		}
+	default:
+		problem("ipam.backend %q is not %q, %q or %q", c.IPAM.Backend, IPAMFile, IPAMNetBox, IPAMSQLite)
+	}
+
+	if c.PXE.Interface == "" {
+		problem("pxe.interface is not set")
+	}
+	if strings.Count(c.PXE.UnknownHostname, "*") != 1 {
+		problem("pxe.unknown_hostname %q must contain one *", c.PXE.UnknownHostname)
+	}
+	for _, pattern := range c.PXE.FailPatterns {
+		if _, err := regexp.Compile(pattern); err != nil {
+			problem("pxe.fail_patterns: bad pattern %q: %v", pattern, err)
+		}
+	}
+
+	if len(problems) != 0 {
+		return fmt.Errorf("invalid config: %v", strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+// RestartRequired lists the sections of next which differ from c in settings
+// that only take effect on restart. The IPAM hosts file, the templates and
+// the fail patterns are applied on reload.
+func (c Config) RestartRequired(next Config) []string {
+	live := func(config Config) Config {
+		config.IPAM.Hosts = ""
+		config.PXE.Templates = ""
+		config.PXE.FailPatterns = nil
+		return config
+	}
+	current, updated := live(c), live(next)
+
+	sections := []struct {
+		name          string
+		current, next interface{}
+	}{
+		{"server", current.Server, updated.Server},
+		{"dhcp", current.DHCP, updated.DHCP},
+		{"tftp", current.TFTP, updated.TFTP},
+		{"http", current.HTTP, updated.HTTP},
+		{"syslog", current.Syslog, updated.Syslog},
+		{"ipam", current.IPAM, updated.IPAM},
+		{"pxe", current.PXE, updated.PXE},
+		{"bmc", current.BMC, updated.BMC},
+		{"history", current.History, updated.History},
+		{"console", current.Console, updated.Console},
+	}
+	changed := make([]string, 0)
+	for _, section := range sections {
+		if !reflect.DeepEqual(section.current, section.next) {
+			changed = append(changed, section.name)
+		}
+	}
+	return changed
+}
+
+// ServerIP is the address hosts reach rackdirector on.
+func (c Config) ServerIP() net.IP {
+	return net.ParseIP(c.Server.Address).To4()
+}
+
+// NameserverIPs are the nameservers handed to hosts.
+func (c Config) NameserverIPs() []net.IP {
+	ips := make([]net.IP, 0, len(c.Server.Nameservers))
+	for _, nameserver := range c.Server.Nameservers {
+		ips = append(ips, net.ParseIP(nameserver))
+	}
+	return ips
+}
+
+// HTTPServer is the host, and port if it isn't 80, hosts fetch from the HTTP
+// server on.
+func (c Config) HTTPServer() string {
+	httpPort := c.HTTPPort()
+	if httpPort == 80 {
+		return c.Server.Address
+	}
+	return net.JoinHostPort(c.Server.Address, strconv.Itoa(httpPort))
+}
+
+// HTTPPort is the port the HTTP server listens on.
+func (c Config) HTTPPort() int {
+	p, _ := port(c.HTTP.Listen)
+	return p
+}
+
+// SyslogPort is the port syslog is received on.
+func (c Config) SyslogPort() int {
+	p, _ := port(c.Syslog.Listen)
+	return p
+}
+
+// NetconsolePort is the port netconsole is received on.
+func (c Config) NetconsolePort() int {
+	p, _ := port(c.Syslog.Netconsole)
+	return p
+}
+
+func port(address string) (int, error) {
+	_, portString, err := net.SplitHostPort(address)
+	if err != nil {
+		return 0, err
+	}
+	p, err := strconv.Atoi(portString)
+	if err != nil || p < 1 || p > 65535 {
+		return 0, fmt.Errorf("bad port in %q", address)
+	}
+	return p, nil
+}
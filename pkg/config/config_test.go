@@ -0,0 +1,182 @@
+package config
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testConfig = `
+server:
+  address: 10.0.0.1
+  os_server: mirror.example.com
+  nameservers: [10.0.0.53]
+dhcp:
+  lease: 1h
+tftp:
+  listen: ":1069"
+http:
+  listen: ":8080"
+syslog:
+  listen: ":1514"
+`
+
+// writeConfig writes data to a config file in a temporary directory,
+// returning its path.
+func writeConfig(t *testing.T, data string) string {
+	dir, err := ioutil.TempDir("", "config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	path := filepath.Join(dir, "rackdirector.yaml")
+	if err := ioutil.WriteFile(path, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// setenv sets key to value until the test ends.
+func setenv(t *testing.T, key string, value string) {
+	old, had := os.LookupEnv(key)
+	if err := os.Setenv(key, value); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		if had {
+			os.Setenv(key, old)
+		} else {
+			os.Unsetenv(key)
+		}
+	})
+}
+
+// TestParseOverrides checks the environment overrides the file and flags
+// override both.
+func TestParseOverrides(t *testing.T) {
+	path := writeConfig(t, testConfig)
+	setenv(t, "RACKDIRECTOR_CONFIG", path)
+	setenv(t, "RACKDIRECTOR_TFTP_LISTEN", ":2069")
+	setenv(t, "RACKDIRECTOR_HTTP_LISTEN", ":8081")
+	setenv(t, "RACKDIRECTOR_OS_SERVER", "")
+
+	config, args, err := Parse([]string{"-http-listen", ":8082", "-nameservers", "10.0.0.53,10.0.1.53", "serve"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(args, []string{"serve"}) {
+		t.Errorf("left args %v", args)
+	}
+	settings := []struct {
+		name      string
+		got, want interface{}
+	}{
+		{"default", config.Syslog.Netconsole, ":6666"},
+		{"file", config.Syslog.Listen, ":1514"},
+		{"file", config.DHCP.Lease, time.Hour},
+		{"empty env", config.Server.OSServer, "mirror.example.com"},
+		{"env", config.TFTP.Listen, ":2069"},
+		{"flag over env", config.HTTP.Listen, ":8082"},
+		{"flag", config.Server.Nameservers, []string{"10.0.0.53", "10.0.1.53"}},
+	}
+	for _, setting := range settings {
+		if !reflect.DeepEqual(setting.got, setting.want) {
+			t.Errorf("%v setting is %v, want %v", setting.name, setting.got, setting.want)
+		}
+	}
+
+	other := writeConfig(t, strings.Replace(testConfig, "10.0.0.1", "10.0.0.2", 1))
+	config, _, err = Parse([]string{"-config", other})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.Server.Address != "10.0.0.2" {
+		t.Errorf("-config read address %v, want the one in %v", config.Server.Address, other)
+	}
+
+	setenv(t, "RACKDIRECTOR_DHCP_LEASE", "soon")
+	if _, _, err := Parse(nil); err == nil || !strings.Contains(err.Error(), "dhcp-lease") {
+		t.Errorf("bad lease gave %v", err)
+	}
+}
+
+func TestLoadStrict(t *testing.T) {
+	path := writeConfig(t, testConfig+"pxe:\n  templats: elsewhere\n")
+	if _, err := Load(path); err == nil || !strings.Contains(err.Error(), "templats") {
+		t.Errorf("unknown key gave %v", err)
+	}
+
+	if _, err := Load(filepath.Join(filepath.Dir(path), "missing.yaml")); err == nil {
+		t.Error("missing config file named explicitly was accepted")
+	}
+	config, err := Load("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(config, Default()) {
+		t.Errorf("missing default config file gave %+v", config)
+	}
+}
+
+// TestValidate checks every problem is reported at once.
+func TestValidate(t *testing.T) {
+	config, err := Load(writeConfig(t, testConfig))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := config.Validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	config.Server.Address = "mirror.example.com"
+	config.DHCP.Lease = 0
+	config.DHCP.Networks = []DHCPNetworkConfig{{Network: "10.0.0.0/24", Match: []string{"port"}}}
+	config.HTTP.Listen = "80"
+	config.IPAM.Backend = "ldap"
+	config.PXE.UnknownHostname = "unknown"
+	config.PXE.FailPatterns = []string{"("}
+	err = config.Validate()
+	if err == nil {
+		t.Fatal("invalid config accepted")
+	}
+	problems := []string{
+		`server.address "mirror.example.com" is not an IPv4 address`,
+		"dhcp.lease 0s is out of range",
+		`dhcp.networks[0].match: "port" is not`,
+		"http.listen: address 80: missing port in address",
+		`ipam.backend "ldap" is not "file", "netbox" or "sqlite"`,
+		`pxe.unknown_hostname "unknown" must contain one *`,
+		`pxe.fail_patterns: bad pattern "("`,
+	}
+	for _, problem := range problems {
+		if !strings.Contains(err.Error(), problem) {
+			t.Errorf("%q doesn't report %q", err, problem)
+		}
+	}
+	if got := strings.Count(err.Error(), "; ") + 1; got != len(problems) {
+		t.Errorf("%d problems reported, want %d: %v", got, len(problems), err)
+	}
+}
+
+func TestRestartRequired(t *testing.T) {
+	current := Default()
+
+	next := current
+	next.IPAM.Hosts = "other-hosts.json"
+	next.PXE.Templates = "other-templates"
+	next.PXE.FailPatterns = []string{"Kernel panic"}
+	if changed := current.RestartRequired(next); len(changed) != 0 {
+		t.Errorf("reloadable settings need a restart of %v", changed)
+	}
+
+	next.HTTP.Listen = ":8080"
+	next.IPAM.Backend = IPAMNetBox
+	next.PXE.State = "elsewhere.json"
+	if changed, want := current.RestartRequired(next), []string{"http", "ipam", "pxe"}; !reflect.DeepEqual(changed, want) {
+		t.Errorf("restart required for %v, want %v", changed, want)
+	}
+}
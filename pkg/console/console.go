@@ -0,0 +1,424 @@
+// Package console captures the serial consoles of hosts running plans to
+// per-host, per-plan log files.
+package console
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nik-johnson-net/rackdirector/pkg/bmc"
+	"github.com/nik-johnson-net/rackdirector/pkg/ipam"
+	"github.com/nik-johnson-net/rackdirector/pkg/pxe"
+)
+
+const (
+	// DefaultMaxSize is the size a log file grows to before it is rotated.
+	DefaultMaxSize = 10 << 20
+	// DefaultMaxFiles is how many rotated files are kept per plan run.
+	DefaultMaxFiles = 5
+
+	// syncInterval is how often the set of captured consoles is matched
+	// against the active plans.
+	syncInterval = 15 * time.Second
+	// reconnectDelay is how long to wait before reopening a console which
+	// failed or dropped.
+	reconnectDelay = 30 * time.Second
+
+	logSuffix = ".log"
+)
+
+// PlanLister lists the active plans.
+type PlanLister interface {
+	ListPlans() []pxe.PlanStatus
+}
+
+// Run is a captured console log of one run of a plan on a host.
+type Run struct {
+	ID       string
+	Size     int64
+	Modified time.Time
+	// Live is set while the console is still being captured.
+	Live bool
+}
+
+// Capturer opens the serial console of every host with a running plan and
+// writes it to Directory/<hostname>/<plan>-<start time>.log.
+type Capturer struct {
+	BMC       bmc.Consoler
+	IPAM      ipam.Store
+	Plans     PlanLister
+	Directory string
+	MaxSize   int64
+	MaxFiles  int
+
+	mu       sync.Mutex
+	sessions map[string]*session
+}
+
+// Run captures consoles until ctx is done.
+func (c *Capturer) Run(ctx context.Context) {
+	ticker := time.NewTicker(syncInterval)
+	defer ticker.Stop()
+
+	for {
+		c.sync()
+		select {
+		case <-ctx.Done():
+			c.stopAll()
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// sync starts capturing the consoles of hosts whose plan is running and stops
+// capturing the rest.
+func (c *Capturer) sync() {
+	active := make(map[string]string)
+	for _, plan := range c.Plans.ListPlans() {
+		if plan.State == pxe.PlanStateRunning && plan.Hostname != "" {
+			active[plan.Hostname] = plan.RunID()
+		}
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.sessions == nil {
+		c.sessions = make(map[string]*session)
+	}
+
+	for hostname, s := range c.sessions {
+		if active[hostname] != s.run {
+			s.stop()
+			delete(c.sessions, hostname)
+		}
+	}
+	for hostname, run := range active {
+		if _, capturing := c.sessions[hostname]; capturing {
+			continue
+		}
+		s, err := c.start(hostname, run)
+		if err != nil {
+			log.Printf("Failed to capture console of %v: %v\n", hostname, err)
+			continue
+		}
+		c.sessions[hostname] = s
+	}
+}
+
+func (c *Capturer) stopAll() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for hostname, s := range c.sessions {
+		s.stop()
+		delete(c.sessions, hostname)
+	}
+}
+
+func (c *Capturer) start(hostname string, run string) (*session, error) {
+	host, err := c.IPAM.GetByHostname(hostname)
+	if err != nil {
+		return nil, err
+	}
+	directory := filepath.Join(c.Directory, hostname)
+	if err := os.MkdirAll(directory, 0755); err != nil {
+		return nil, err
+	}
+	file, err := openRotatingFile(filepath.Join(directory, run+logSuffix), c.maxSize(), c.maxFiles())
+	if err != nil {
+		return nil, err
+	}
+
+	s := &session{
+		hostname:    hostname,
+		run:         run,
+		file:        file,
+		subscribers: make(map[chan []byte]struct{}),
+		done:        make(chan struct{}),
+		stopped:     make(chan struct{}),
+	}
+	go s.capture(c.BMC, host)
+	return s, nil
+}
+
+func (c *Capturer) maxSize() int64 {
+	if c.MaxSize == 0 {
+		return DefaultMaxSize
+	}
+	return c.MaxSize
+}
+
+func (c *Capturer) maxFiles() int {
+	if c.MaxFiles == 0 {
+		return DefaultMaxFiles
+	}
+	return c.MaxFiles
+}
+
+// Runs lists the captured console logs of hostname, newest first.
+func (c *Capturer) Runs(hostname string) ([]Run, error) {
+	if !validName(hostname) {
+		return nil, fmt.Errorf("invalid hostname %q", hostname)
+	}
+	files, err := ioutil.ReadDir(filepath.Join(c.Directory, hostname))
+	if os.IsNotExist(err) {
+		return []Run{}, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	live := ""
+	if s, ok := c.sessions[hostname]; ok {
+		live = s.run
+	}
+	c.mu.Unlock()
+
+	// Rotated files count towards the size of their run.
+	rotated := make(map[string]int64)
+	for _, file := range files {
+		if index := strings.LastIndex(file.Name(), logSuffix+"."); index >= 0 {
+			rotated[file.Name()[:index]] += file.Size()
+		}
+	}
+
+	runs := make([]Run, 0, len(files))
+	for _, file := range files {
+		if file.IsDir() || !strings.HasSuffix(file.Name(), logSuffix) {
+			continue
+		}
+		id := strings.TrimSuffix(file.Name(), logSuffix)
+		runs = append(runs, Run{
+			ID:       id,
+			Size:     file.Size() + rotated[id],
+			Modified: file.ModTime(),
+			Live:     id == live,
+		})
+	}
+	sort.Slice(runs, func(i, j int) bool {
+		return runs[i].Modified.After(runs[j].Modified)
+	})
+	return runs, nil
+}
+
+// Open returns the whole log of a run of hostname, rotated files included.
+// If follow is set and the run is still being captured, the reader carries
+// on with new console output until the capture ends or the reader is
+// closed.
+func (c *Capturer) Open(hostname string, run string, follow bool) (io.ReadCloser, error) {
+	if !validName(hostname) || !validName(run) {
+		return nil, fmt.Errorf("invalid log %v/%v", hostname, run)
+	}
+	path := filepath.Join(c.Directory, hostname, run+logSuffix)
+
+	c.mu.Lock()
+	s, live := c.sessions[hostname]
+	c.mu.Unlock()
+	if !follow || !live || s.run != run {
+		return openSegments(path, c.maxFiles())
+	}
+	return s.follow(path, c.maxFiles())
+}
+
+func validName(name string) bool {
+	return name != "" && name != "." && name != ".." && !strings.ContainsAny(name, `/\`)
+}
+
+// session captures the console of one host for one plan run.
+type session struct {
+	hostname string
+	run      string
+
+	mu          sync.Mutex
+	file        *rotatingFile
+	subscribers map[chan []byte]struct{}
+	done        chan struct{}
+	stopped     chan struct{}
+	stopOnce    sync.Once
+}
+
+// capture copies the console of host to the log, reopening it whenever it
+// fails, until the session is stopped.
+func (s *session) capture(consoles bmc.Consoler, host ipam.Host) {
+	defer s.finish()
+
+	for {
+		stream, err := consoles.Console(host)
+		if err != nil {
+			log.Printf("Failed to open console of %v: %v\n", s.hostname, err)
+		} else {
+			log.Printf("Capturing console of %v for %v\n", s.hostname, s.run)
+			closed := make(chan struct{})
+			go func() {
+				select {
+				case <-s.stopped:
+					stream.Close()
+				case <-closed:
+				}
+			}()
+			_, err = io.Copy(s, stream)
+			close(closed)
+			stream.Close()
+		}
+
+		select {
+		case <-s.stopped:
+			return
+		default:
+		}
+		if err != nil {
+			log.Printf("Console of %v dropped: %v\n", s.hostname, err)
+		}
+		select {
+		case <-s.stopped:
+			return
+		case <-time.After(reconnectDelay):
+		}
+	}
+}
+
+// Write appends console output to the log and passes it to followers.
+// Followers which fall behind miss output rather than stall the capture.
+func (s *session) Write(p []byte) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	n, err := s.file.Write(p)
+	if err != nil {
+		return n, err
+	}
+	for subscriber := range s.subscribers {
+		select {
+		case subscriber <- append([]byte(nil), p...):
+		default:
+		}
+	}
+	return n, nil
+}
+
+func (s *session) stop() {
+	s.stopOnce.Do(func() {
+		close(s.stopped)
+	})
+}
+
+// finish closes the log and ends every follower.
+func (s *session) finish() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.file.Close()
+	for subscriber := range s.subscribers {
+		close(subscriber)
+	}
+	s.subscribers = nil
+	close(s.done)
+}
+
+// follow reads the log up to now, then the console output written after.
+func (s *session) follow(path string, maxFiles int) (io.ReadCloser, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	history, err := openSegments(path, maxFiles)
+	if err != nil {
+		return nil, err
+	}
+	select {
+	case <-s.done:
+		return history, nil
+	default:
+	}
+
+	subscriber := make(chan []byte, 64)
+	s.subscribers[subscriber] = struct{}{}
+	return &follower{
+		history:    history,
+		session:    s,
+		subscriber: subscriber,
+		closed:     make(chan struct{}),
+	}, nil
+}
+
+func (s *session) unsubscribe(subscriber chan []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.subscribers[subscriber]; ok {
+		delete(s.subscribers, subscriber)
+		close(subscriber)
+	}
+}
+
+// follower reads a log's history and then live output from its session.
+type follower struct {
+	session    *session
+	subscriber chan []byte
+	pending    []byte
+	closed     chan struct{}
+	closeOnce  sync.Once
+
+	mu      sync.Mutex
+	history io.ReadCloser
+}
+
+func (f *follower) Read(p []byte) (int, error) {
+	if n, done, err := f.readHistory(p); !done {
+		return n, err
+	}
+
+	for len(f.pending) == 0 {
+		select {
+		case data, ok := <-f.subscriber:
+			if !ok {
+				return 0, io.EOF
+			}
+			f.pending = data
+		case <-f.closed:
+			return 0, io.EOF
+		}
+	}
+	n := copy(p, f.pending)
+	f.pending = f.pending[n:]
+	return n, nil
+}
+
+// readHistory reads from the history until it is exhausted, after which done
+// is set.
+func (f *follower) readHistory(p []byte) (int, bool, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.history == nil {
+		return 0, true, nil
+	}
+	n, err := f.history.Read(p)
+	if err != io.EOF {
+		return n, false, err
+	}
+	f.history.Close()
+	f.history = nil
+	return n, n == 0, nil
+}
+
+func (f *follower) Close() error {
+	f.closeOnce.Do(func() {
+		close(f.closed)
+		f.mu.Lock()
+		if f.history != nil {
+			f.history.Close()
+			f.history = nil
+		}
+		f.mu.Unlock()
+		f.session.unsubscribe(f.subscriber)
+	})
+	return nil
+}
@@ -0,0 +1,138 @@
+package console
+
+import (
+	"fmt"
+	"io"
+	"os"
+)
+
+// rotatingFile appends to path, moving it to path.1, path.1 to path.2 and so
+// on once it would grow past maxSize. At most maxFiles old files are kept.
+type rotatingFile struct {
+	path     string
+	maxSize  int64
+	maxFiles int
+
+	file *os.File
+	size int64
+}
+
+func openRotatingFile(path string, maxSize int64, maxFiles int) (*rotatingFile, error) {
+	r := &rotatingFile{
+		path:     path,
+		maxSize:  maxSize,
+		maxFiles: maxFiles,
+	}
+	if err := r.open(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *rotatingFile) open() error {
+	file, err := os.OpenFile(r.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	r.file = file
+	r.size = info.Size()
+	return nil
+}
+
+func (r *rotatingFile) Write(p []byte) (int, error) {
+	if r.size > 0 && r.size+int64(len(p)) > r.maxSize {
+		if err := r.rotate(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := r.file.Write(p)
+	r.size += int64(n)
+	return n, err
+}
+
+func (r *rotatingFile) rotate() error {
+	if err := r.file.Close(); err != nil {
+		return err
+	}
+	for i := r.maxFiles - 1; i >= 1; i-- {
+		err := os.Rename(segmentPath(r.path, i), segmentPath(r.path, i+1))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	if r.maxFiles > 0 {
+		if err := os.Rename(r.path, segmentPath(r.path, 1)); err != nil {
+			return err
+		}
+	} else if err := os.Remove(r.path); err != nil {
+		return err
+	}
+	return r.open()
+}
+
+func (r *rotatingFile) Close() error {
+	return r.file.Close()
+}
+
+// segmentPath returns the path of the index'th newest rotated file, or the
+// current file for index zero.
+func segmentPath(path string, index int) string {
+	if index == 0 {
+		return path
+	}
+	return fmt.Sprintf("%v.%d", path, index)
+}
+
+// openSegments opens the rotated files of path and then path itself, oldest
+// first, reading the current file only up to its present size. Missing
+// segments are skipped.
+func openSegments(path string, maxFiles int) (io.ReadCloser, error) {
+	var files []*os.File
+	var readers []io.Reader
+	closeAll := func() {
+		for _, file := range files {
+			file.Close()
+		}
+	}
+
+	for i := maxFiles; i >= 0; i-- {
+		file, err := os.Open(segmentPath(path, i))
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			closeAll()
+			return nil, err
+		}
+		files = append(files, file)
+
+		info, err := file.Stat()
+		if err != nil {
+			closeAll()
+			return nil, err
+		}
+		readers = append(readers, io.LimitReader(file, info.Size()))
+	}
+	if len(files) == 0 {
+		return nil, os.ErrNotExist
+	}
+
+	return &segmentReader{
+		Reader: io.MultiReader(readers...),
+		close:  closeAll,
+	}, nil
+}
+
+type segmentReader struct {
+	io.Reader
+	close func()
+}
+
+func (s *segmentReader) Close() error {
+	s.close()
+	return nil
+}
@@ -4,10 +4,12 @@ import (
 	"fmt"
 	"net"
 	"os"
+	"strconv"
 
 	"github.com/insomniacslk/dhcp/dhcpv4"
 	"github.com/insomniacslk/dhcp/iana"
 	"github.com/nik-johnson-net/rackdirector/pkg/dhcpd/server"
+	"github.com/nik-johnson-net/rackdirector/pkg/history"
 )
 
 // DefaultDHCPv4ServerPort is the default server port for DHCPv4 servers
@@ -32,39 +34,86 @@ type DHCPResponse struct {
 	Options        []DHCPOption
 }
 
+// DHCPRequest is what a DHCPv4 request says about where the host is.
+type DHCPRequest struct {
+	// CircuitID, RemoteID and SubscriberID are from the relay agent
+	// information option, if the relay added one.
+	CircuitID    string
+	RemoteID     string
+	SubscriberID string
+	MAC          net.HardwareAddr
+	// RelayIP is the address of the relay the request came through, which
+	// is unspecified if the host is on a network the server is attached to.
+	RelayIP net.IP
+	// LocalIP is the server address the request arrived on.
+	LocalIP net.IP
+}
+
 type DHCPv4Handler interface {
-	Handle(circuitID string, subscriberID string, macAddress net.HardwareAddr, gatewayIP net.IP) (DHCPResponse, error)
+	Handle(request DHCPRequest) (DHCPResponse, error)
 }
 
 // DHCPD is a DHCP server integrated with IPAM
 type DHCPD struct {
 	DHCPv4Handler DHCPv4Handler
-	dhcpdv4       *server.DHCPDv4
+	History       *history.Log
+	// Listen is the address to listen on, :67 by default.
+	Listen string
+	// ServerIP identifies the server when it can't tell which address a
+	// request arrived on.
+	ServerIP net.IP
+	// HTTPPort is the port boot files are served over HTTP on, 80 by
+	// default.
+	HTTPPort int
+	dhcpdv4  *server.DHCPDv4
 }
 
-// ListenAndServe does something
-func (d *DHCPD) ListenAndServe() error {
+// Open binds the DHCP port, reporting any failure to do so.
+func (d *DHCPD) Open() error {
+	listenAddr := net.UDPAddr{
+		Port: DefaultDHCPv4ServerPort,
+	}
+	if d.Listen != "" {
+		addr, err := net.ResolveUDPAddr("udp4", d.Listen)
+		if err != nil {
+			return err
+		}
+		listenAddr = *addr
+	}
+
 	d.dhcpdv4 = &server.DHCPDv4{
 		Handlers: server.DHCPv4Handlers{
 			Discover: d.dhcpv4OnDiscover,
 			Request:  d.dhcpv4OnDiscover,
 		},
-		ListenAddress: net.UDPAddr{
-			Port: 67,
-		},
+		ListenAddress: listenAddr,
+		ServerIP:      d.ServerIP,
 	}
-	go func() {
-		d.dhcpdv4.ListenAndServe()
-	}()
+	return d.dhcpdv4.Open()
+}
 
-	return nil
+// Serve answers requests until Close is called.
+func (d *DHCPD) Serve() error {
+	return d.dhcpdv4.Serve()
 }
 
-// Close closes things
+// Close stops the server.
 func (d *DHCPD) Close() error {
+	if d.dhcpdv4 == nil {
+		return nil
+	}
 	return d.dhcpdv4.Close()
 }
 
+// httpURL returns the URL of path on the HTTP server at address.
+func (d *DHCPD) httpURL(address net.IP, path string) string {
+	host := address.String()
+	if d.HTTPPort != 0 && d.HTTPPort != 80 {
+		host = net.JoinHostPort(host, strconv.Itoa(d.HTTPPort))
+	}
+	return fmt.Sprintf("http://%s/%s", host, path)
+}
+
 func localIP(peer net.Addr) net.IP {
 	host, _, err := net.SplitHostPort(peer.String())
 	if err != nil {
@@ -75,6 +124,7 @@ func localIP(peer net.Addr) net.IP {
 
 func (d *DHCPD) dhcpv4OnDiscover(m *dhcpv4.DHCPv4, localAddr net.IP, peer net.Addr) (*dhcpv4.DHCPv4, error) {
 	var circuitID string
+	var remoteID string
 	var subscriberID string
 	var userClass string
 	modifiers := make([]dhcpv4.Modifier, 0)
@@ -82,6 +132,7 @@ func (d *DHCPD) dhcpv4OnDiscover(m *dhcpv4.DHCPv4, localAddr net.IP, peer net.Ad
 
 	if agentInfo := m.RelayAgentInfo(); agentInfo != nil {
 		circuitID = string(agentInfo.Get(dhcpv4.AgentCircuitIDSubOption))
+		remoteID = string(agentInfo.Get(dhcpv4.AgentRemoteIDSubOption))
 		subscriberID = string(agentInfo.Get(dhcpv4.SubscriberIDSubOption))
 	}
 
@@ -99,7 +150,14 @@ func (d *DHCPD) dhcpv4OnDiscover(m *dhcpv4.DHCPv4, localAddr net.IP, peer net.Ad
 		fmt.Fprintf(os.Stderr, "Compute DHCP Request: %v", m.Summary())
 	}*/
 
-	response, err := d.DHCPv4Handler.Handle(circuitID, subscriberID, m.ClientHWAddr, m.GatewayIPAddr)
+	response, err := d.DHCPv4Handler.Handle(DHCPRequest{
+		CircuitID:    circuitID,
+		RemoteID:     remoteID,
+		SubscriberID: subscriberID,
+		MAC:          m.ClientHWAddr,
+		RelayIP:      m.GatewayIPAddr,
+		LocalIP:      localAddr,
+	})
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "Error responding to DHCPv4 packet - %v:\n%s\n", err, m.Summary())
 		return nil, nil
@@ -111,7 +169,7 @@ func (d *DHCPD) dhcpv4OnDiscover(m *dhcpv4.DHCPv4, localAddr net.IP, peer net.Ad
 	case iana.INTEL_X86PC:
 		if userClass == "iPXE" {
 			fmt.Printf("Serving legacy iPXE\n")
-			bootfile := fmt.Sprintf("http://%s/config.ipxe", localAddr.String())
+			bootfile := d.httpURL(localAddr, "config.ipxe")
 			modifiers = append(modifiers, dhcpv4.WithGeneric(dhcpv4.OptionBootfileName, []byte(bootfile)))
 		} else {
 			fmt.Printf("Serving legacy %s to load undionly.kpxe\n", userClass)
@@ -122,11 +180,11 @@ func (d *DHCPD) dhcpv4OnDiscover(m *dhcpv4.DHCPv4, localAddr net.IP, peer net.Ad
 		switch userClass {
 		case "iPXE":
 			fmt.Printf("Serving UEFI (arch %s) iPXE\n", clientArch)
-			bootfile := fmt.Sprintf("http://%s/config.ipxe", localAddr.String())
+			bootfile := d.httpURL(localAddr, "config.ipxe")
 			modifiers = append(modifiers, dhcpv4.WithGeneric(dhcpv4.OptionBootfileName, []byte(bootfile)))
 		case "HTTPClient":
 			fmt.Printf("Serving UEFI (arch %s) HTTPClient to load ipxe\n", clientArch)
-			bootfile := fmt.Sprintf("http://%s/ipxe.efi", localAddr.String())
+			bootfile := d.httpURL(localAddr, "ipxe.efi")
 			modifiers = append(modifiers, dhcpv4.WithGeneric(dhcpv4.OptionBootfileName, []byte(bootfile)))
 		default:
 			fmt.Printf("Serving UEFI (arch %s) %s to load ipxe\n", clientArch, userClass)
@@ -162,6 +220,17 @@ func (d *DHCPD) dhcpv4OnDiscover(m *dhcpv4.DHCPv4, localAddr net.IP, peer net.Ad
 
 	fmt.Fprintf(os.Stdout, "handing address %v to %v\n", response, circuitID)
 	reply, err := dhcpv4.NewReplyFromRequest(m, modifiers...)
+	if err == nil {
+		err := d.History.Record(history.Event{
+			Hostname: response.Hostname,
+			Address:  response.IP.String(),
+			Type:     history.DHCPServed,
+			Message:  fmt.Sprintf("%v to %v on %v (%v)", replyType, m.ClientHWAddr, circuitID, userClass),
+		})
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error recording DHCP event: %v\n", err)
+		}
+	}
 	/*if circuitID == "ge-0/0/29.0:management" {
 		fmt.Fprintf(os.Stderr, "BMC DHCP Reply: %v", reply.Summary())
 	} else {
@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"net"
 	"os"
+	"sync"
 
 	"github.com/insomniacslk/dhcp/dhcpv4"
 	"github.com/insomniacslk/dhcp/dhcpv4/server4"
@@ -23,10 +24,18 @@ type DHCPv4Handlers struct {
 type DHCPDv4 struct {
 	Handlers      DHCPv4Handlers
 	ListenAddress net.UDPAddr
-	server        *server4.Server
+	// ServerIP is used as the local address of requests received on an
+	// unspecified address.
+	ServerIP net.IP
+	server   *server4.Server
+	mu       sync.Mutex
+	closed   bool
 }
 
 func (d *DHCPDv4) Close() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.closed = true
 	if d.server != nil {
 		return d.server.Close()
 	}
@@ -36,7 +45,7 @@ func (d *DHCPDv4) Close() error {
 func (d *DHCPDv4) handle(conn net.PacketConn, peer net.Addr, m *dhcpv4.DHCPv4) {
 	localAddr := conn.LocalAddr().(*net.UDPAddr).IP
 	if localAddr.IsUnspecified() || len(localAddr) != 4 {
-		localAddr = net.ParseIP("10.0.1.10").To4()
+		localAddr = d.ServerIP.To4()
 	}
 
 	var handler DHCPv4Handler
@@ -80,12 +89,23 @@ func (d *DHCPDv4) handle(conn net.PacketConn, peer net.Addr, m *dhcpv4.DHCPv4) {
 	}
 }
 
-func (d *DHCPDv4) ListenAndServe() error {
+// Open binds ListenAddress.
+func (d *DHCPDv4) Open() error {
 	server, err := server4.NewServer("", &d.ListenAddress, d.handle)
 	if err != nil {
 		return err
 	}
 	d.server = server
+	return nil
+}
 
-	return server.Serve()
+// Serve handles requests until Close is called, after which it returns nil.
+func (d *DHCPDv4) Serve() error {
+	err := d.server.Serve()
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.closed {
+		return nil
+	}
+	return err
 }
@@ -0,0 +1,141 @@
+package history
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// EventType identifies what happened to a host.
+type EventType string
+
+const (
+	PlanStarted        EventType = "plan-started"
+	PlanFinished       EventType = "plan-finished"
+	PlanFailed         EventType = "plan-failed"
+	PlanCancelled      EventType = "plan-cancelled"
+	StageAdvanced      EventType = "stage-advanced"
+	StageRetried       EventType = "stage-retried"
+	StageJumped        EventType = "stage-jumped"
+	DHCPServed         EventType = "dhcp-served"
+	BootScriptFetched  EventType = "boot-script-fetched"
+	SeedFetched        EventType = "seed-fetched"
+	BMCPasswordRotated EventType = "bmc-password-rotated"
+)
+
+// Event is a single entry in a host's timeline.
+type Event struct {
+	Time     time.Time
+	Hostname string
+	Address  string
+	Type     EventType
+	Plan     string `json:",omitempty"`
+	Stage    string `json:",omitempty"`
+	Message  string `json:",omitempty"`
+	// Payload is data the host reported along with the event, such as the
+	// results of an install.
+	Payload json.RawMessage `json:",omitempty"`
+}
+
+// MaxPayload is the largest payload recorded with an event, in bytes. Larger
+// payloads are dropped, and the event message says so.
+const MaxPayload = 64 << 10
+
+// Log is an append-only event log holding one JSON lines file per host in
+// Directory. A nil *Log discards all events.
+type Log struct {
+	Directory string
+	mu        sync.Mutex
+}
+
+// Record appends event to the log of event.Hostname. The event time is set
+// if it is zero.
+func (l *Log) Record(event Event) error {
+	if l == nil {
+		return nil
+	}
+	if event.Hostname == "" {
+		return fmt.Errorf("event %v has no hostname", event.Type)
+	}
+	if event.Time.IsZero() {
+		event.Time = time.Now()
+	}
+	if len(event.Payload) > MaxPayload {
+		dropped := fmt.Sprintf("payload of %d bytes dropped", len(event.Payload))
+		if event.Message != "" {
+			event.Message += ", " + dropped
+		} else {
+			event.Message = dropped
+		}
+		event.Payload = nil
+	}
+
+	line, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if err := os.MkdirAll(l.Directory, 0755); err != nil {
+		return err
+	}
+	file, err := os.OpenFile(l.path(event.Hostname), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	_, err = file.Write(append(line, '\n'))
+	return err
+}
+
+// Events returns the timeline of hostname, oldest first.
+func (l *Log) Events(hostname string) ([]Event, error) {
+	events := make([]Event, 0)
+	if l == nil {
+		return events, nil
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	file, err := os.Open(l.path(hostname))
+	if os.IsNotExist(err) {
+		return events, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	// Events are decoded one after another rather than by line, so a line
+	// is never too long to read.
+	decoder := json.NewDecoder(file)
+	for {
+		var event Event
+		err := decoder.Decode(&event)
+		if err == io.EOF {
+			return events, nil
+		} else if err != nil {
+			return nil, err
+		}
+		events = append(events, event)
+	}
+}
+
+func (l *Log) path(hostname string) string {
+	// Hostnames come from IPAM, but keep them from escaping the directory.
+	name := strings.Map(func(r rune) rune {
+		if r == '/' || r == os.PathSeparator {
+			return '_'
+		}
+		return r
+	}, hostname)
+	return filepath.Join(l.Directory, name+".log")
+}
@@ -0,0 +1,56 @@
+package history
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func newTestLog(t *testing.T) *Log {
+	dir, err := ioutil.TempDir("", "history")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	return &Log{Directory: dir}
+}
+
+// TestEventsLongLines checks events far longer than a bufio.Scanner line
+// are read back, and payloads over MaxPayload aren't recorded.
+func TestEventsLongLines(t *testing.T) {
+	l := newTestLog(t)
+	payload := func(size int) json.RawMessage {
+		return json.RawMessage(fmt.Sprintf("%q", bytes.Repeat([]byte("x"), size-2)))
+	}
+	recorded := []Event{
+		{Hostname: "node1", Type: StageAdvanced, Message: "completed install", Payload: payload(MaxPayload)},
+		{Hostname: "node1", Type: PlanFinished, Message: "plan took 1h", Payload: payload(MaxPayload + 1)},
+		{Hostname: "node1", Type: PlanStarted, Payload: payload(MaxPayload + 1)},
+	}
+	for _, event := range recorded {
+		if err := l.Record(event); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	events, err := l.Events("node1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != len(recorded) {
+		t.Fatalf("read %d events, want %d", len(events), len(recorded))
+	}
+	if !bytes.Equal(events[0].Payload, recorded[0].Payload) {
+		t.Errorf("payload of %d bytes read back as %d bytes", len(recorded[0].Payload), len(events[0].Payload))
+	}
+	dropped := fmt.Sprintf("payload of %d bytes dropped", MaxPayload+1)
+	if events[1].Payload != nil || events[1].Message != "plan took 1h, "+dropped {
+		t.Errorf("oversized payload recorded as %q with %d bytes", events[1].Message, len(events[1].Payload))
+	}
+	if events[2].Payload != nil || events[2].Message != dropped {
+		t.Errorf("oversized payload recorded as %q with %d bytes", events[2].Message, len(events[2].Payload))
+	}
+}
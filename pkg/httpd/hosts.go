@@ -0,0 +1,214 @@
+package httpd
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/nik-johnson-net/rackdirector/pkg/ipam"
+)
+
+type hostsResponse struct {
+	Hosts []ipam.HostRecord
+}
+
+type interfacesResponse struct {
+	Interfaces []ipam.InterfaceRecord
+}
+
+// writeIPAMError responds to a failed IPAM lookup or change.
+func writeIPAMError(w http.ResponseWriter, err error) {
+	status := 500
+	if _, invalid := err.(*ipam.ValidationError); invalid {
+		status = 400
+	} else if err == ipam.ErrNotFound {
+		status = 404
+	} else if err == ipam.ErrExists {
+		status = 409
+	}
+	w.WriteHeader(status)
+	w.Write([]byte(err.Error()))
+}
+
+func writeJSON(w http.ResponseWriter, value interface{}) {
+	err := json.NewEncoder(w).Encode(value)
+	if err != nil {
+		w.WriteHeader(500)
+		w.Write([]byte(err.Error()))
+	}
+}
+
+// editor returns the IPAM if its hosts can be changed through the API, and
+// otherwise responds saying they can't.
+func (h *HTTPD) editor(w http.ResponseWriter) (ipam.Editor, bool) {
+	editor, ok := h.IPAM.(ipam.Editor)
+	if !ok {
+		w.WriteHeader(405)
+		w.Write([]byte("hosts can't be changed with this ipam backend"))
+	}
+	return editor, ok
+}
+
+// decode reads the request body into value, responding if it can't.
+func decode(w http.ResponseWriter, r *http.Request, value interface{}) bool {
+	if err := json.NewDecoder(r.Body).Decode(value); err != nil {
+		w.WriteHeader(400)
+		w.Write([]byte(err.Error()))
+		return false
+	}
+	return true
+}
+
+// listHosts lists every host, or creates one on POST.
+func (h *HTTPD) listHosts(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		hosts := h.IPAM.Hosts()
+		response := hostsResponse{
+			Hosts: make([]ipam.HostRecord, 0, len(hosts)),
+		}
+		for _, host := range hosts {
+			response.Hosts = append(response.Hosts, host.Record())
+		}
+		writeJSON(w, response)
+	case http.MethodPost:
+		editor, ok := h.editor(w)
+		if !ok {
+			return
+		}
+		var record ipam.HostRecord
+		if !decode(w, r, &record) {
+			return
+		}
+		if err := editor.CreateHost(record); err != nil {
+			writeIPAMError(w, err)
+			return
+		}
+		w.WriteHeader(201)
+	default:
+		w.WriteHeader(400)
+	}
+}
+
+// host returns, replaces or deletes hostname.
+func (h *HTTPD) host(w http.ResponseWriter, r *http.Request, hostname string) {
+	if r.Method == http.MethodGet {
+		host, err := h.IPAM.GetByHostname(hostname)
+		if err != nil || host.Hostname != hostname {
+			writeIPAMError(w, ipam.ErrNotFound)
+			return
+		}
+		writeJSON(w, host.Record())
+		return
+	}
+
+	editor, ok := h.editor(w)
+	if !ok {
+		return
+	}
+	var err error
+	switch r.Method {
+	case http.MethodPut:
+		var record ipam.HostRecord
+		if !decode(w, r, &record) {
+			return
+		}
+		err = editor.UpdateHost(hostname, record)
+	case http.MethodDelete:
+		err = editor.DeleteHost(hostname)
+	default:
+		w.WriteHeader(400)
+		return
+	}
+	if err != nil {
+		writeIPAMError(w, err)
+	}
+}
+
+// hostInterfaces lists the interfaces of hostname, or adds one on POST.
+func (h *HTTPD) hostInterfaces(w http.ResponseWriter, r *http.Request, hostname string) {
+	switch r.Method {
+	case http.MethodGet:
+		host, err := h.IPAM.GetByHostname(hostname)
+		if err != nil || host.Hostname != hostname {
+			writeIPAMError(w, ipam.ErrNotFound)
+			return
+		}
+		writeJSON(w, interfacesResponse{Interfaces: host.Record().Interfaces})
+	case http.MethodPost:
+		editor, ok := h.editor(w)
+		if !ok {
+			return
+		}
+		var record ipam.InterfaceRecord
+		if !decode(w, r, &record) {
+			return
+		}
+		if err := editor.AddInterface(hostname, record); err != nil {
+			writeIPAMError(w, err)
+			return
+		}
+		w.WriteHeader(201)
+	default:
+		w.WriteHeader(400)
+	}
+}
+
+// hostInterface replaces or deletes the interface of hostname named device.
+func (h *HTTPD) hostInterface(w http.ResponseWriter, r *http.Request, hostname string, device string) {
+	editor, ok := h.editor(w)
+	if !ok {
+		return
+	}
+	var err error
+	switch r.Method {
+	case http.MethodPut:
+		var record ipam.InterfaceRecord
+		if !decode(w, r, &record) {
+			return
+		}
+		err = editor.UpdateInterface(hostname, device, record)
+	case http.MethodDelete:
+		err = editor.DeleteInterface(hostname, device)
+	default:
+		w.WriteHeader(400)
+		return
+	}
+	if err != nil {
+		writeIPAMError(w, err)
+	}
+}
+
+// hostBMC returns, sets or deletes the BMC of hostname.
+func (h *HTTPD) hostBMC(w http.ResponseWriter, r *http.Request, hostname string) {
+	if r.Method == http.MethodGet {
+		host, err := h.IPAM.GetByHostname(hostname)
+		if err != nil || host.Hostname != hostname || host.Bmc.Ipv4 == nil {
+			writeIPAMError(w, ipam.ErrNotFound)
+			return
+		}
+		writeJSON(w, host.Record().Bmc)
+		return
+	}
+
+	editor, ok := h.editor(w)
+	if !ok {
+		return
+	}
+	var err error
+	switch r.Method {
+	case http.MethodPut:
+		var record ipam.BMCRecord
+		if !decode(w, r, &record) {
+			return
+		}
+		err = editor.SetBMC(hostname, record)
+	case http.MethodDelete:
+		err = editor.DeleteBMC(hostname)
+	default:
+		w.WriteHeader(400)
+		return
+	}
+	if err != nil {
+		writeIPAMError(w, err)
+	}
+}
@@ -1,24 +1,52 @@
 package httpd
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io/ioutil"
 	"log"
 	"net"
 	"net/http"
 	"os"
 	"path/filepath"
+	"strings"
 
+	"github.com/nik-johnson-net/rackdirector/pkg/bmc"
+	"github.com/nik-johnson-net/rackdirector/pkg/console"
+	"github.com/nik-johnson-net/rackdirector/pkg/history"
 	"github.com/nik-johnson-net/rackdirector/pkg/ipam"
+	"github.com/nik-johnson-net/rackdirector/pkg/pxe"
 )
 
+// maxCallbackBytes is the largest callback accepted, payload included.
+const maxCallbackBytes = 1 << 20
+
 type Controller interface {
 	InstallSeed(peer net.IP) ([]byte, error)
 	PxeConfig(peer net.IP) ([]byte, error)
 	IPxeConfig(peer net.IP) ([]byte, error)
 	CurrentPlan(ip net.IP) (string, error)
 	SetPlan(ip net.IP, plan string) error
-	AdvancePlan(peer net.IP) error
+	Callback(request pxe.CallbackRequest) error
+	ReloadPlans() error
+	ListPlans() []pxe.PlanStatus
+	CancelPlan(ip net.IP) error
+	RetryStage(ip net.IP) error
+	JumpToStage(ip net.IP, stage uint) error
+	CompletePlan(ip net.IP) error
+	StartBatch(request pxe.BatchRequest) (pxe.BatchStatus, error)
+	Batch(id string) (pxe.BatchStatus, error)
+	ListBatches() []pxe.BatchStatus
+	RotateBMCPassword(hostname string) error
+	LogRuns(hostname string) ([]string, error)
+	ReadLog(hostname string, run string) ([]byte, error)
+}
+
+// Reloader reloads the settings which can change while running.
+type Reloader interface {
+	Reload() error
 }
 
 type getRequest struct {
@@ -34,6 +62,31 @@ type setRequest struct {
 	Plan    string
 }
 
+type addressRequest struct {
+	Address string
+}
+
+type hostnameRequest struct {
+	Hostname string
+}
+
+type jumpRequest struct {
+	Address string
+	Stage   uint
+}
+
+type listResponse struct {
+	Plans []pxe.PlanStatus
+}
+
+type batchesResponse struct {
+	Batches []pxe.BatchStatus
+}
+
+type historyResponse struct {
+	Events []history.Event
+}
+
 func getPeer(r *http.Request) net.IP {
 	address, _, err := net.SplitHostPort(r.RemoteAddr)
 	if err != nil {
@@ -45,14 +98,28 @@ func getPeer(r *http.Request) net.IP {
 type HTTPD struct {
 	Controller    Controller
 	FileDirectory string
-	endChan       chan<- bool
-	httpServer    http.Server
-	IPAM          *ipam.StaticIpam
+	// Listen is the address to listen on, :80 by default.
+	Listen     string
+	httpServer http.Server
+	listener   net.Listener
+	IPAM       ipam.Store
+	History    *history.Log
+	BMCStatus  *bmc.Poller
+	Consoles   *console.Capturer
+	Reloader   Reloader
 }
 
-func (h *HTTPD) ListenAndServe() (<-chan bool, error) {
-	endChan := make(chan bool, 1)
-	h.endChan = endChan
+// Open binds the HTTP port, :80 unless Listen is set.
+func (h *HTTPD) Open() error {
+	listenAddr := h.Listen
+	if listenAddr == "" {
+		listenAddr = ":80"
+	}
+	listener, err := net.Listen("tcp", listenAddr)
+	if err != nil {
+		return err
+	}
+	h.listener = listener
 
 	muxer := http.NewServeMux()
 	muxer.HandleFunc("/config.ipxe", h.ipxe)
@@ -65,25 +132,47 @@ func (h *HTTPD) ListenAndServe() (<-chan bool, error) {
 	muxer.HandleFunc("/ipxe.efi", h.serveFile)
 	muxer.HandleFunc("/installseed", h.installSeed)
 	muxer.HandleFunc("/api/plan", h.plan)
-	muxer.HandleFunc("/api/advanceplan", h.advanceplan)
+	muxer.HandleFunc("/api/plans", h.listPlans)
+	muxer.HandleFunc("/api/plan/retry", h.retryStage)
+	muxer.HandleFunc("/api/plan/jump", h.jumpToStage)
+	muxer.HandleFunc("/api/plan/complete", h.completePlan)
+	muxer.HandleFunc("/api/batch", h.batch)
+	muxer.HandleFunc("/api/batches", h.listBatches)
+	muxer.HandleFunc("/api/callback", h.callback)
+	muxer.HandleFunc("/api/reloadplans", h.reloadplans)
+	muxer.HandleFunc("/api/reload", h.reload)
 	muxer.HandleFunc("/api/lookup", h.lookup)
+	muxer.HandleFunc("/api/history", h.history)
+	muxer.HandleFunc("/api/bmc/rotate", h.rotateBMCPassword)
+	muxer.HandleFunc("/api/hosts", h.listHosts)
+	muxer.HandleFunc("/api/hosts/", h.hosts)
 	muxer.HandleFunc("/", h.handle404)
 	h.httpServer = http.Server{
 		Handler:  muxer,
 		ErrorLog: log.New(os.Stderr, "http", log.LstdFlags),
 	}
+	return nil
+}
 
-	go func() {
-		err := h.httpServer.ListenAndServe()
-		defer func() {
-			endChan <- true
-		}()
-		if err != nil {
-			panic(err)
-		}
-	}()
+// Serve answers requests until Shutdown is called.
+func (h *HTTPD) Serve() error {
+	err := h.httpServer.Serve(h.listener)
+	if err == http.ErrServerClosed {
+		return nil
+	}
+	return err
+}
 
-	return endChan, nil
+// Shutdown stops accepting requests and waits for those in flight to finish
+// until ctx is done.
+func (h *HTTPD) Shutdown(ctx context.Context) error {
+	if h.listener == nil {
+		return nil
+	}
+	err := h.httpServer.Shutdown(ctx)
+	// Shutdown only closes listeners which are being served.
+	h.listener.Close()
+	return err
 }
 
 func (h *HTTPD) serveFile(w http.ResponseWriter, r *http.Request) {
@@ -133,50 +222,133 @@ func (h *HTTPD) installSeed(w http.ResponseWriter, r *http.Request) {
 	w.Write(body)
 }
 
-func (h *HTTPD) advanceplan(w http.ResponseWriter, r *http.Request) {
-	address := getPeer(r)
-	err := h.Controller.AdvancePlan(address)
+// callback lets a host report the result of its current stage. The request
+// carries the stage's token in place of any other authentication.
+func (h *HTTPD) callback(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(400)
+		return
+	}
+
+	// MaxBytesReader fails reads past the limit, having returned exactly
+	// maxCallbackBytes.
+	body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxCallbackBytes))
+	if err != nil && len(body) == maxCallbackBytes {
+		w.WriteHeader(413)
+		w.Write([]byte(fmt.Sprintf("callback is larger than %d bytes", maxCallbackBytes)))
+		return
+	} else if err != nil {
+		w.WriteHeader(400)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	var request pxe.CallbackRequest
+	err = json.Unmarshal(body, &request)
 	if err != nil {
-		panic(err)
+		w.WriteHeader(400)
+		w.Write([]byte(err.Error()))
+		return
 	}
 
+	err = h.Controller.Callback(request)
+	if err == pxe.ErrInvalidToken {
+		log.Printf("Rejected callback from %v: %v\n", getPeer(r), err)
+		w.WriteHeader(403)
+		w.Write([]byte(err.Error()))
+		return
+	} else if err != nil {
+		w.WriteHeader(500)
+		w.Write([]byte(err.Error()))
+		return
+	}
 	w.WriteHeader(200)
 }
 
-func (h *HTTPD) plan(w http.ResponseWriter, r *http.Request) {
-	var body []byte
-	var err error
+func (h *HTTPD) reloadplans(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodPost:
+		err := h.Controller.ReloadPlans()
+		if err != nil {
+			w.WriteHeader(500)
+			w.Write([]byte(err.Error()))
+			return
+		}
+
+		w.WriteHeader(200)
+	default:
+		w.WriteHeader(400)
+	}
+}
+
+func (h *HTTPD) reload(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(400)
+		return
+	}
+	if h.Reloader == nil {
+		w.WriteHeader(404)
+		return
+	}
 
+	err := h.Reloader.Reload()
+	if err != nil {
+		w.WriteHeader(500)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	w.WriteHeader(200)
+}
+
+func (h *HTTPD) plan(w http.ResponseWriter, r *http.Request) {
 	switch r.Method {
 	case http.MethodGet:
 		var request getRequest
-		err = json.NewDecoder(r.Body).Decode(&request)
+		err := json.NewDecoder(r.Body).Decode(&request)
 		if err != nil {
-			panic(err)
+			w.WriteHeader(400)
+			w.Write([]byte(err.Error()))
+			return
 		}
-		address := net.ParseIP(request.Address)
-		plan, err := h.Controller.CurrentPlan(address)
+		plan, err := h.Controller.CurrentPlan(net.ParseIP(request.Address))
 		if err != nil {
-			panic(err)
+			planError(w, err)
+			return
 		}
-		w.WriteHeader(200)
-		err = json.NewEncoder(w).Encode(getResponse{plan})
+		json.NewEncoder(w).Encode(getResponse{plan})
 
 	case http.MethodPost:
 		var request setRequest
-		err = json.NewDecoder(r.Body).Decode(&request)
+		err := json.NewDecoder(r.Body).Decode(&request)
 		if err != nil {
-			panic(err)
+			w.WriteHeader(400)
+			w.Write([]byte(err.Error()))
+			return
+		}
+		err = h.Controller.SetPlan(net.ParseIP(request.Address), request.Plan)
+		if err != nil {
+			planError(w, err)
+			return
 		}
-		address := net.ParseIP(request.Address)
-		err = h.Controller.SetPlan(address, request.Plan)
+		w.WriteHeader(200)
+
+	case http.MethodDelete:
+		h.planAction(w, r, h.Controller.CancelPlan)
+
+	default:
+		w.WriteHeader(400)
 	}
+}
 
-	if err != nil {
-		panic(err)
+// planError writes err from a plan operation, which is a 404 if the host
+// isn't in a plan.
+func planError(w http.ResponseWriter, err error) {
+	if errors.Is(err, pxe.ErrNoPlan) {
+		w.WriteHeader(404)
+	} else {
+		w.WriteHeader(500)
 	}
-	w.WriteHeader(200)
-	w.Write(body)
+	w.Write([]byte(err.Error()))
 }
 
 func (h *HTTPD) lookup(w http.ResponseWriter, r *http.Request) {
@@ -202,3 +374,375 @@ func (h *HTTPD) lookup(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(400)
 	}
 }
+
+func (h *HTTPD) listPlans(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		err := json.NewEncoder(w).Encode(listResponse{h.Controller.ListPlans()})
+		if err != nil {
+			w.WriteHeader(500)
+			w.Write([]byte(err.Error()))
+			return
+		}
+	default:
+		w.WriteHeader(400)
+	}
+}
+
+// planAction decodes an address from a POST or DELETE body and applies action
+// to it.
+func (h *HTTPD) planAction(w http.ResponseWriter, r *http.Request, action func(net.IP) error) {
+	if r.Method != http.MethodPost && r.Method != http.MethodDelete {
+		w.WriteHeader(400)
+		return
+	}
+
+	var request addressRequest
+	err := json.NewDecoder(r.Body).Decode(&request)
+	if err != nil {
+		w.WriteHeader(400)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	err = action(net.ParseIP(request.Address))
+	if err != nil {
+		planError(w, err)
+		return
+	}
+	w.WriteHeader(200)
+}
+
+func (h *HTTPD) retryStage(w http.ResponseWriter, r *http.Request) {
+	h.planAction(w, r, h.Controller.RetryStage)
+}
+
+func (h *HTTPD) completePlan(w http.ResponseWriter, r *http.Request) {
+	h.planAction(w, r, h.Controller.CompletePlan)
+}
+
+func (h *HTTPD) jumpToStage(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(400)
+		return
+	}
+
+	var request jumpRequest
+	err := json.NewDecoder(r.Body).Decode(&request)
+	if err != nil {
+		w.WriteHeader(400)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	err = h.Controller.JumpToStage(net.ParseIP(request.Address), request.Stage)
+	if err != nil {
+		planError(w, err)
+		return
+	}
+	w.WriteHeader(200)
+}
+
+func (h *HTTPD) history(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		hostname := r.URL.Query().Get("hostname")
+		if hostname == "" {
+			w.WriteHeader(400)
+			w.Write([]byte("hostname is required"))
+			return
+		}
+
+		events, err := h.History.Events(hostname)
+		if err != nil {
+			w.WriteHeader(500)
+			w.Write([]byte(err.Error()))
+			return
+		}
+
+		err = json.NewEncoder(w).Encode(historyResponse{events})
+		if err != nil {
+			w.WriteHeader(500)
+			w.Write([]byte(err.Error()))
+			return
+		}
+	default:
+		w.WriteHeader(400)
+	}
+}
+
+// hosts serves /api/hosts/{hostname}/{resource}.
+func (h *HTTPD) hosts(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/api/hosts/"), "/")
+	if len(parts) == 1 {
+		h.host(w, r, parts[0])
+		return
+	}
+	if len(parts) == 3 && parts[1] == "interfaces" {
+		h.hostInterface(w, r, parts[0], parts[2])
+		return
+	}
+	if len(parts) != 2 {
+		h.handle404(w, r)
+		return
+	}
+	hostname, resource := parts[0], parts[1]
+
+	switch resource {
+	case "interfaces":
+		h.hostInterfaces(w, r, hostname)
+	case "bmc":
+		h.hostBMC(w, r, hostname)
+	case "power":
+		h.power(w, r, hostname)
+	case "console":
+		h.console(w, r, hostname)
+	case "consoles":
+		h.consoles(w, r, hostname)
+	case "logs":
+		h.logs(w, r, hostname)
+	default:
+		h.handle404(w, r)
+	}
+}
+
+// power returns the last polled BMC status of hostname, polling it now if it
+// hasn't been yet.
+func (h *HTTPD) power(w http.ResponseWriter, r *http.Request, hostname string) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(400)
+		return
+	}
+	if h.BMCStatus == nil {
+		w.WriteHeader(500)
+		w.Write([]byte("bmc polling is disabled"))
+		return
+	}
+
+	host, err := h.IPAM.GetByHostname(hostname)
+	if err != nil {
+		w.WriteHeader(404)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	status, polled := h.BMCStatus.Status(host.Hostname)
+	if !polled {
+		status = h.BMCStatus.Poll(r.Context(), host)
+	}
+
+	err = json.NewEncoder(w).Encode(status)
+	if err != nil {
+		w.WriteHeader(500)
+		w.Write([]byte(err.Error()))
+		return
+	}
+}
+
+type logsResponse struct {
+	Runs []string
+}
+
+// logs lists the plan runs hostname sent logs for, or with ?run= returns the
+// logs of that run.
+func (h *HTTPD) logs(w http.ResponseWriter, r *http.Request, hostname string) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(400)
+		return
+	}
+
+	run := r.URL.Query().Get("run")
+	if run == "" {
+		runs, err := h.Controller.LogRuns(hostname)
+		if err != nil {
+			w.WriteHeader(500)
+			w.Write([]byte(err.Error()))
+			return
+		}
+		err = json.NewEncoder(w).Encode(logsResponse{runs})
+		if err != nil {
+			w.WriteHeader(500)
+			w.Write([]byte(err.Error()))
+		}
+		return
+	}
+
+	logs, err := h.Controller.ReadLog(hostname, run)
+	if os.IsNotExist(err) {
+		w.WriteHeader(404)
+		w.Write([]byte(fmt.Sprintf("no logs %v for %v", run, hostname)))
+		return
+	} else if err != nil {
+		w.WriteHeader(500)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Write(logs)
+}
+
+type consolesResponse struct {
+	Runs []console.Run
+}
+
+// consoles lists the captured console logs of hostname.
+func (h *HTTPD) consoles(w http.ResponseWriter, r *http.Request, hostname string) {
+	if r.Method != http.MethodGet || h.Consoles == nil {
+		w.WriteHeader(400)
+		return
+	}
+
+	runs, err := h.Consoles.Runs(hostname)
+	if err != nil {
+		w.WriteHeader(500)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	err = json.NewEncoder(w).Encode(consolesResponse{runs})
+	if err != nil {
+		w.WriteHeader(500)
+		w.Write([]byte(err.Error()))
+		return
+	}
+}
+
+// console serves the console log of the run given by ?run=, defaulting to
+// the newest. With ?follow=true a live capture is streamed as it happens.
+func (h *HTTPD) console(w http.ResponseWriter, r *http.Request, hostname string) {
+	if r.Method != http.MethodGet || h.Consoles == nil {
+		w.WriteHeader(400)
+		return
+	}
+
+	run := r.URL.Query().Get("run")
+	if run == "" {
+		runs, err := h.Consoles.Runs(hostname)
+		if err != nil {
+			w.WriteHeader(500)
+			w.Write([]byte(err.Error()))
+			return
+		}
+		if len(runs) == 0 {
+			w.WriteHeader(404)
+			w.Write([]byte(fmt.Sprintf("no console logs for %v", hostname)))
+			return
+		}
+		run = runs[0].ID
+	}
+
+	follow := r.URL.Query().Get("follow") == "true"
+	reader, err := h.Consoles.Open(hostname, run, follow)
+	if os.IsNotExist(err) {
+		w.WriteHeader(404)
+		w.Write([]byte(fmt.Sprintf("no console log %v for %v", run, hostname)))
+		return
+	} else if err != nil {
+		w.WriteHeader(500)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	defer reader.Close()
+
+	go func() {
+		<-r.Context().Done()
+		reader.Close()
+	}()
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	flusher, _ := w.(http.Flusher)
+	buffer := make([]byte, 4096)
+	for {
+		n, err := reader.Read(buffer)
+		if n > 0 {
+			if _, err := w.Write(buffer[:n]); err != nil {
+				return
+			}
+			if follow && flusher != nil {
+				flusher.Flush()
+			}
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+func (h *HTTPD) rotateBMCPassword(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(400)
+		return
+	}
+
+	var request hostnameRequest
+	err := json.NewDecoder(r.Body).Decode(&request)
+	if err != nil {
+		w.WriteHeader(400)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	err = h.Controller.RotateBMCPassword(request.Hostname)
+	if err != nil {
+		w.WriteHeader(500)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	w.WriteHeader(200)
+}
+
+// batch starts a batch, or returns the status of the batch given by the id
+// query parameter. Batches are kept in memory only, so they are forgotten
+// when rackdirector restarts.
+func (h *HTTPD) batch(w http.ResponseWriter, r *http.Request) {
+	var status pxe.BatchStatus
+	var err error
+
+	switch r.Method {
+	case http.MethodGet:
+		status, err = h.Controller.Batch(r.URL.Query().Get("id"))
+		if err != nil {
+			w.WriteHeader(404)
+			w.Write([]byte(err.Error()))
+			return
+		}
+
+	case http.MethodPost:
+		var request pxe.BatchRequest
+		err = json.NewDecoder(r.Body).Decode(&request)
+		if err != nil {
+			w.WriteHeader(400)
+			w.Write([]byte(err.Error()))
+			return
+		}
+		status, err = h.Controller.StartBatch(request)
+		if err != nil {
+			w.WriteHeader(500)
+			w.Write([]byte(err.Error()))
+			return
+		}
+
+	default:
+		w.WriteHeader(400)
+		return
+	}
+
+	err = json.NewEncoder(w).Encode(status)
+	if err != nil {
+		w.WriteHeader(500)
+		w.Write([]byte(err.Error()))
+	}
+}
+
+func (h *HTTPD) listBatches(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		err := json.NewEncoder(w).Encode(batchesResponse{h.Controller.ListBatches()})
+		if err != nil {
+			w.WriteHeader(500)
+			w.Write([]byte(err.Error()))
+			return
+		}
+	default:
+		w.WriteHeader(400)
+	}
+}
@@ -0,0 +1,80 @@
+package httpd
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/nik-johnson-net/rackdirector/pkg/pxe"
+)
+
+// fakeController answers callbacks and plan cancellations. Other Controller
+// methods aren't implemented.
+type fakeController struct {
+	Controller
+	callbacks []pxe.CallbackRequest
+}
+
+func (f *fakeController) Callback(request pxe.CallbackRequest) error {
+	f.callbacks = append(f.callbacks, request)
+	if request.Token != "valid" {
+		return pxe.ErrInvalidToken
+	}
+	return nil
+}
+
+func (f *fakeController) CancelPlan(ip net.IP) error {
+	if !ip.Equal(net.ParseIP("10.0.0.1")) {
+		return fmt.Errorf("%v %w", ip, pxe.ErrNoPlan)
+	}
+	return nil
+}
+
+func TestCallback(t *testing.T) {
+	payload := strings.Repeat("x", maxCallbackBytes)
+	tests := []struct {
+		name   string
+		body   string
+		status int
+	}{
+		{"valid", `{"Token": "valid", "Status": "success"}`, 200},
+		{"invalid token", `{"Token": "used", "Status": "success"}`, 403},
+		{"bad json", `{"Token": `, 400},
+		{"too large", fmt.Sprintf(`{"Token": "valid", "Status": "success", "Payload": %q}`, payload), 413},
+	}
+	for _, test := range tests {
+		controller := &fakeController{}
+		h := &HTTPD{Controller: controller}
+		w := httptest.NewRecorder()
+		h.callback(w, httptest.NewRequest(http.MethodPost, "/api/callback", bytes.NewBufferString(test.body)))
+		if w.Code != test.status {
+			t.Errorf("%v callback gave %d %q, want %d", test.name, w.Code, w.Body.String(), test.status)
+		}
+		if test.status >= 400 && test.status != 403 && len(controller.callbacks) != 0 {
+			t.Errorf("%v callback was passed on", test.name)
+		}
+	}
+}
+
+func TestCancelPlan(t *testing.T) {
+	tests := []struct {
+		body   string
+		status int
+	}{
+		{`{"Address": "10.0.0.1"}`, 200},
+		{`{"Address": "10.0.0.2"}`, 404},
+		{`{"Address": `, 400},
+	}
+	for _, test := range tests {
+		h := &HTTPD{Controller: &fakeController{}}
+		w := httptest.NewRecorder()
+		h.plan(w, httptest.NewRequest(http.MethodDelete, "/api/plan", bytes.NewBufferString(test.body)))
+		if w.Code != test.status {
+			t.Errorf("cancelling %v gave %d %q, want %d", test.body, w.Code, w.Body.String(), test.status)
+		}
+	}
+}
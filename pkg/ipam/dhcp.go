@@ -0,0 +1,186 @@
+package ipam
+
+import (
+	"bytes"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/nik-johnson-net/rackdirector/pkg/dhcpd"
+)
+
+// Ways of matching DHCP requests to hosts. MatchCircuitID finds the
+// interface or BMC whose port is the relay's circuit ID, on the switch with
+// the relay's remote ID if it was given one. MatchRemoteID only finds those
+// given a remote ID, MatchMAC finds the one with the request's MAC, and
+// MatchAny tries each of them in turn.
+const (
+	MatchRemoteID  = "remote_id"
+	MatchCircuitID = "circuit_id"
+	MatchMAC       = "mac"
+	MatchAny       = "any"
+)
+
+// NetworkMatch says how requests from Network are matched to hosts, trying
+// each of Match in turn until one finds the host.
+type NetworkMatch struct {
+	Network net.IPNet
+	Match   []string
+}
+
+// DHCPHandler hands out the addresses of hosts in Store over DHCP.
+type DHCPHandler struct {
+	Store Store
+	// Nameservers, Lease and TFTPServer are handed to every host.
+	Nameservers []net.IP
+	Lease       time.Duration
+	TFTPServer  string
+	// Networks says how requests are matched to hosts on each network, which
+	// is the relay's for relayed requests and the server's otherwise. The
+	// first network holding the address is used. Requests from any other
+	// network are matched as Match says, or by circuit ID if it is empty.
+	Networks []NetworkMatch
+	Match    []string
+}
+
+func getDomain(hostname string) string {
+	split := strings.SplitN(hostname, ".", 2)
+	return split[1]
+}
+
+func (d *DHCPHandler) Handle(request dhcpd.DHCPRequest) (dhcpd.DHCPResponse, error) {
+	for _, match := range d.matches(request) {
+		var response dhcpd.DHCPResponse
+		var err error
+		switch match {
+		case MatchRemoteID:
+			response, err = d.byPort(request, true)
+		case MatchCircuitID:
+			response, err = d.byPort(request, false)
+		case MatchMAC:
+			response, err = d.byMAC(request)
+		default:
+			continue
+		}
+		if err != ErrNotFound {
+			return response, err
+		}
+	}
+	return dhcpd.DHCPResponse{}, ErrNotFound
+}
+
+// matches lists the ways of matching request to try, in order.
+func (d *DHCPHandler) matches(request dhcpd.DHCPRequest) []string {
+	ip := request.RelayIP
+	if ip == nil || ip.IsUnspecified() {
+		ip = request.LocalIP
+	}
+	match := d.Match
+	for _, network := range d.Networks {
+		if network.Network.Contains(ip) {
+			match = network.Match
+			break
+		}
+	}
+	if len(match) == 0 {
+		return []string{MatchCircuitID}
+	}
+
+	matches := make([]string, 0, len(match))
+	for _, m := range match {
+		if m == MatchAny {
+			matches = append(matches, MatchRemoteID, MatchCircuitID, MatchMAC)
+			continue
+		}
+		matches = append(matches, m)
+	}
+	return matches
+}
+
+// remoteID is the relay's remote ID, or its subscriber ID for relays which
+// identify the switch with that instead.
+func remoteID(request dhcpd.DHCPRequest) string {
+	if request.RemoteID != "" {
+		return request.RemoteID
+	}
+	return request.SubscriberID
+}
+
+// byPort matches the request by the switch port the relay names. Unless
+// withRemoteID is set, ports given no remote ID match any relay's requests.
+func (d *DHCPHandler) byPort(request dhcpd.DHCPRequest, withRemoteID bool) (dhcpd.DHCPResponse, error) {
+	remote := remoteID(request)
+	// Requests which weren't relayed with a circuit ID would otherwise match
+	// interfaces without a port.
+	if request.CircuitID == "" || (withRemoteID && remote == "") {
+		return dhcpd.DHCPResponse{}, ErrNotFound
+	}
+	h, err := d.Store.GetByPort(remote, request.CircuitID, request.RelayIP)
+	if err != nil {
+		return dhcpd.DHCPResponse{}, err
+	}
+
+	remoteIDs := []string{remote}
+	if !withRemoteID {
+		remoteIDs = append(remoteIDs, "")
+	}
+	for _, remoteID := range remoteIDs {
+		for _, interf := range h.Interfaces {
+			if interf.RemoteID == remoteID && interf.Port == request.CircuitID {
+				return d.interfaceResponse(h, interf), nil
+			}
+		}
+		if h.Bmc.RemoteID == remoteID && h.Bmc.Port == request.CircuitID {
+			return d.bmcResponse(h), nil
+		}
+	}
+	return dhcpd.DHCPResponse{}, ErrNotFound
+}
+
+func (d *DHCPHandler) byMAC(request dhcpd.DHCPRequest) (dhcpd.DHCPResponse, error) {
+	if len(request.MAC) == 0 {
+		return dhcpd.DHCPResponse{}, ErrNotFound
+	}
+	h, err := d.Store.GetByMAC(request.MAC)
+	if err != nil {
+		return dhcpd.DHCPResponse{}, err
+	}
+	for _, interf := range h.Interfaces {
+		if bytes.Equal(interf.MAC, request.MAC) {
+			return d.interfaceResponse(h, interf), nil
+		}
+	}
+	if bytes.Equal(h.Bmc.MAC, request.MAC) {
+		return d.bmcResponse(h), nil
+	}
+	return dhcpd.DHCPResponse{}, ErrNotFound
+}
+
+func (d *DHCPHandler) interfaceResponse(h Host, interf Interface) dhcpd.DHCPResponse {
+	return dhcpd.DHCPResponse{
+		IP:             interf.Ipv4,
+		Network:        interf.Network,
+		Gateway:        interf.Ipv4Gateway,
+		DNS:            d.Nameservers,
+		Lease:          d.leaseSeconds(),
+		Hostname:       h.Hostname,
+		DomainSearch:   getDomain(h.Hostname),
+		TFTPServerName: d.TFTPServer,
+	}
+}
+
+func (d *DHCPHandler) bmcResponse(h Host) dhcpd.DHCPResponse {
+	return dhcpd.DHCPResponse{
+		IP:           h.Bmc.Ipv4,
+		Network:      h.Bmc.Network,
+		Gateway:      h.Bmc.Ipv4Gateway,
+		DNS:          d.Nameservers,
+		Lease:        d.leaseSeconds(),
+		Hostname:     h.Hostname,
+		DomainSearch: getDomain(h.Hostname),
+	}
+}
+
+func (d *DHCPHandler) leaseSeconds() uint32 {
+	return uint32(d.Lease / time.Second)
+}
@@ -0,0 +1,188 @@
+package ipam
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/nik-johnson-net/rackdirector/pkg/dhcpd"
+)
+
+// testStore returns a Store of records, which must be valid.
+func testStore(t *testing.T, records ...HostRecord) Store {
+	config, err := fromRecords(records)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := &hostDatabase{}
+	store.replace(config)
+	return store
+}
+
+func dhcpRecord(hostname string, remoteID string, port string, mac string, ipv4 string) HostRecord {
+	return HostRecord{
+		Hostname: hostname,
+		Interfaces: []InterfaceRecord{{
+			Device:   "eth0",
+			RemoteID: remoteID,
+			Port:     port,
+			MAC:      mac,
+			Ipv4:     ipv4,
+		}},
+	}
+}
+
+func mustParseCIDR(s string) net.IPNet {
+	_, network, err := net.ParseCIDR(s)
+	if err != nil {
+		panic(err)
+	}
+	return *network
+}
+
+func mustParseMAC(s string) net.HardwareAddr {
+	mac, err := net.ParseMAC(s)
+	if err != nil {
+		panic(err)
+	}
+	return mac
+}
+
+func TestDHCPHandlerMatch(t *testing.T) {
+	handler := &DHCPHandler{
+		Store: testStore(t,
+			dhcpRecord("remote.example.com", "sw1", "Ethernet1", "52:54:00:00:00:01", "10.0.0.1/24"),
+			dhcpRecord("circuit.example.com", "", "Ethernet1", "52:54:00:00:00:02", "10.0.0.2/24"),
+			dhcpRecord("mac.example.com", "", "Ethernet3", "52:54:00:00:00:03", "10.0.0.3/24"),
+			dhcpRecord("any-remote.example.com", "sw1", "Ethernet1", "", "10.0.1.1/24"),
+			dhcpRecord("any-circuit.example.com", "", "Ethernet1", "", "10.0.1.2/24"),
+			dhcpRecord("global.example.com", "", "Ethernet1", "", "10.0.3.1/24"),
+		),
+		Lease: time.Hour,
+		Networks: []NetworkMatch{
+			{Network: mustParseCIDR("10.0.0.0/24"), Match: []string{MatchRemoteID, MatchCircuitID}},
+			{Network: mustParseCIDR("10.0.1.0/24"), Match: []string{MatchAny}},
+		},
+		Match: []string{MatchMAC, MatchCircuitID},
+	}
+	knownMAC := mustParseMAC("52:54:00:00:00:03")
+	unknownMAC := mustParseMAC("52:54:00:00:00:09")
+	relayed := func(relayIP string, remoteID string, port string, mac net.HardwareAddr) dhcpd.DHCPRequest {
+		return dhcpd.DHCPRequest{
+			CircuitID: port,
+			RemoteID:  remoteID,
+			MAC:       mac,
+			RelayIP:   net.ParseIP(relayIP),
+			LocalIP:   net.ParseIP("10.0.0.250"),
+		}
+	}
+	direct := func(localIP string, relayIP net.IP) dhcpd.DHCPRequest {
+		return dhcpd.DHCPRequest{MAC: knownMAC, RelayIP: relayIP, LocalIP: net.ParseIP(localIP)}
+	}
+	subscriber := relayed("10.0.0.254", "", "Ethernet1", knownMAC)
+	subscriber.SubscriberID = "sw1"
+
+	tests := []struct {
+		name    string
+		request dhcpd.DHCPRequest
+		// want is the hostname matched, or empty if none is.
+		want string
+	}{
+		{"network: remote ID first", relayed("10.0.0.254", "sw1", "Ethernet1", knownMAC), "remote.example.com"},
+		{"network: circuit ID after unknown remote ID", relayed("10.0.0.254", "sw9", "Ethernet1", knownMAC), "circuit.example.com"},
+		{"network: circuit ID without remote ID", relayed("10.0.0.254", "", "Ethernet1", knownMAC), "circuit.example.com"},
+		{"network: subscriber ID as remote ID", subscriber, "remote.example.com"},
+		{"network: no MAC fallback", relayed("10.0.0.254", "sw1", "Ethernet9", knownMAC), ""},
+		{"global: MAC before circuit ID", relayed("10.0.3.254", "sw1", "Ethernet1", knownMAC), "mac.example.com"},
+		{"global: circuit ID after unknown MAC", relayed("10.0.3.254", "sw1", "Ethernet1", unknownMAC), "global.example.com"},
+		{"global: circuit ID only on the relay network", relayed("10.0.4.254", "", "Ethernet1", unknownMAC), ""},
+		{"any: remote ID first", relayed("10.0.1.254", "sw1", "Ethernet1", knownMAC), "any-remote.example.com"},
+		{"any: circuit ID next", relayed("10.0.1.254", "sw9", "Ethernet1", knownMAC), "any-circuit.example.com"},
+		{"any: MAC last", relayed("10.0.1.254", "sw1", "Ethernet9", knownMAC), "mac.example.com"},
+		{"direct: network of the local address", direct("10.0.0.250", net.IPv4zero), ""},
+		{"direct: no relay address", direct("10.0.3.250", nil), "mac.example.com"},
+		{"direct: any", direct("10.0.1.250", net.IPv4zero), "mac.example.com"},
+	}
+	for _, test := range tests {
+		response, err := handler.Handle(test.request)
+		if test.want == "" {
+			if err != ErrNotFound {
+				t.Errorf("%v: got %v, %v, want %v", test.name, response.Hostname, err, ErrNotFound)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%v: %v", test.name, err)
+			continue
+		}
+		if response.Hostname != test.want {
+			t.Errorf("%v: matched %v, want %v", test.name, response.Hostname, test.want)
+		}
+		if response.Lease != 3600 {
+			t.Errorf("%v: lease %v, want 3600", test.name, response.Lease)
+		}
+	}
+}
+
+func TestDHCPHandlerDefaultMatch(t *testing.T) {
+	handler := &DHCPHandler{
+		Store: testStore(t, dhcpRecord("node1.example.com", "", "Ethernet1", "52:54:00:00:00:01", "10.0.0.1/24")),
+	}
+	request := dhcpd.DHCPRequest{
+		CircuitID: "Ethernet1",
+		MAC:       mustParseMAC("52:54:00:00:00:01"),
+		RelayIP:   net.ParseIP("10.0.0.254"),
+	}
+	if response, err := handler.Handle(request); err != nil || !response.IP.Equal(net.ParseIP("10.0.0.1")) {
+		t.Errorf("circuit ID matched %v, %v", response.IP, err)
+	}
+	request.CircuitID = ""
+	if _, err := handler.Handle(request); err != ErrNotFound {
+		t.Errorf("MAC matched without being asked for, %v", err)
+	}
+}
+
+// TestDHCPHandlerRemoteID checks which interface or BMC of a host found by
+// port is handed out, and that only relays giving a remote ID match by it.
+func TestDHCPHandlerRemoteID(t *testing.T) {
+	node1 := dhcpRecord("node1.example.com", "sw1", "Ethernet1", "", "10.0.0.1/24")
+	node1.Interfaces = append(node1.Interfaces, InterfaceRecord{Device: "eth1", Port: "Ethernet1", Ipv4: "10.0.0.2/24"})
+	node1.Bmc = BMCRecord{Type: "ipmi", RemoteID: "mgmt1", Port: "Ethernet1", Ipv4: "10.0.1.1/24"}
+	node2 := dhcpRecord("node2.example.com", "sw2", "Ethernet1", "", "10.0.0.3/24")
+	store := testStore(t, node1, node2)
+
+	tests := []struct {
+		name     string
+		match    string
+		remoteID string
+		relayIP  string
+		// want is the address handed out, or empty if none is.
+		want string
+	}{
+		{"remote ID", MatchRemoteID, "sw1", "10.0.0.254", "10.0.0.1"},
+		{"remote ID of another switch", MatchRemoteID, "sw2", "10.0.0.254", "10.0.0.3"},
+		{"remote ID of a BMC", MatchRemoteID, "mgmt1", "10.0.1.254", "10.0.1.1"},
+		{"remote ID missing", MatchRemoteID, "", "10.0.0.254", ""},
+		{"remote ID unknown", MatchRemoteID, "sw9", "10.0.0.254", ""},
+		{"circuit ID with remote ID", MatchCircuitID, "sw1", "10.0.0.254", "10.0.0.1"},
+		{"circuit ID with unknown remote ID", MatchCircuitID, "sw9", "10.0.0.254", "10.0.0.2"},
+		{"circuit ID without remote ID", MatchCircuitID, "", "10.0.0.254", "10.0.0.2"},
+	}
+	for _, test := range tests {
+		handler := &DHCPHandler{Store: store, Match: []string{test.match}}
+		response, err := handler.Handle(dhcpd.DHCPRequest{
+			CircuitID: "Ethernet1",
+			RemoteID:  test.remoteID,
+			RelayIP:   net.ParseIP(test.relayIP),
+		})
+		if test.want == "" {
+			if err != ErrNotFound {
+				t.Errorf("%v: got %v, %v, want %v", test.name, response.IP, err, ErrNotFound)
+			}
+			continue
+		}
+		if err != nil || !response.IP.Equal(net.ParseIP(test.want)) {
+			t.Errorf("%v: got %v, %v, want %v", test.name, response.IP, err, test.want)
+		}
+	}
+}
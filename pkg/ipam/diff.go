@@ -0,0 +1,65 @@
+package ipam
+
+import (
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// HostDiff lists the hosts added, removed and changed by a reload.
+type HostDiff struct {
+	Added   []string
+	Removed []string
+	Changed []string
+}
+
+// Empty reports whether nothing changed.
+func (d HostDiff) Empty() bool {
+	return len(d.Added) == 0 && len(d.Removed) == 0 && len(d.Changed) == 0
+}
+
+func (d HostDiff) String() string {
+	if d.Empty() {
+		return "no changes"
+	}
+	parts := make([]string, 0, 3)
+	for _, part := range []struct {
+		name  string
+		hosts []string
+	}{
+		{"added", d.Added},
+		{"removed", d.Removed},
+		{"changed", d.Changed},
+	} {
+		if len(part.hosts) != 0 {
+			parts = append(parts, part.name+" "+strings.Join(part.hosts, ", "))
+		}
+	}
+	return strings.Join(parts, "; ")
+}
+
+func diffHosts(previous []Host, next []Host) HostDiff {
+	before := make(map[string]Host, len(previous))
+	for _, host := range previous {
+		before[host.Hostname] = host
+	}
+
+	var diff HostDiff
+	for _, host := range next {
+		old, existed := before[host.Hostname]
+		if !existed {
+			diff.Added = append(diff.Added, host.Hostname)
+		} else if !reflect.DeepEqual(old, host) {
+			diff.Changed = append(diff.Changed, host.Hostname)
+		}
+		delete(before, host.Hostname)
+	}
+	for hostname := range before {
+		diff.Removed = append(diff.Removed, hostname)
+	}
+
+	sort.Strings(diff.Added)
+	sort.Strings(diff.Removed)
+	sort.Strings(diff.Changed)
+	return diff
+}
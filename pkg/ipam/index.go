@@ -0,0 +1,51 @@
+package ipam
+
+import "net"
+
+// hostIndex finds hosts without scanning them all, which matters when a
+// rack powers on and every host asks for an address at once. Each map gives
+// the position of the host in the list it was built from. Where several
+// hosts share a key, the first listed wins, as lint refuses such duplicates
+// anyway.
+type hostIndex struct {
+	// byPort lists the networks and remote IDs of the switches each switch
+	// port is on, in host order.
+	byPort     map[string][]portEntry
+	byIP       map[string]int
+	byHostname map[string]int
+	byMAC      map[string]int
+}
+
+type portEntry struct {
+	network  net.IPNet
+	remoteID string
+	host     int
+}
+
+func newHostIndex(hosts []Host) hostIndex {
+	index := hostIndex{
+		byPort:     make(map[string][]portEntry),
+		byIP:       make(map[string]int, len(hosts)*2),
+		byHostname: make(map[string]int, len(hosts)*2),
+		byMAC:      make(map[string]int),
+	}
+	add := func(keys map[string]int, key string, host int) {
+		if _, taken := keys[key]; key != "" && !taken {
+			keys[key] = host
+		}
+	}
+
+	for i, host := range hosts {
+		add(index.byHostname, host.Hostname, i)
+		add(index.byHostname, host.Bmc.Hostname, i)
+		for _, interf := range host.Interfaces {
+			index.byPort[interf.Port] = append(index.byPort[interf.Port], portEntry{interf.Network, interf.RemoteID, i})
+			add(index.byIP, string(interf.Ipv4.To16()), i)
+			add(index.byMAC, string(interf.MAC), i)
+		}
+		index.byPort[host.Bmc.Port] = append(index.byPort[host.Bmc.Port], portEntry{host.Bmc.Network, host.Bmc.RemoteID, i})
+		add(index.byIP, string(host.Bmc.Ipv4.To16()), i)
+		add(index.byMAC, string(host.Bmc.MAC), i)
+	}
+	return index
+}
@@ -0,0 +1,146 @@
+package ipam
+
+import (
+	"fmt"
+	"net"
+	"testing"
+)
+
+func TestGetByPortRemoteID(t *testing.T) {
+	store := testStore(t,
+		dhcpRecord("sw1-port1.example.com", "sw1", "Ethernet1", "", "10.0.0.1/24"),
+		dhcpRecord("sw2-port1.example.com", "sw2", "Ethernet1", "", "10.0.0.2/24"),
+		dhcpRecord("port2.example.com", "", "Ethernet2", "", "10.0.0.3/24"),
+		dhcpRecord("sw1-port3.example.com", "sw1", "Ethernet3", "", "10.0.0.4/24"),
+		dhcpRecord("port3.example.com", "", "Ethernet3", "", "10.0.0.5/24"),
+	)
+	tests := []struct {
+		name     string
+		remoteID string
+		port     string
+		relayIP  string
+		// want is the hostname found, or empty if none is.
+		want string
+	}{
+		{"first switch", "sw1", "Ethernet1", "10.0.0.254", "sw1-port1.example.com"},
+		{"second switch", "sw2", "Ethernet1", "10.0.0.254", "sw2-port1.example.com"},
+		{"unknown switch", "sw3", "Ethernet1", "10.0.0.254", ""},
+		{"no remote ID in request", "", "Ethernet1", "10.0.0.254", ""},
+		{"other network", "sw1", "Ethernet1", "10.0.9.254", ""},
+		{"entry without remote ID", "sw1", "Ethernet2", "10.0.0.254", "port2.example.com"},
+		{"neither with remote ID", "", "Ethernet2", "10.0.0.254", "port2.example.com"},
+		{"remote ID wins", "sw1", "Ethernet3", "10.0.0.254", "sw1-port3.example.com"},
+		{"entry without remote ID for other switches", "sw2", "Ethernet3", "10.0.0.254", "port3.example.com"},
+		{"entry without remote ID for no remote ID", "", "Ethernet3", "10.0.0.254", "port3.example.com"},
+	}
+	for _, test := range tests {
+		host, err := store.GetByPort(test.remoteID, test.port, net.ParseIP(test.relayIP))
+		if test.want == "" {
+			if err != ErrNotFound {
+				t.Errorf("%v: got %v, %v, want %v", test.name, host.Hostname, err, ErrNotFound)
+			}
+			continue
+		}
+		if err != nil || host.Hostname != test.want {
+			t.Errorf("%v: got %v, %v, want %v", test.name, host.Hostname, err, test.want)
+		}
+	}
+}
+
+const benchmarkHosts = 10000
+
+// benchmarkConfig indexes hosts cabled to 48-port switches which name
+// their ports alike and tell them apart by remote ID, so every port name is
+// shared by a couple of hundred hosts.
+func benchmarkConfig() ipamConfig {
+	_, network, _ := net.ParseCIDR("10.1.0.0/16")
+	_, bmcNetwork, _ := net.ParseCIDR("10.2.0.0/16")
+	hosts := make([]Host, 0, benchmarkHosts)
+	for i := 0; i < benchmarkHosts; i++ {
+		hosts = append(hosts, Host{
+			Hostname: fmt.Sprintf("node%d.example.com", i),
+			Interfaces: []Interface{{
+				Device:   "eth0",
+				RemoteID: fmt.Sprintf("sw%d", i/48),
+				Port:     fmt.Sprintf("Ethernet%d", i%48),
+				MAC:      benchmarkMAC(1, i),
+				Ipv4:     benchmarkIP(1, i),
+				Network:  *network,
+			}},
+			Bmc: BMC{
+				Hostname: fmt.Sprintf("node%d-ipmi.example.com", i),
+				RemoteID: fmt.Sprintf("mgmt%d", i/48),
+				Port:     fmt.Sprintf("Ethernet%d", i%48),
+				MAC:      benchmarkMAC(2, i),
+				Ipv4:     benchmarkIP(2, i),
+				Network:  *bmcNetwork,
+			},
+		})
+	}
+	return ipamConfig{Hosts: hosts, index: newHostIndex(hosts)}
+}
+
+func benchmarkIP(network byte, host int) net.IP {
+	return net.IPv4(10, network, byte(host>>8), byte(host))
+}
+
+func benchmarkMAC(network byte, host int) net.HardwareAddr {
+	return net.HardwareAddr{0x52, 0x54, 0, network, byte(host >> 8), byte(host)}
+}
+
+// The lookups are of the last host, which is the slowest to find by port.
+const benchmarkHost = benchmarkHosts - 1
+
+func BenchmarkGetHost(b *testing.B) {
+	config := benchmarkConfig()
+	remoteID := fmt.Sprintf("sw%d", benchmarkHost/48)
+	port := fmt.Sprintf("Ethernet%d", benchmarkHost%48)
+	relayIP := net.IPv4(10, 1, 0, 1)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, ok := config.GetHost(remoteID, port, relayIP); !ok {
+			b.Fatal("host not found")
+		}
+	}
+}
+
+func BenchmarkGetHostByIP(b *testing.B) {
+	config := benchmarkConfig()
+	ip := benchmarkIP(1, benchmarkHost)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, ok := config.GetHostByIP(ip); !ok {
+			b.Fatal("host not found")
+		}
+	}
+}
+
+func BenchmarkGetHostByHostname(b *testing.B) {
+	config := benchmarkConfig()
+	hostname := fmt.Sprintf("node%d.example.com", benchmarkHost)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, ok := config.GetHostByHostname(hostname); !ok {
+			b.Fatal("host not found")
+		}
+	}
+}
+
+func BenchmarkGetHostByMAC(b *testing.B) {
+	config := benchmarkConfig()
+	mac := benchmarkMAC(1, benchmarkHost)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, ok := config.GetHostByMAC(mac); !ok {
+			b.Fatal("host not found")
+		}
+	}
+}
+
+func BenchmarkNewHostIndex(b *testing.B) {
+	hosts := benchmarkConfig().Hosts
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		newHostIndex(hosts)
+	}
+}
@@ -1,13 +1,11 @@
 package ipam
 
 import (
-	"encoding/json"
 	"fmt"
+	"log"
 	"net"
 	"os"
-	"strings"
-
-	"github.com/nik-johnson-net/rackdirector/pkg/dhcpd"
+	"sync"
 )
 
 type HostAddressInfo struct {
@@ -19,41 +17,23 @@ type HostAddressInfo struct {
 	DomainSearch string
 }
 
-type jsonIpamInterface struct {
-	Device      string
-	Port        string
-	Ipv4        string
-	Ipv4Gateway string `json:"ipv4_gateway"`
-}
-
-type jsonIpamBmc struct {
-	Hostname    string
-	Port        string
-	Ipv4        string
-	Ipv4Gateway string `json:"ipv4_gateway"`
-}
-
-type jsonIpamHost struct {
-	Hostname   string
-	Interfaces []jsonIpamInterface
-	Bmc        jsonIpamBmc
-}
-
-type jsonIpamConfig struct {
-	Hosts []jsonIpamHost
-}
-
 type BMC struct {
+	Type        string
+	BootMode    string
 	Hostname    string
+	RemoteID    string
 	Port        string
 	Ipv4        net.IP
 	Network     net.IPNet
 	Ipv4Gateway net.IP
+	MAC         net.HardwareAddr
 }
 
 type Interface struct {
 	Device      string
+	RemoteID    string
 	Port        string
+	MAC         net.HardwareAddr
 	Ipv4        net.IP
 	Network     net.IPNet
 	Ipv4Gateway net.IP
@@ -61,114 +41,124 @@ type Interface struct {
 
 type Host struct {
 	Hostname   string
+	Tags       []string
 	Interfaces []Interface
 	Bmc        BMC
 }
 
+// HasTag reports whether the host is tagged with tag.
+func (h Host) HasTag(tag string) bool {
+	for _, t := range h.Tags {
+		if t == tag {
+			return true
+		}
+	}
+	return false
+}
+
 type ipamConfig struct {
 	Hosts []Host
+	index hostIndex
 }
 
-func (i ipamConfig) GetHost(port string, relayIP net.IP) (Host, bool) {
-	for _, entry := range i.Hosts {
-		for _, interf := range entry.Interfaces {
-			if interf.Network.Contains(relayIP) && interf.Port == port {
-				return entry, true
+func (i ipamConfig) GetHost(remoteID string, port string, relayIP net.IP) (Host, bool) {
+	// Ports given with the relay's remote ID win over those given without
+	// one, which are on whichever switch relays the request.
+	for _, entryRemoteID := range []string{remoteID, ""} {
+		for _, entry := range i.index.byPort[port] {
+			if entry.remoteID == entryRemoteID && entry.network.Contains(relayIP) {
+				return i.Hosts[entry.host], true
 			}
 		}
-		if entry.Bmc.Network.Contains(relayIP) && entry.Bmc.Port == port {
-			return entry, true
-		}
 	}
 	return Host{}, false
 }
 
 func (i ipamConfig) GetHostByIP(ip net.IP) (Host, bool) {
-	for _, entry := range i.Hosts {
-		for _, interf := range entry.Interfaces {
-			if interf.Ipv4.Equal(ip) {
-				return entry, true
-			}
-		}
-		if entry.Bmc.Ipv4.Equal(ip) {
-			return entry, true
-		}
-	}
-	return Host{}, false
+	return i.lookup(i.index.byIP, string(ip.To16()))
 }
 
 func (i ipamConfig) GetHostByHostname(hostname string) (Host, bool) {
-	for _, entry := range i.Hosts {
-		if entry.Hostname == hostname {
-			return entry, true
-		}
-		if entry.Bmc.Hostname == hostname {
-			return entry, true
-		}
+	return i.lookup(i.index.byHostname, hostname)
+}
+
+func (i ipamConfig) GetHostByMAC(mac net.HardwareAddr) (Host, bool) {
+	return i.lookup(i.index.byMAC, string(mac))
+}
+
+func (i ipamConfig) lookup(index map[string]int, key string) (Host, bool) {
+	// Interfaces without a known address, MAC or hostname never match.
+	if key == "" {
+		return Host{}, false
 	}
-	return Host{}, false
+	host, ok := index[key]
+	if !ok {
+		return Host{}, false
+	}
+	return i.Hosts[host], true
 }
 
+// StaticIpam is a Store of the hosts in a JSON file.
 type StaticIpam struct {
-	config ipamConfig
+	hostDatabase
 }
 
+// NewFromFile loads the hosts in file, panicking if it can't.
 func NewFromFile(file string) *StaticIpam {
-	configFile, err := os.Open(file)
+	s, err := Load(file)
 	if err != nil {
 		panic(err)
 	}
-	defer configFile.Close()
-	decoder := json.NewDecoder(configFile)
+	return s
+}
 
-	var jsonConfig jsonIpamConfig
-	err = decoder.Decode(&jsonConfig)
+// Load reads the hosts in file.
+func Load(file string) (*StaticIpam, error) {
+	config, err := loadConfig(file)
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
+	s := &StaticIpam{}
+	s.replace(config)
+	return s, nil
+}
 
-	config := ipamConfig{
-		Hosts: make([]Host, 0),
+// Reload replaces the hosts with those in file, returning what changed. The
+// current hosts are kept if the file can't be loaded or isn't valid.
+func (s *StaticIpam) Reload(file string) (HostDiff, error) {
+	config, err := loadConfig(file)
+	if err != nil {
+		return HostDiff{}, err
 	}
-	for _, host := range jsonConfig.Hosts {
-		hostObj := Host{
-			Hostname:   host.Hostname,
-			Interfaces: make([]Interface, 0),
-		}
-		for _, interf := range host.Interfaces {
-			ip, network, err := net.ParseCIDR(interf.Ipv4)
-			if err != nil {
-				panic(err)
-			}
-			hostObj.Interfaces = append(hostObj.Interfaces, Interface{
-				Device:      interf.Device,
-				Port:        interf.Port,
-				Ipv4:        ip,
-				Network:     *network,
-				Ipv4Gateway: net.ParseIP(interf.Ipv4Gateway),
-			})
-		}
+	return s.replace(config), nil
+}
 
-		ip, network, err := net.ParseCIDR(host.Bmc.Ipv4)
-		if err != nil {
-			panic(err)
-		}
-		hostObj.Bmc = BMC{
-			Hostname:    host.Bmc.Hostname,
-			Port:        host.Bmc.Port,
-			Ipv4:        ip,
-			Network:     *network,
-			Ipv4Gateway: net.ParseIP(host.Bmc.Ipv4Gateway),
+func loadConfig(file string) (ipamConfig, error) {
+	records, err := readRecords(file)
+	if err != nil {
+		return ipamConfig{}, err
+	}
+	config, err := fromRecords(records)
+	if err != nil {
+		return ipamConfig{}, fmt.Errorf("%v: %w", file, err)
+	}
+	for _, problem := range Lint(records) {
+		if problem.Warning {
+			log.Printf("%v: %v\n", file, problem)
 		}
-
-		config.Hosts = append(config.Hosts, hostObj)
 	}
 
 	fmt.Fprintf(os.Stdout, "Build database %v\n", config)
+	return config, nil
+}
 
-	return &StaticIpam{
-		config: config,
+// validate lints the hosts, returning a *ValidationError if any has errors.
+func (i ipamConfig) validate() error {
+	records := make([]HostRecord, 0, len(i.Hosts))
+	for _, host := range i.Hosts {
+		records = append(records, host.Record())
 	}
+	return validationError(Lint(records))
 }
 
 func computeGateway(ip net.IPNet) net.IP {
@@ -177,52 +167,63 @@ func computeGateway(ip net.IPNet) net.IP {
 	return network
 }
 
-func getDomain(hostname string) string {
-	split := strings.SplitN(hostname, ".", 2)
-	return split[1]
-}
-
-func (s *StaticIpam) Handle(circuitID string, subscriberID string, macAddress net.HardwareAddr, gatewayIP net.IP) (dhcpd.DHCPResponse, error) {
-	if h, ok := s.config.GetHost(circuitID, gatewayIP); ok {
-		for _, interf := range h.Interfaces {
-			if interf.Port == circuitID {
-				return dhcpd.DHCPResponse{
-					IP:             interf.Ipv4,
-					Network:        interf.Network,
-					Gateway:        interf.Ipv4Gateway,
-					DNS:            []net.IP{net.ParseIP("1.1.1.1")},
-					Lease:          86400,
-					Hostname:       h.Hostname,
-					DomainSearch:   getDomain(h.Hostname),
-					TFTPServerName: "10.0.1.10",
-				}, nil
-			}
-		}
-		if h.Bmc.Port == circuitID {
-			return dhcpd.DHCPResponse{
-				IP:           h.Bmc.Ipv4,
-				Network:      h.Bmc.Network,
-				Gateway:      h.Bmc.Ipv4Gateway,
-				DNS:          []net.IP{net.ParseIP("1.1.1.1")},
-				Lease:        86400,
-				Hostname:     h.Hostname,
-				DomainSearch: getDomain(h.Hostname),
-			}, nil
-		}
+// hostDatabase implements Store over hosts which are replaced as a whole.
+type hostDatabase struct {
+	mu     sync.RWMutex
+	config ipamConfig
+}
+
+// replace indexes and swaps in config, returning what changed.
+func (d *hostDatabase) replace(config ipamConfig) HostDiff {
+	config.index = newHostIndex(config.Hosts)
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	diff := diffHosts(d.config.Hosts, config.Hosts)
+	d.config = config
+	return diff
+}
+
+func (d *hostDatabase) GetByPort(remoteID string, port string, relayIP net.IP) (Host, error) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	if h, ok := d.config.GetHost(remoteID, port, relayIP); ok {
+		return h, nil
 	}
-	return dhcpd.DHCPResponse{}, fmt.Errorf("not found")
+	return Host{}, ErrNotFound
 }
 
-func (s *StaticIpam) Get(peer net.IP) (Host, error) {
-	if h, ok := s.config.GetHostByIP(peer); ok {
+func (d *hostDatabase) Get(peer net.IP) (Host, error) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	if h, ok := d.config.GetHostByIP(peer); ok {
 		return h, nil
 	}
-	return Host{}, fmt.Errorf("not found")
+	return Host{}, ErrNotFound
 }
 
-func (s *StaticIpam) GetByHostname(hostname string) (Host, error) {
-	if h, ok := s.config.GetHostByHostname(hostname); ok {
+func (d *hostDatabase) GetByHostname(hostname string) (Host, error) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	if h, ok := d.config.GetHostByHostname(hostname); ok {
 		return h, nil
 	}
-	return Host{}, fmt.Errorf("not found")
+	return Host{}, ErrNotFound
+}
+
+func (d *hostDatabase) GetByMAC(mac net.HardwareAddr) (Host, error) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	if h, ok := d.config.GetHostByMAC(mac); ok {
+		return h, nil
+	}
+	return Host{}, ErrNotFound
+}
+
+// Hosts returns every host in the database.
+func (d *hostDatabase) Hosts() []Host {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	hosts := make([]Host, len(d.config.Hosts))
+	copy(hosts, d.config.Hosts)
+	return hosts
 }
@@ -0,0 +1,237 @@
+package ipam
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+// Problem is something wrong with a host, found by Lint. Path is where it is
+// in hosts.json, such as hosts[2].interfaces[0].ipv4. Hosts with errors are
+// refused; warnings are only reported.
+type Problem struct {
+	Path    string
+	Message string
+	Warning bool
+}
+
+func (p Problem) String() string {
+	if p.Warning {
+		return fmt.Sprintf("%v: warning: %v", p.Path, p.Message)
+	}
+	return fmt.Sprintf("%v: %v", p.Path, p.Message)
+}
+
+// ValidationError lists every error found in a set of hosts.
+type ValidationError struct {
+	Problems []Problem
+}
+
+func (e *ValidationError) Error() string {
+	problems := make([]string, 0, len(e.Problems))
+	for _, problem := range e.Problems {
+		problems = append(problems, problem.String())
+	}
+	return fmt.Sprintf("invalid hosts: %v", strings.Join(problems, "; "))
+}
+
+// validationError returns a *ValidationError of the errors in problems, or
+// nil if they are all warnings.
+func validationError(problems []Problem) error {
+	errors := make([]Problem, 0)
+	for _, problem := range problems {
+		if !problem.Warning {
+			errors = append(errors, problem)
+		}
+	}
+	if len(errors) == 0 {
+		return nil
+	}
+	return &ValidationError{Problems: errors}
+}
+
+// LintFile lints the hosts in a hosts.json file. An error is returned if
+// the file can't be read at all.
+func LintFile(file string) ([]Problem, error) {
+	records, err := readRecords(file)
+	if err != nil {
+		return nil, err
+	}
+	return Lint(records), nil
+}
+
+// linter collects the problems in a set of hosts.
+type linter struct {
+	problems []Problem
+	// owners maps each hostname, address, MAC and switch port to the path
+	// claiming it first.
+	owners map[string]string
+	// networks maps each network to the interface or BMC it was first
+	// given a gateway at, and that gateway.
+	networks map[string]linterNetwork
+	order    []string
+}
+
+type linterNetwork struct {
+	network net.IPNet
+	path    string
+	gateway string
+}
+
+// Lint checks the hosts for anything which would keep them from being looked
+// up or booted, returning every problem found:
+//
+//   - hostnames which are empty, lack a domain or are used twice
+//   - addresses, gateways and MACs which don't parse
+//   - addresses and MACs used twice, or gateways outside their network
+//   - switch ports used twice on the same network and switch, or remote
+//     IDs given without a port
+//   - networks which overlap without being the same, or which are given
+//     different gateways
+//   - hosts with no BMC, as a warning
+func Lint(records []HostRecord) []Problem {
+	l := &linter{
+		problems: make([]Problem, 0),
+		owners:   make(map[string]string),
+		networks: make(map[string]linterNetwork),
+	}
+	for i, record := range records {
+		l.host(fmt.Sprintf("hosts[%d]", i), record)
+	}
+	l.overlaps()
+	return l.problems
+}
+
+func (l *linter) errorf(path string, format string, args ...interface{}) {
+	l.problems = append(l.problems, Problem{Path: path, Message: fmt.Sprintf(format, args...)})
+}
+
+func (l *linter) warnf(path string, format string, args ...interface{}) {
+	l.problems = append(l.problems, Problem{Path: path, Message: fmt.Sprintf(format, args...), Warning: true})
+}
+
+// claim records path as using name, reporting it if another path already
+// does.
+func (l *linter) claim(path string, kind string, name string) {
+	key := kind + " " + name
+	if owner, taken := l.owners[key]; taken {
+		l.errorf(path, "%v %v is already used at %v", kind, name, owner)
+		return
+	}
+	l.owners[key] = path
+}
+
+func (l *linter) host(path string, record HostRecord) {
+	switch {
+	case record.Hostname == "":
+		l.errorf(path+".hostname", "hostname is empty")
+	case !strings.Contains(strings.Trim(record.Hostname, "."), "."):
+		l.errorf(path+".hostname", "hostname %v has no domain", record.Hostname)
+		l.claim(path+".hostname", "hostname", record.Hostname)
+	default:
+		l.claim(path+".hostname", "hostname", record.Hostname)
+	}
+
+	devices := make(map[string]bool)
+	for i, interf := range record.Interfaces {
+		interfPath := fmt.Sprintf("%v.interfaces[%d]", path, i)
+		if interf.Device != "" {
+			if devices[interf.Device] {
+				l.errorf(interfPath+".device", "device %v is already used by this host", interf.Device)
+			}
+			devices[interf.Device] = true
+		}
+		l.address(interfPath, interf.Ipv4, interf.Ipv4Gateway, interf.RemoteID, interf.Port)
+		l.mac(interfPath, interf.MAC)
+	}
+
+	if record.Bmc == (BMCRecord{}) {
+		l.warnf(path, "host has no bmc")
+		return
+	}
+	if record.Bmc.Hostname != "" {
+		l.claim(path+".bmc.hostname", "hostname", record.Bmc.Hostname)
+	}
+	l.address(path+".bmc", record.Bmc.Ipv4, record.Bmc.Ipv4Gateway, record.Bmc.RemoteID, record.Bmc.Port)
+	l.mac(path+".bmc", record.Bmc.MAC)
+}
+
+// mac checks the MAC of the interface or BMC at path, if it has one.
+func (l *linter) mac(path string, mac string) {
+	if mac == "" {
+		return
+	}
+	hardwareAddr, err := net.ParseMAC(mac)
+	if err != nil {
+		l.errorf(path+".mac", "%q is not a MAC address", mac)
+		return
+	}
+	l.claim(path+".mac", "MAC", hardwareAddr.String())
+}
+
+// address checks the address, gateway and switch port of the interface or
+// BMC at path.
+func (l *linter) address(path string, address string, gateway string, remoteID string, port string) {
+	if remoteID != "" && port == "" {
+		l.errorf(path+".remote_id", "remote ID %v is given without a port", remoteID)
+	}
+
+	ip, network, err := net.ParseCIDR(address)
+	if err != nil {
+		l.errorf(path+".ipv4", "%q is not an address in CIDR notation", address)
+	} else if ip.To4() == nil {
+		l.errorf(path+".ipv4", "%v is not an IPv4 address", address)
+		network = nil
+	} else {
+		l.claim(path+".ipv4", "address", ip.String())
+	}
+
+	if gateway != "" {
+		gatewayIP := net.ParseIP(gateway)
+		if gatewayIP == nil {
+			l.errorf(path+".ipv4_gateway", "%q is not an address", gateway)
+		} else if network != nil && !network.Contains(gatewayIP) {
+			l.errorf(path+".ipv4_gateway", "gateway %v is not in network %v", gateway, network)
+		}
+	}
+
+	if network == nil {
+		return
+	}
+	switch {
+	case remoteID != "" && port != "":
+		l.claim(path+".port", "switch port", fmt.Sprintf("%v of remote ID %v on network %v", port, remoteID, network))
+	case port != "":
+		l.claim(path+".port", "switch port", fmt.Sprintf("%v on network %v", port, network))
+	}
+
+	key := network.String()
+	seen, ok := l.networks[key]
+	if !ok {
+		l.order = append(l.order, key)
+	}
+	// The first gateway given for a network is the one others must match.
+	if !ok || seen.gateway == "" {
+		l.networks[key] = linterNetwork{network: *network, path: path, gateway: gateway}
+		return
+	}
+	gatewayIP, seenIP := net.ParseIP(gateway), net.ParseIP(seen.gateway)
+	if gatewayIP != nil && seenIP != nil && !gatewayIP.Equal(seenIP) {
+		l.errorf(path+".ipv4_gateway", "gateway %v of network %v differs from %v at %v.ipv4_gateway", gateway, network, seen.gateway, seen.path)
+	}
+}
+
+// overlaps reports networks which overlap without being the same, such as
+// a /23 and one of its /24s, since hosts on them would disagree about which
+// addresses are on link.
+func (l *linter) overlaps() {
+	for i, key := range l.order {
+		network := l.networks[key]
+		for _, earlierKey := range l.order[:i] {
+			earlier := l.networks[earlierKey]
+			if network.network.Contains(earlier.network.IP) || earlier.network.Contains(network.network.IP) {
+				l.errorf(network.path+".ipv4", "network %v overlaps network %v at %v.ipv4", key, earlierKey, earlier.path)
+			}
+		}
+	}
+}
@@ -0,0 +1,131 @@
+package ipam
+
+import (
+	"reflect"
+	"testing"
+)
+
+func lintRecord(hostname string, mac string, ipv4 string, port string) HostRecord {
+	return HostRecord{
+		Hostname: hostname,
+		Interfaces: []InterfaceRecord{{
+			Device:      "eth0",
+			Port:        port,
+			MAC:         mac,
+			Ipv4:        ipv4,
+			Ipv4Gateway: "10.0.0.254",
+		}},
+		Bmc: BMCRecord{
+			Type:     "ipmi",
+			Hostname: hostname + "-ipmi",
+			Ipv4:     "10.0.1" + ipv4[len("10.0.0"):],
+		},
+	}
+}
+
+func TestLint(t *testing.T) {
+	node1 := lintRecord("node1.example.com", "52:54:00:00:00:01", "10.0.0.1/24", "Ethernet1")
+	node2 := lintRecord("node2.example.com", "52:54:00:00:00:02", "10.0.0.2/24", "Ethernet2")
+
+	tests := []struct {
+		name   string
+		modify func(first, second *HostRecord)
+		want   []Problem
+	}{
+		{
+			name:   "valid",
+			modify: func(first, second *HostRecord) {},
+			want:   []Problem{},
+		},
+		{
+			name:   "duplicate MAC",
+			modify: func(first, second *HostRecord) { second.Interfaces[0].MAC = "52-54-00-00-00-01" },
+			want: []Problem{
+				{Path: "hosts[1].interfaces[0].mac", Message: "MAC 52:54:00:00:00:01 is already used at hosts[0].interfaces[0].mac"},
+			},
+		},
+		{
+			name:   "duplicate port",
+			modify: func(first, second *HostRecord) { second.Interfaces[0].Port = "Ethernet1" },
+			want: []Problem{
+				{Path: "hosts[1].interfaces[0].port", Message: "switch port Ethernet1 on network 10.0.0.0/24 is already used at hosts[0].interfaces[0].port"},
+			},
+		},
+		{
+			name: "duplicate port and remote ID",
+			modify: func(first, second *HostRecord) {
+				second.Interfaces[0].Port = "Ethernet1"
+				second.Interfaces[0].RemoteID = "sw1"
+				first.Interfaces[0].RemoteID = "sw1"
+			},
+			want: []Problem{
+				{Path: "hosts[1].interfaces[0].port", Message: "switch port Ethernet1 of remote ID sw1 on network 10.0.0.0/24 is already used at hosts[0].interfaces[0].port"},
+			},
+		},
+		{
+			name: "same port on different remote IDs",
+			modify: func(first, second *HostRecord) {
+				second.Interfaces[0].Port = "Ethernet1"
+				second.Interfaces[0].RemoteID = "sw2"
+				first.Interfaces[0].RemoteID = "sw1"
+			},
+			want: []Problem{},
+		},
+		{
+			name:   "remote ID without a port",
+			modify: func(first, second *HostRecord) { second.Interfaces[0].Port = ""; second.Interfaces[0].RemoteID = "sw1" },
+			want: []Problem{
+				{Path: "hosts[1].interfaces[0].remote_id", Message: "remote ID sw1 is given without a port"},
+			},
+		},
+		{
+			name: "gateway outside its network",
+			modify: func(first, second *HostRecord) {
+				second.Bmc.Ipv4Gateway = "10.0.0.254"
+			},
+			want: []Problem{
+				{Path: "hosts[1].bmc.ipv4_gateway", Message: "gateway 10.0.0.254 is not in network 10.0.1.0/24"},
+			},
+		},
+		{
+			name:   "hostname without a domain",
+			modify: func(first, second *HostRecord) { second.Hostname = "node2" },
+			want: []Problem{
+				{Path: "hosts[1].hostname", Message: "hostname node2 has no domain"},
+			},
+		},
+		{
+			name:   "empty hostname",
+			modify: func(first, second *HostRecord) { second.Hostname = "" },
+			want: []Problem{
+				{Path: "hosts[1].hostname", Message: "hostname is empty"},
+			},
+		},
+		{
+			name:   "duplicate hostname",
+			modify: func(first, second *HostRecord) { second.Bmc.Hostname = "node1.example.com" },
+			want: []Problem{
+				{Path: "hosts[1].bmc.hostname", Message: "hostname node1.example.com is already used at hosts[0].hostname"},
+			},
+		},
+		{
+			name:   "no BMC",
+			modify: func(first, second *HostRecord) { second.Bmc = BMCRecord{} },
+			want: []Problem{
+				{Path: "hosts[1]", Message: "host has no bmc", Warning: true},
+			},
+		},
+	}
+	for _, test := range tests {
+		first, second := node1, node2
+		// Copies of a record share its interfaces, so each test gets its own.
+		first.Interfaces = append([]InterfaceRecord(nil), node1.Interfaces...)
+		second.Interfaces = append([]InterfaceRecord(nil), node2.Interfaces...)
+		test.modify(&first, &second)
+
+		got := Lint([]HostRecord{first, second})
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%v: got problems %v, want %v", test.name, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,562 @@
+package ipam
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"text/template"
+	"time"
+)
+
+const (
+	// netboxPageSize is how many objects are asked for per request.
+	netboxPageSize = 1000
+	// netboxBatchSize is how many IDs are filtered on per request, which
+	// keeps URLs short.
+	netboxBatchSize = 100
+	// netboxTimeout bounds each request when no Client is given.
+	netboxTimeout = 30 * time.Second
+)
+
+// Custom fields on NetBox devices giving the BMC's type and boot mode.
+const (
+	netboxBMCType     = "bmc_type"
+	netboxBMCBootMode = "bmc_boot_mode"
+)
+
+// netboxGateway is the custom field on NetBox prefixes giving their IPv4
+// gateway. Networks without a prefix setting it are assumed to have their
+// gateway on their first address.
+const netboxGateway = "gateway"
+
+// SwitchPort is the switch port a host interface is cabled to, as given to
+// NetBox.CircuitID and NetBox.RemoteID.
+type SwitchPort struct {
+	// Device is the switch's name.
+	Device string
+	// Port is the switch interface's name.
+	Port string
+	// VLAN is the name of the port's untagged VLAN, if it has one.
+	VLAN string
+}
+
+// NetBox is a Store of the devices in NetBox. Each device is a host; its
+// interfaces with IPv4 addresses are the host's interfaces, and the
+// interface holding its out-of-band IP, or failing that its first
+// management-only interface, is its BMC. Hosts are fetched by Refresh and
+// kept until the next one, so lookups never wait on NetBox. Interfaces,
+// addresses and switch ports are fetched for many devices per request.
+// Gateways are the gateway custom field of the prefix of each network.
+type NetBox struct {
+	hostDatabase
+
+	// URL is where NetBox is, such as https://netbox.example.com.
+	URL string
+	// Token authenticates to the NetBox API.
+	Token string
+	// Filter selects the devices which are hosts, as query parameters to
+	// /api/dcim/devices/.
+	Filter url.Values
+	// CircuitID renders the DHCP circuit ID of an interface from the
+	// SwitchPort it is cabled to.
+	CircuitID *template.Template
+	// RemoteID renders the DHCP remote ID of the switch an interface is
+	// cabled to, if set, for switches whose circuit IDs are only port names.
+	RemoteID *template.Template
+	// Interval is how often Run refreshes the hosts.
+	Interval time.Duration
+	// Client makes requests to NetBox, with a 30 second timeout if nil.
+	Client *http.Client
+}
+
+type netboxPage struct {
+	Next    string
+	Results json.RawMessage
+}
+
+type netboxRef struct {
+	ID   int
+	Name string
+}
+
+// netboxTag is a device tag, which older NetBox versions give as its name
+// and newer ones as an object.
+type netboxTag string
+
+func (t *netboxTag) UnmarshalJSON(data []byte) error {
+	var name string
+	if err := json.Unmarshal(data, &name); err == nil {
+		*t = netboxTag(name)
+		return nil
+	}
+	var tag struct {
+		Slug string
+	}
+	if err := json.Unmarshal(data, &tag); err != nil {
+		return err
+	}
+	*t = netboxTag(tag.Slug)
+	return nil
+}
+
+type netboxDevice struct {
+	ID           int
+	Name         string
+	PrimaryIP4   *netboxIP `json:"primary_ip4"`
+	OOBIP        *netboxIP `json:"oob_ip"`
+	Tags         []netboxTag
+	CustomFields map[string]interface{} `json:"custom_fields"`
+}
+
+type netboxPrefix struct {
+	Prefix       string
+	CustomFields map[string]interface{} `json:"custom_fields"`
+}
+
+type netboxIP struct {
+	ID      int
+	Address string
+	DNSName string `json:"dns_name"`
+	// AssignedObjectType and AssignedObjectID say which interface the
+	// address is on, or Interface does before NetBox 2.9.
+	AssignedObjectType string `json:"assigned_object_type"`
+	AssignedObjectID   int    `json:"assigned_object_id"`
+	Interface          *netboxRef
+}
+
+func (i netboxIP) interfaceID() int {
+	if i.Interface != nil {
+		return i.Interface.ID
+	}
+	if i.AssignedObjectType == "dcim.interface" {
+		return i.AssignedObjectID
+	}
+	return 0
+}
+
+type netboxInterface struct {
+	ID           int
+	Name         string
+	MACAddress   string     `json:"mac_address"`
+	MgmtOnly     bool       `json:"mgmt_only"`
+	UntaggedVLAN *netboxRef `json:"untagged_vlan"`
+	Device       netboxRef
+	// The far end of the cable is connected_endpoints from NetBox 3.3, and
+	// connected_endpoint before it.
+	ConnectedEndpoints []netboxInterface `json:"connected_endpoints"`
+	ConnectedEndpoint  *netboxInterface  `json:"connected_endpoint"`
+}
+
+func (i netboxInterface) peer() *netboxInterface {
+	if len(i.ConnectedEndpoints) != 0 {
+		return &i.ConnectedEndpoints[0]
+	}
+	return i.ConnectedEndpoint
+}
+
+// Refresh fetches every host from NetBox, returning what changed. Devices
+// which can't be made into a valid host on their own, such as those without
+// a hostname with a domain, are logged and left out. The current hosts are
+// kept if NetBox can't be read, or if the rest of the hosts conflict with
+// each other.
+func (n *NetBox) Refresh() (HostDiff, error) {
+	config, problems, err := n.fetch()
+	if err != nil {
+		return HostDiff{}, err
+	}
+	config, skipped := withoutInvalidHosts(config)
+	for _, problem := range append(problems, skipped...) {
+		log.Printf("Skipping netbox %v\n", problem)
+	}
+	if err := config.validate(); err != nil {
+		return HostDiff{}, err
+	}
+	return n.replace(config), nil
+}
+
+// Lint fetches every host from NetBox and lints them, without changing the
+// current hosts. Paths are to the hosts in the order NetBox lists them,
+// leaving out devices which couldn't be made into hosts at all; those are
+// reported by device name.
+func (n *NetBox) Lint() ([]Problem, error) {
+	config, problems, err := n.fetch()
+	if err != nil {
+		return nil, err
+	}
+	records := make([]HostRecord, 0, len(config.Hosts))
+	for _, host := range config.Hosts {
+		records = append(records, host.Record())
+	}
+	return append(problems, Lint(records)...), nil
+}
+
+// withoutInvalidHosts leaves the hosts out of config which have errors of
+// their own, returning a problem for each. Errors between hosts, such as an
+// address used twice, are left for validate since there's no telling which
+// host is wrong.
+func withoutInvalidHosts(config ipamConfig) (ipamConfig, []Problem) {
+	valid := ipamConfig{Hosts: make([]Host, 0, len(config.Hosts))}
+	skipped := make([]Problem, 0)
+	for _, host := range config.Hosts {
+		errors := make([]string, 0)
+		for _, problem := range Lint([]HostRecord{host.Record()}) {
+			if !problem.Warning {
+				errors = append(errors, problem.Message)
+			}
+		}
+		if len(errors) != 0 {
+			skipped = append(skipped, Problem{
+				Path:    fmt.Sprintf("host %q", host.Hostname),
+				Message: strings.Join(errors, "; "),
+			})
+			continue
+		}
+		valid.Hosts = append(valid.Hosts, host)
+	}
+	return valid, skipped
+}
+
+// fetch returns a host for each device NetBox lists, and a problem for each
+// device which couldn't be made into one.
+func (n *NetBox) fetch() (ipamConfig, []Problem, error) {
+	devices := make([]netboxDevice, 0)
+	query := url.Values{}
+	for key, values := range n.Filter {
+		query[key] = values
+	}
+	if err := n.list("/api/dcim/devices/", query, &devices); err != nil {
+		return ipamConfig{}, nil, err
+	}
+
+	deviceIDs := make([]int, 0, len(devices))
+	for _, device := range devices {
+		deviceIDs = append(deviceIDs, device.ID)
+	}
+	interfaces := make([]netboxInterface, 0)
+	if err := n.listByID("/api/dcim/interfaces/", "device_id", deviceIDs, nil, &interfaces); err != nil {
+		return ipamConfig{}, nil, err
+	}
+	addresses := make([]netboxIP, 0)
+	family := url.Values{"family": {"4"}}
+	if err := n.listByID("/api/ipam/ip-addresses/", "device_id", deviceIDs, family, &addresses); err != nil {
+		return ipamConfig{}, nil, err
+	}
+
+	peerIDs := make([]int, 0)
+	seenPeers := make(map[int]bool)
+	interfacesOf := make(map[int][]netboxInterface)
+	for _, interf := range interfaces {
+		interfacesOf[interf.Device.ID] = append(interfacesOf[interf.Device.ID], interf)
+		if peer := interf.peer(); peer != nil && peer.ID != 0 && !seenPeers[peer.ID] {
+			seenPeers[peer.ID] = true
+			peerIDs = append(peerIDs, peer.ID)
+		}
+	}
+	addressOf := make(map[int]netboxIP)
+	for _, address := range addresses {
+		if _, taken := addressOf[address.interfaceID()]; !taken {
+			addressOf[address.interfaceID()] = address
+		}
+	}
+	peers := make([]netboxInterface, 0)
+	if err := n.listByID("/api/dcim/interfaces/", "id", peerIDs, nil, &peers); err != nil {
+		return ipamConfig{}, nil, err
+	}
+	switchPorts := make(map[int]netboxInterface, len(peers))
+	for _, peer := range peers {
+		switchPorts[peer.ID] = peer
+	}
+	gateways, err := n.gateways()
+	if err != nil {
+		return ipamConfig{}, nil, err
+	}
+
+	config := ipamConfig{
+		Hosts: make([]Host, 0, len(devices)),
+	}
+	problems := make([]Problem, 0)
+	for _, device := range devices {
+		host, err := n.host(device, interfacesOf[device.ID], addressOf, switchPorts, gateways)
+		if err != nil {
+			problems = append(problems, Problem{Path: fmt.Sprintf("device %q", device.Name), Message: err.Error()})
+			continue
+		}
+		config.Hosts = append(config.Hosts, host)
+	}
+	return config, problems, nil
+}
+
+// Run refreshes the hosts every Interval until ctx is done.
+func (n *NetBox) Run(ctx context.Context) {
+	ticker := time.NewTicker(n.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			diff, err := n.Refresh()
+			if err != nil {
+				log.Printf("Keeping current hosts: netbox: %v\n", err)
+			} else if !diff.Empty() {
+				log.Printf("Refreshed hosts from netbox: %v\n", diff)
+			}
+		}
+	}
+}
+
+// host builds the host for device from its interfaces, the addresses of
+// every interface and the switch ports they are cabled to, each keyed by
+// interface ID, and the gateways of networks.
+func (n *NetBox) host(device netboxDevice, interfaces []netboxInterface, addressOf map[int]netboxIP, switchPorts map[int]netboxInterface, gateways map[string]net.IP) (Host, error) {
+	host := Host{
+		Hostname:   device.Name,
+		Interfaces: make([]Interface, 0),
+	}
+	if device.PrimaryIP4 != nil && device.PrimaryIP4.DNSName != "" {
+		host.Hostname = device.PrimaryIP4.DNSName
+	}
+	for _, tag := range device.Tags {
+		host.Tags = append(host.Tags, string(tag))
+	}
+
+	bmcInterface := 0
+	for _, interf := range interfaces {
+		address, ok := addressOf[interf.ID]
+		if !ok {
+			continue
+		}
+		if device.OOBIP != nil && device.OOBIP.ID == address.ID {
+			bmcInterface = interf.ID
+			break
+		}
+		if interf.MgmtOnly && bmcInterface == 0 {
+			bmcInterface = interf.ID
+		}
+	}
+
+	for _, interf := range interfaces {
+		address, ok := addressOf[interf.ID]
+		if !ok {
+			continue
+		}
+		ip, network, err := net.ParseCIDR(address.Address)
+		if err != nil {
+			return Host{}, fmt.Errorf("interface %v: %v", interf.Name, err)
+		}
+		mac, err := parseMAC(interf.MACAddress)
+		if err != nil {
+			return Host{}, fmt.Errorf("interface %v: %v", interf.Name, err)
+		}
+		remoteID, port, err := n.relayIDs(interf, switchPorts)
+		if err != nil {
+			return Host{}, fmt.Errorf("interface %v: %v", interf.Name, err)
+		}
+
+		if interf.ID == bmcInterface {
+			host.Bmc = BMC{
+				Type:        customField(device.CustomFields, netboxBMCType),
+				BootMode:    customField(device.CustomFields, netboxBMCBootMode),
+				Hostname:    address.DNSName,
+				RemoteID:    remoteID,
+				Port:        port,
+				Ipv4:        ip,
+				Network:     *network,
+				Ipv4Gateway: gateway(gateways, *network),
+				MAC:         mac,
+			}
+			continue
+		}
+		host.Interfaces = append(host.Interfaces, Interface{
+			Device:      interf.Name,
+			RemoteID:    remoteID,
+			Port:        port,
+			MAC:         mac,
+			Ipv4:        ip,
+			Network:     *network,
+			Ipv4Gateway: gateway(gateways, *network),
+		})
+	}
+	return host, nil
+}
+
+// relayIDs renders the remote ID and circuit ID of the switch port interf
+// is cabled to, which are empty if it isn't cabled to a switch.
+func (n *NetBox) relayIDs(interf netboxInterface, switchPorts map[int]netboxInterface) (string, string, error) {
+	peer := interf.peer()
+	if peer == nil || peer.ID == 0 {
+		return "", "", nil
+	}
+	switchPort, ok := switchPorts[peer.ID]
+	if !ok {
+		return "", "", fmt.Errorf("switch port %v wasn't found", peer.ID)
+	}
+
+	port := SwitchPort{
+		Device: switchPort.Device.Name,
+		Port:   switchPort.Name,
+	}
+	if switchPort.UntaggedVLAN != nil {
+		port.VLAN = switchPort.UntaggedVLAN.Name
+	}
+	var remoteID, circuitID bytes.Buffer
+	if n.RemoteID != nil {
+		if err := n.RemoteID.Execute(&remoteID, port); err != nil {
+			return "", "", err
+		}
+	}
+	if err := n.CircuitID.Execute(&circuitID, port); err != nil {
+		return "", "", err
+	}
+	return remoteID.String(), circuitID.String(), nil
+}
+
+// gateways fetches the gateway of every IPv4 prefix which has one, keyed by
+// network.
+func (n *NetBox) gateways() (map[string]net.IP, error) {
+	prefixes := make([]netboxPrefix, 0)
+	if err := n.list("/api/ipam/prefixes/", url.Values{"family": {"4"}}, &prefixes); err != nil {
+		return nil, err
+	}
+	gateways := make(map[string]net.IP)
+	for _, prefix := range prefixes {
+		value := customField(prefix.CustomFields, netboxGateway)
+		if value == "" {
+			continue
+		}
+		_, network, err := net.ParseCIDR(prefix.Prefix)
+		if err != nil {
+			return nil, fmt.Errorf("prefix %v: %v", prefix.Prefix, err)
+		}
+		// NetBox IP fields are often given with a prefix length.
+		ip := net.ParseIP(strings.SplitN(value, "/", 2)[0])
+		if ip == nil || ip.To4() == nil {
+			return nil, fmt.Errorf("prefix %v: %v %q is not an IPv4 address", prefix.Prefix, netboxGateway, value)
+		}
+		gateways[network.String()] = ip.To4()
+	}
+	return gateways, nil
+}
+
+// gateway returns the gateway of network, which defaults to its first
+// address.
+func gateway(gateways map[string]net.IP, network net.IPNet) net.IP {
+	if ip, ok := gateways[network.String()]; ok {
+		return ip
+	}
+	return computeGateway(network)
+}
+
+func customField(fields map[string]interface{}, name string) string {
+	value, ok := fields[name].(string)
+	if !ok {
+		return ""
+	}
+	return value
+}
+
+func parseMAC(mac string) (net.HardwareAddr, error) {
+	if mac == "" {
+		return nil, nil
+	}
+	return net.ParseMAC(mac)
+}
+
+// listByID lists the objects at path matching any of ids on the filter key,
+// a batch of IDs per request, appending them all to results, which must
+// point to a slice.
+func (n *NetBox) listByID(path string, key string, ids []int, query url.Values, results interface{}) error {
+	all := make([]json.RawMessage, 0)
+	for start := 0; start < len(ids); start += netboxBatchSize {
+		end := start + netboxBatchSize
+		if end > len(ids) {
+			end = len(ids)
+		}
+		batch := url.Values{}
+		for k, values := range query {
+			batch[k] = values
+		}
+		for _, id := range ids[start:end] {
+			batch.Add(key, fmt.Sprint(id))
+		}
+		objects := make([]json.RawMessage, 0)
+		if err := n.list(path, batch, &objects); err != nil {
+			return err
+		}
+		all = append(all, objects...)
+	}
+
+	data, err := json.Marshal(all)
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(data, results); err != nil {
+		return fmt.Errorf("%v: %v", path, err)
+	}
+	return nil
+}
+
+// list fetches every page of objects at path into results, which must point
+// to a slice.
+func (n *NetBox) list(path string, query url.Values, results interface{}) error {
+	query.Set("limit", fmt.Sprint(netboxPageSize))
+	next := n.endpoint(path) + "?" + query.Encode()
+
+	all := make([]json.RawMessage, 0)
+	for next != "" {
+		var page netboxPage
+		if err := n.get(next, &page); err != nil {
+			return err
+		}
+		objects := make([]json.RawMessage, 0)
+		if err := json.Unmarshal(page.Results, &objects); err != nil {
+			return fmt.Errorf("%v: %v", path, err)
+		}
+		all = append(all, objects...)
+		next = page.Next
+	}
+
+	data, err := json.Marshal(all)
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(data, results); err != nil {
+		return fmt.Errorf("%v: %v", path, err)
+	}
+	return nil
+}
+
+func (n *NetBox) endpoint(path string) string {
+	return strings.TrimSuffix(n.URL, "/") + path
+}
+
+func (n *NetBox) get(address string, result interface{}) error {
+	request, err := http.NewRequest(http.MethodGet, address, nil)
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Accept", "application/json")
+	if n.Token != "" {
+		request.Header.Set("Authorization", "Token "+n.Token)
+	}
+
+	client := n.Client
+	if client == nil {
+		client = &http.Client{Timeout: netboxTimeout}
+	}
+	response, err := client.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET %v: %v", request.URL.Path, response.Status)
+	}
+	return json.NewDecoder(response.Body).Decode(result)
+}
@@ -0,0 +1,415 @@
+package ipam
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strconv"
+	"sync"
+	"testing"
+	"text/template"
+)
+
+type object map[string]interface{}
+
+// mockNetBox serves devices, interfaces, IP addresses and prefixes as the
+// NetBox API does, a few to a page whatever limit is asked for.
+type mockNetBox struct {
+	mu         sync.Mutex
+	pageSize   int
+	devices    []object
+	interfaces []object
+	addresses  []object
+	prefixes   []object
+	// requests counts the requests to each path.
+	requests map[string]int
+}
+
+func (m *mockNetBox) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if r.Header.Get("Authorization") != "Token secret" {
+		http.Error(w, "invalid token", http.StatusForbidden)
+		return
+	}
+	m.requests[r.URL.Path]++
+
+	query := r.URL.Query()
+	var objects []object
+	switch r.URL.Path {
+	case "/api/dcim/devices/":
+		objects = filter(m.devices, query, "role", func(o object) string { return o["role"].(string) })
+	case "/api/dcim/interfaces/":
+		objects = filter(m.interfaces, query, "id", func(o object) string { return fmt.Sprint(o["id"]) })
+		objects = filter(objects, query, "device_id", func(o object) string { return fmt.Sprint(o["device"].(object)["id"]) })
+	case "/api/ipam/ip-addresses/":
+		objects = filter(m.addresses, query, "device_id", func(o object) string { return fmt.Sprint(m.deviceOf(o)) })
+	case "/api/ipam/prefixes/":
+		objects = m.prefixes
+	default:
+		http.NotFound(w, r)
+		return
+	}
+
+	offset, _ := strconv.Atoi(query.Get("offset"))
+	end := offset + m.pageSize
+	if end > len(objects) {
+		end = len(objects)
+	}
+	page := object{"count": len(objects), "next": nil, "results": objects[offset:end]}
+	if end < len(objects) {
+		query.Set("offset", fmt.Sprint(end))
+		page["next"] = "http://" + r.Host + r.URL.Path + "?" + query.Encode()
+	}
+	json.NewEncoder(w).Encode(page)
+}
+
+// deviceOf returns the ID of the device holding address.
+func (m *mockNetBox) deviceOf(address object) int {
+	id, ok := address["assigned_object_id"]
+	if !ok {
+		id = address["interface"].(object)["id"]
+	}
+	for _, interf := range m.interfaces {
+		if interf["id"] == id {
+			return interf["device"].(object)["id"].(int)
+		}
+	}
+	return 0
+}
+
+// filter returns the objects whose key is any of the values of param in
+// query, or all of them if it has none.
+func filter(objects []object, query url.Values, param string, key func(object) string) []object {
+	values, ok := query[param]
+	if !ok {
+		return objects
+	}
+	filtered := make([]object, 0)
+	for _, o := range objects {
+		for _, value := range values {
+			if key(o) == value {
+				filtered = append(filtered, o)
+				break
+			}
+		}
+	}
+	return filtered
+}
+
+func newMockNetBox() *mockNetBox {
+	switchPort := func(id int, name string) object {
+		return object{
+			"id":            id,
+			"name":          name,
+			"device":        object{"id": 9, "name": "sw1"},
+			"untagged_vlan": object{"id": 1, "name": "provisioning"},
+		}
+	}
+	return &mockNetBox{
+		pageSize: 2,
+		requests: make(map[string]int),
+		devices: []object{
+			{
+				"id":            1,
+				"name":          "node1",
+				"role":          "server",
+				"primary_ip4":   object{"id": 11, "dns_name": "node1.example.com"},
+				"oob_ip":        object{"id": 12},
+				"tags":          []interface{}{object{"slug": "compute"}},
+				"custom_fields": object{"bmc_type": "ipmi", "bmc_boot_mode": "uefi"},
+			},
+			{
+				"id":   2,
+				"name": "node2.example.com",
+				"role": "server",
+				"tags": []interface{}{"compute"},
+			},
+			{
+				"id":   3,
+				"name": "node3.example.com",
+				"role": "server",
+			},
+			{
+				"id":   9,
+				"name": "sw1",
+				"role": "switch",
+			},
+		},
+		interfaces: []object{
+			{
+				"id":                  101,
+				"name":                "eth0",
+				"mac_address":         "52:54:00:00:01:01",
+				"device":              object{"id": 1, "name": "node1"},
+				"connected_endpoints": []interface{}{object{"id": 901}},
+			},
+			{
+				"id":                 102,
+				"name":               "ipmi",
+				"mac_address":        "52:54:00:00:01:02",
+				"device":             object{"id": 1, "name": "node1"},
+				"connected_endpoint": object{"id": 902},
+			},
+			{
+				"id":                  201,
+				"name":                "eth0",
+				"device":              object{"id": 2, "name": "node2.example.com"},
+				"connected_endpoints": []interface{}{object{"id": 903}},
+			},
+			{
+				"id":        202,
+				"name":      "mgmt",
+				"mgmt_only": true,
+				"device":    object{"id": 2, "name": "node2.example.com"},
+			},
+			{
+				"id":     203,
+				"name":   "eth1",
+				"device": object{"id": 2, "name": "node2.example.com"},
+			},
+			switchPort(901, "Ethernet1"),
+			switchPort(902, "Ethernet2"),
+			switchPort(903, "Ethernet3"),
+		},
+		addresses: []object{
+			{"id": 11, "address": "10.0.0.10/24", "dns_name": "node1.example.com", "assigned_object_type": "dcim.interface", "assigned_object_id": 101},
+			{"id": 12, "address": "10.0.1.10/24", "dns_name": "node1-ipmi.example.com", "assigned_object_type": "dcim.interface", "assigned_object_id": 102},
+			{"id": 21, "address": "10.0.0.11/24", "interface": object{"id": 201}},
+			{"id": 22, "address": "10.0.1.11/24", "interface": object{"id": 202}},
+		},
+		prefixes: []object{
+			{"prefix": "10.0.0.0/24", "custom_fields": object{"gateway": "10.0.0.254/24"}},
+			{"prefix": "10.0.1.0/24", "custom_fields": object{"gateway": nil}},
+		},
+	}
+}
+
+func newTestNetBox(t *testing.T, mock *mockNetBox) *NetBox {
+	server := httptest.NewServer(mock)
+	t.Cleanup(server.Close)
+	return &NetBox{
+		URL:       server.URL + "/",
+		Token:     "secret",
+		Filter:    url.Values{"role": {"server"}},
+		CircuitID: template.Must(template.New("circuit_id").Parse("{{.Device}}:{{.Port}}:{{.VLAN}}")),
+		Client:    server.Client(),
+	}
+}
+
+func hostRecords(hosts []Host) []HostRecord {
+	records := make([]HostRecord, 0, len(hosts))
+	for _, host := range hosts {
+		records = append(records, host.Record())
+	}
+	return records
+}
+
+func TestNetBoxRefresh(t *testing.T) {
+	mock := newMockNetBox()
+	n := newTestNetBox(t, mock)
+
+	diff, err := n.Refresh()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := HostDiff{Added: []string{"node1.example.com", "node2.example.com", "node3.example.com"}}
+	if !reflect.DeepEqual(diff, want) {
+		t.Errorf("diff is %+v, want %+v", diff, want)
+	}
+
+	hosts := []HostRecord{
+		{
+			Hostname: "node1.example.com",
+			Tags:     []string{"compute"},
+			Interfaces: []InterfaceRecord{
+				{Device: "eth0", Port: "sw1:Ethernet1:provisioning", MAC: "52:54:00:00:01:01", Ipv4: "10.0.0.10/24", Ipv4Gateway: "10.0.0.254"},
+			},
+			Bmc: BMCRecord{
+				Type:        "ipmi",
+				BootMode:    "uefi",
+				Hostname:    "node1-ipmi.example.com",
+				Port:        "sw1:Ethernet2:provisioning",
+				MAC:         "52:54:00:00:01:02",
+				Ipv4:        "10.0.1.10/24",
+				Ipv4Gateway: "10.0.1.1",
+			},
+		},
+		{
+			Hostname: "node2.example.com",
+			Tags:     []string{"compute"},
+			Interfaces: []InterfaceRecord{
+				{Device: "eth0", Port: "sw1:Ethernet3:provisioning", Ipv4: "10.0.0.11/24", Ipv4Gateway: "10.0.0.254"},
+			},
+			Bmc: BMCRecord{Ipv4: "10.0.1.11/24", Ipv4Gateway: "10.0.1.1"},
+		},
+		{
+			Hostname:   "node3.example.com",
+			Interfaces: []InterfaceRecord{},
+		},
+	}
+	if got := hostRecords(n.Hosts()); !reflect.DeepEqual(got, hosts) {
+		t.Errorf("hosts are\n%+v\nwant\n%+v", got, hosts)
+	}
+
+	// Three devices and eight interfaces need several pages each, but the
+	// interfaces and addresses of all the devices are asked for together.
+	requests := map[string]int{
+		"/api/dcim/devices/":      2,
+		"/api/dcim/interfaces/":   3 + 2,
+		"/api/ipam/ip-addresses/": 2,
+		"/api/ipam/prefixes/":     1,
+	}
+	if !reflect.DeepEqual(mock.requests, requests) {
+		t.Errorf("requests were %v, want %v", mock.requests, requests)
+	}
+
+	host, err := n.GetByPort("", "sw1:Ethernet2:provisioning", net.ParseIP("10.0.1.254"))
+	if err != nil || host.Hostname != "node1.example.com" {
+		t.Errorf("BMC port found %v, %v", host.Hostname, err)
+	}
+}
+
+func TestNetBoxRefreshDiff(t *testing.T) {
+	mock := newMockNetBox()
+	n := newTestNetBox(t, mock)
+	if _, err := n.Refresh(); err != nil {
+		t.Fatal(err)
+	}
+
+	diff, err := n.Refresh()
+	if err != nil || !diff.Empty() {
+		t.Errorf("unchanged refresh gave %v, %v", diff, err)
+	}
+
+	mock.mu.Lock()
+	mock.devices[0]["role"] = "retired"
+	mock.addresses[2]["address"] = "10.0.0.12/24"
+	mock.devices = append(mock.devices, object{"id": 4, "name": "node4.example.com", "role": "server"})
+	mock.mu.Unlock()
+
+	diff, err = n.Refresh()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := HostDiff{
+		Added:   []string{"node4.example.com"},
+		Removed: []string{"node1.example.com"},
+		Changed: []string{"node2.example.com"},
+	}
+	if !reflect.DeepEqual(diff, want) {
+		t.Errorf("diff is %+v, want %+v", diff, want)
+	}
+	if _, err := n.GetByHostname("node1.example.com"); err != ErrNotFound {
+		t.Errorf("removed host found: %v", err)
+	}
+}
+
+func TestNetBoxRefreshKeepsHosts(t *testing.T) {
+	mock := newMockNetBox()
+	n := newTestNetBox(t, mock)
+	if _, err := n.Refresh(); err != nil {
+		t.Fatal(err)
+	}
+	before := n.Hosts()
+
+	n.Token = "wrong"
+	if _, err := n.Refresh(); err == nil {
+		t.Error("refresh with a bad token succeeded")
+	}
+
+	n.Token = "secret"
+	mock.mu.Lock()
+	mock.addresses[3]["address"] = "10.0.0.10/24"
+	mock.mu.Unlock()
+	if _, err := n.Refresh(); err == nil {
+		t.Error("refresh with a duplicate address succeeded")
+	} else if _, ok := err.(*ValidationError); !ok {
+		t.Errorf("duplicate address gave %v, want a *ValidationError", err)
+	}
+
+	if !reflect.DeepEqual(n.Hosts(), before) {
+		t.Error("failed refreshes changed the hosts")
+	}
+}
+
+// TestNetBoxRefreshSkipsDevices checks devices which can't be made into
+// valid hosts are left out, and reported by Lint, without holding up the
+// rest.
+func TestNetBoxRefreshSkipsDevices(t *testing.T) {
+	mock := newMockNetBox()
+	mock.devices[2]["name"] = "node3"
+	mock.devices = append(mock.devices, object{"id": 5, "name": "node5.example.com", "role": "server"})
+	mock.interfaces = append(mock.interfaces, object{"id": 501, "name": "eth0", "mac_address": "52:54:00", "device": object{"id": 5}})
+	mock.addresses = append(mock.addresses, object{"id": 51, "address": "10.0.0.15/24", "assigned_object_type": "dcim.interface", "assigned_object_id": 501})
+	n := newTestNetBox(t, mock)
+
+	diff, err := n.Refresh()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"node1.example.com", "node2.example.com"}; !reflect.DeepEqual(diff.Added, want) {
+		t.Errorf("added %v, want %v", diff.Added, want)
+	}
+	for _, hostname := range []string{"node3", "node5.example.com"} {
+		if _, err := n.GetByHostname(hostname); err != ErrNotFound {
+			t.Errorf("invalid host %v found: %v", hostname, err)
+		}
+	}
+
+	problems, err := n.Lint()
+	if err != nil {
+		t.Fatal(err)
+	}
+	paths := make([]string, 0)
+	for _, problem := range problems {
+		if !problem.Warning {
+			paths = append(paths, problem.Path)
+		}
+	}
+	if want := []string{`device "node5.example.com"`, "hosts[2].hostname"}; !reflect.DeepEqual(paths, want) {
+		t.Errorf("lint found errors at %v, want %v", paths, want)
+	}
+}
+
+// TestNetBoxBatches checks interfaces and addresses are asked for a batch of
+// devices at a time.
+func TestNetBoxBatches(t *testing.T) {
+	const devices = 2*netboxBatchSize + 1
+	mock := &mockNetBox{
+		pageSize: netboxPageSize,
+		requests: make(map[string]int),
+	}
+	for i := 1; i <= devices; i++ {
+		mock.devices = append(mock.devices, object{"id": i, "name": fmt.Sprintf("node%d.example.com", i), "role": "server"})
+		mock.interfaces = append(mock.interfaces, object{"id": 1000 + i, "name": "eth0", "device": object{"id": i}})
+		mock.addresses = append(mock.addresses, object{
+			"id":                   i,
+			"address":              fmt.Sprintf("10.0.%d.%d/16", i/256, i%256),
+			"assigned_object_type": "dcim.interface",
+			"assigned_object_id":   1000 + i,
+		})
+	}
+	n := newTestNetBox(t, mock)
+
+	diff, err := n.Refresh()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(diff.Added) != devices {
+		t.Errorf("%d hosts added, want %d", len(diff.Added), devices)
+	}
+	requests := map[string]int{
+		"/api/dcim/devices/":      1,
+		"/api/dcim/interfaces/":   3,
+		"/api/ipam/ip-addresses/": 3,
+		"/api/ipam/prefixes/":     1,
+	}
+	if !reflect.DeepEqual(mock.requests, requests) {
+		t.Errorf("requests were %v, want %v", mock.requests, requests)
+	}
+}
@@ -0,0 +1,200 @@
+package ipam
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+)
+
+// InterfaceRecord is an interface as written in hosts.json and the hosts
+// API. Ipv4 is in CIDR notation. MAC is optional, and only needed on networks
+// which match hosts by MAC. RemoteID is optional too: it is the relay
+// agent remote ID of the switch Port is on, for switches whose circuit IDs
+// are only port names and so are the same on every switch.
+type InterfaceRecord struct {
+	Device      string
+	RemoteID    string `json:"remote_id,omitempty"`
+	Port        string
+	MAC         string `json:"mac,omitempty"`
+	Ipv4        string
+	Ipv4Gateway string `json:"ipv4_gateway"`
+}
+
+// BMCRecord is a BMC as written in hosts.json and the hosts API. Ipv4 is in
+// CIDR notation, and MAC and RemoteID are optional as for interfaces.
+type BMCRecord struct {
+	Type        string
+	BootMode    string `json:"boot_mode"`
+	Hostname    string
+	RemoteID    string `json:"remote_id,omitempty"`
+	Port        string
+	MAC         string `json:"mac,omitempty"`
+	Ipv4        string
+	Ipv4Gateway string `json:"ipv4_gateway"`
+}
+
+// HostRecord is a host as written in hosts.json and the hosts API. A host
+// without a BMC has an empty Bmc.
+type HostRecord struct {
+	Hostname   string
+	Tags       []string
+	Interfaces []InterfaceRecord
+	Bmc        BMCRecord
+}
+
+type hostsFile struct {
+	Hosts []HostRecord
+}
+
+func readRecords(file string) ([]HostRecord, error) {
+	configFile, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer configFile.Close()
+
+	var hosts hostsFile
+	if err := json.NewDecoder(configFile).Decode(&hosts); err != nil {
+		return nil, fmt.Errorf("%v: %v", file, err)
+	}
+	return hosts.Hosts, nil
+}
+
+// fromRecords lints and builds the hosts in records, returning a
+// *ValidationError listing every error found.
+func fromRecords(records []HostRecord) (ipamConfig, error) {
+	if err := validationError(Lint(records)); err != nil {
+		return ipamConfig{}, err
+	}
+	config := ipamConfig{
+		Hosts: make([]Host, 0, len(records)),
+	}
+	for _, record := range records {
+		host, err := record.host()
+		if err != nil {
+			return ipamConfig{}, err
+		}
+		config.Hosts = append(config.Hosts, host)
+	}
+	return config, nil
+}
+
+func (r InterfaceRecord) iface() (Interface, error) {
+	ip, network, err := net.ParseCIDR(r.Ipv4)
+	if err != nil {
+		return Interface{}, err
+	}
+	mac, err := parseMAC(r.MAC)
+	if err != nil {
+		return Interface{}, err
+	}
+	return Interface{
+		Device:      r.Device,
+		RemoteID:    r.RemoteID,
+		Port:        r.Port,
+		MAC:         mac,
+		Ipv4:        ip,
+		Network:     *network,
+		Ipv4Gateway: net.ParseIP(r.Ipv4Gateway),
+	}, nil
+}
+
+func (r BMCRecord) bmc() (BMC, error) {
+	if r == (BMCRecord{}) {
+		return BMC{}, nil
+	}
+	ip, network, err := net.ParseCIDR(r.Ipv4)
+	if err != nil {
+		return BMC{}, err
+	}
+	mac, err := parseMAC(r.MAC)
+	if err != nil {
+		return BMC{}, err
+	}
+	return BMC{
+		Type:        r.Type,
+		BootMode:    r.BootMode,
+		Hostname:    r.Hostname,
+		RemoteID:    r.RemoteID,
+		Port:        r.Port,
+		MAC:         mac,
+		Ipv4:        ip,
+		Network:     *network,
+		Ipv4Gateway: net.ParseIP(r.Ipv4Gateway),
+	}, nil
+}
+
+func (r HostRecord) host() (Host, error) {
+	host := Host{
+		Hostname:   r.Hostname,
+		Tags:       r.Tags,
+		Interfaces: make([]Interface, 0),
+	}
+	for _, record := range r.Interfaces {
+		interf, err := record.iface()
+		if err != nil {
+			return Host{}, fmt.Errorf("host %v: %v", r.Hostname, err)
+		}
+		host.Interfaces = append(host.Interfaces, interf)
+	}
+	bmc, err := r.Bmc.bmc()
+	if err != nil {
+		return Host{}, fmt.Errorf("host %v bmc: %v", r.Hostname, err)
+	}
+	host.Bmc = bmc
+	return host, nil
+}
+
+func cidr(ip net.IP, network net.IPNet) string {
+	if ip == nil {
+		return ""
+	}
+	return (&net.IPNet{IP: ip, Mask: network.Mask}).String()
+}
+
+func ipString(ip net.IP) string {
+	if ip == nil {
+		return ""
+	}
+	return ip.String()
+}
+
+func macString(mac net.HardwareAddr) string {
+	if mac == nil {
+		return ""
+	}
+	return mac.String()
+}
+
+// Record returns the host as written in hosts.json and the hosts API.
+func (h Host) Record() HostRecord {
+	record := HostRecord{
+		Hostname:   h.Hostname,
+		Tags:       h.Tags,
+		Interfaces: make([]InterfaceRecord, 0, len(h.Interfaces)),
+	}
+	for _, interf := range h.Interfaces {
+		record.Interfaces = append(record.Interfaces, InterfaceRecord{
+			Device:      interf.Device,
+			RemoteID:    interf.RemoteID,
+			Port:        interf.Port,
+			MAC:         macString(interf.MAC),
+			Ipv4:        cidr(interf.Ipv4, interf.Network),
+			Ipv4Gateway: ipString(interf.Ipv4Gateway),
+		})
+	}
+	if h.Bmc.Ipv4 != nil {
+		record.Bmc = BMCRecord{
+			Type:        h.Bmc.Type,
+			BootMode:    h.Bmc.BootMode,
+			Hostname:    h.Bmc.Hostname,
+			RemoteID:    h.Bmc.RemoteID,
+			Port:        h.Bmc.Port,
+			MAC:         macString(h.Bmc.MAC),
+			Ipv4:        cidr(h.Bmc.Ipv4, h.Bmc.Network),
+			Ipv4Gateway: ipString(h.Bmc.Ipv4Gateway),
+		}
+	}
+	return record
+}
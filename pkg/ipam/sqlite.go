@@ -0,0 +1,429 @@
+package ipam
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"sync"
+
+	// Registers the sqlite3 database/sql driver.
+	_ "github.com/mattn/go-sqlite3"
+)
+
+const sqliteSchema = `
+CREATE TABLE IF NOT EXISTS hosts (
+	hostname TEXT PRIMARY KEY,
+	tags TEXT NOT NULL DEFAULT '[]'
+);
+CREATE TABLE IF NOT EXISTS interfaces (
+	hostname TEXT NOT NULL REFERENCES hosts (hostname) ON UPDATE CASCADE ON DELETE CASCADE,
+	device TEXT NOT NULL,
+	port TEXT NOT NULL,
+	ipv4 TEXT NOT NULL,
+	ipv4_gateway TEXT NOT NULL,
+	PRIMARY KEY (hostname, device)
+);
+CREATE TABLE IF NOT EXISTS bmcs (
+	hostname TEXT PRIMARY KEY REFERENCES hosts (hostname) ON UPDATE CASCADE ON DELETE CASCADE,
+	type TEXT NOT NULL,
+	boot_mode TEXT NOT NULL,
+	bmc_hostname TEXT NOT NULL,
+	port TEXT NOT NULL,
+	ipv4 TEXT NOT NULL,
+	ipv4_gateway TEXT NOT NULL
+);
+`
+
+// sqliteMigrations upgrade databases created with an older schema, in
+// order. The database's user_version is how many have been applied.
+var sqliteMigrations = []string{
+	`ALTER TABLE interfaces ADD COLUMN mac TEXT NOT NULL DEFAULT '';
+	ALTER TABLE bmcs ADD COLUMN mac TEXT NOT NULL DEFAULT '';`,
+	`ALTER TABLE interfaces ADD COLUMN remote_id TEXT NOT NULL DEFAULT '';
+	ALTER TABLE bmcs ADD COLUMN remote_id TEXT NOT NULL DEFAULT '';`,
+}
+
+// SQLite is an Editor keeping hosts in a SQLite database. Lookups are served
+// from memory, which is reloaded after every change.
+type SQLite struct {
+	hostDatabase
+
+	db *sql.DB
+	// writeLock keeps changes from committing out of order with the hosts
+	// in memory.
+	writeLock sync.Mutex
+}
+
+// OpenSQLite opens the database at path, creating it if it doesn't exist.
+func OpenSQLite(path string) (*SQLite, error) {
+	db, err := sql.Open("sqlite3", path+"?_foreign_keys=1")
+	if err != nil {
+		return nil, err
+	}
+	// Foreign keys are enabled per connection, and one connection is plenty.
+	db.SetMaxOpenConns(1)
+	if _, err := db.Exec(sqliteSchema); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("%v: %v", path, err)
+	}
+	if err := migrateSQLite(db); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("%v: %v", path, err)
+	}
+
+	s := &SQLite{db: db}
+	if _, err := s.Refresh(); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("%v: %w", path, err)
+	}
+	return s, nil
+}
+
+// migrateSQLite applies the migrations the database hasn't had yet.
+func migrateSQLite(db *sql.DB) error {
+	var version int
+	if err := db.QueryRow(`PRAGMA user_version`).Scan(&version); err != nil {
+		return err
+	}
+	for ; version < len(sqliteMigrations); version++ {
+		tx, err := db.Begin()
+		if err != nil {
+			return err
+		}
+		if _, err := tx.Exec(sqliteMigrations[version]); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("migration %d: %v", version+1, err)
+		}
+		if _, err := tx.Exec(fmt.Sprintf(`PRAGMA user_version = %d`, version+1)); err != nil {
+			tx.Rollback()
+			return err
+		}
+		if err := tx.Commit(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// LintSQLite lints the hosts in the database at path.
+func LintSQLite(path string) ([]Problem, error) {
+	db, err := sql.Open("sqlite3", "file:"+path+"?mode=ro")
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+	records, err := readSQLite(db)
+	if err != nil {
+		return nil, fmt.Errorf("%v: %v", path, err)
+	}
+	return Lint(records), nil
+}
+
+// Close closes the database.
+func (s *SQLite) Close() error {
+	return s.db.Close()
+}
+
+// Refresh reloads the hosts from the database, returning what changed.
+func (s *SQLite) Refresh() (HostDiff, error) {
+	s.writeLock.Lock()
+	defer s.writeLock.Unlock()
+	records, err := readSQLite(s.db)
+	if err != nil {
+		return HostDiff{}, err
+	}
+	config, err := fromRecords(records)
+	if err != nil {
+		return HostDiff{}, err
+	}
+	return s.replace(config), nil
+}
+
+// Import adds the hosts in a hosts.json file. Either all are added or,
+// if any is already in the database or they'd be invalid, none are.
+func (s *SQLite) Import(file string) (HostDiff, error) {
+	records, err := readRecords(file)
+	if err != nil {
+		return HostDiff{}, err
+	}
+	return s.edit(func(tx *sql.Tx) error {
+		for _, record := range records {
+			if err := insertHost(tx, record); err != nil {
+				return fmt.Errorf("host %v: %v", record.Hostname, err)
+			}
+		}
+		return nil
+	})
+}
+
+func (s *SQLite) CreateHost(record HostRecord) error {
+	_, err := s.edit(func(tx *sql.Tx) error {
+		return insertHost(tx, record)
+	})
+	return err
+}
+
+func (s *SQLite) UpdateHost(hostname string, record HostRecord) error {
+	_, err := s.edit(func(tx *sql.Tx) error {
+		if err := hostExists(tx, hostname); err != nil {
+			return err
+		}
+		if record.Hostname != hostname {
+			if err := hostExists(tx, record.Hostname); err == nil {
+				return ErrExists
+			}
+		}
+
+		tags, err := json.Marshal(record.Tags)
+		if err != nil {
+			return err
+		}
+		if _, err := tx.Exec(`UPDATE hosts SET hostname = ?, tags = ? WHERE hostname = ?`, record.Hostname, string(tags), hostname); err != nil {
+			return err
+		}
+		if _, err := tx.Exec(`DELETE FROM interfaces WHERE hostname = ?`, record.Hostname); err != nil {
+			return err
+		}
+		if _, err := tx.Exec(`DELETE FROM bmcs WHERE hostname = ?`, record.Hostname); err != nil {
+			return err
+		}
+		return insertChildren(tx, record)
+	})
+	return err
+}
+
+func (s *SQLite) DeleteHost(hostname string) error {
+	_, err := s.edit(func(tx *sql.Tx) error {
+		return execOne(tx, `DELETE FROM hosts WHERE hostname = ?`, hostname)
+	})
+	return err
+}
+
+func (s *SQLite) AddInterface(hostname string, record InterfaceRecord) error {
+	_, err := s.edit(func(tx *sql.Tx) error {
+		if err := hostExists(tx, hostname); err != nil {
+			return err
+		}
+		return insertInterface(tx, hostname, record)
+	})
+	return err
+}
+
+func (s *SQLite) UpdateInterface(hostname string, device string, record InterfaceRecord) error {
+	_, err := s.edit(func(tx *sql.Tx) error {
+		if record.Device != device {
+			var taken int
+			err := tx.QueryRow(`SELECT COUNT(*) FROM interfaces WHERE hostname = ? AND device = ?`, hostname, record.Device).Scan(&taken)
+			if err != nil {
+				return err
+			}
+			if taken != 0 {
+				return ErrExists
+			}
+		}
+		return execOne(tx, `UPDATE interfaces SET device = ?, remote_id = ?, port = ?, mac = ?, ipv4 = ?, ipv4_gateway = ? WHERE hostname = ? AND device = ?`,
+			record.Device, record.RemoteID, record.Port, record.MAC, record.Ipv4, record.Ipv4Gateway, hostname, device)
+	})
+	return err
+}
+
+func (s *SQLite) DeleteInterface(hostname string, device string) error {
+	_, err := s.edit(func(tx *sql.Tx) error {
+		return execOne(tx, `DELETE FROM interfaces WHERE hostname = ? AND device = ?`, hostname, device)
+	})
+	return err
+}
+
+func (s *SQLite) SetBMC(hostname string, record BMCRecord) error {
+	_, err := s.edit(func(tx *sql.Tx) error {
+		if err := hostExists(tx, hostname); err != nil {
+			return err
+		}
+		if _, err := tx.Exec(`DELETE FROM bmcs WHERE hostname = ?`, hostname); err != nil {
+			return err
+		}
+		return insertBMC(tx, hostname, record)
+	})
+	return err
+}
+
+func (s *SQLite) DeleteBMC(hostname string) error {
+	_, err := s.edit(func(tx *sql.Tx) error {
+		return execOne(tx, `DELETE FROM bmcs WHERE hostname = ?`, hostname)
+	})
+	return err
+}
+
+// edit makes a change in a transaction, which is only committed if every
+// host is still valid afterwards.
+func (s *SQLite) edit(change func(tx *sql.Tx) error) (HostDiff, error) {
+	s.writeLock.Lock()
+	defer s.writeLock.Unlock()
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return HostDiff{}, err
+	}
+	defer tx.Rollback()
+
+	if err := change(tx); err != nil {
+		return HostDiff{}, err
+	}
+	records, err := readSQLite(tx)
+	if err != nil {
+		return HostDiff{}, err
+	}
+	config, err := fromRecords(records)
+	if err != nil {
+		return HostDiff{}, err
+	}
+	if err := tx.Commit(); err != nil {
+		return HostDiff{}, err
+	}
+
+	diff := s.replace(config)
+	log.Printf("Changed hosts: %v\n", diff)
+	return diff, nil
+}
+
+// querier is a *sql.DB or *sql.Tx.
+type querier interface {
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+func hostExists(q querier, hostname string) error {
+	var found string
+	err := q.QueryRow(`SELECT hostname FROM hosts WHERE hostname = ?`, hostname).Scan(&found)
+	if err == sql.ErrNoRows {
+		return ErrNotFound
+	}
+	return err
+}
+
+// execOne runs a statement which must affect one row, or the thing it
+// changes wasn't found.
+func execOne(tx *sql.Tx, query string, args ...interface{}) error {
+	result, err := tx.Exec(query, args...)
+	if err != nil {
+		return err
+	}
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if affected == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func insertHost(tx *sql.Tx, record HostRecord) error {
+	if err := hostExists(tx, record.Hostname); err == nil {
+		return ErrExists
+	} else if err != ErrNotFound {
+		return err
+	}
+	tags, err := json.Marshal(record.Tags)
+	if err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`INSERT INTO hosts (hostname, tags) VALUES (?, ?)`, record.Hostname, string(tags)); err != nil {
+		return err
+	}
+	return insertChildren(tx, record)
+}
+
+func insertChildren(tx *sql.Tx, record HostRecord) error {
+	for _, interf := range record.Interfaces {
+		if err := insertInterface(tx, record.Hostname, interf); err != nil {
+			return err
+		}
+	}
+	if record.Bmc == (BMCRecord{}) {
+		return nil
+	}
+	return insertBMC(tx, record.Hostname, record.Bmc)
+}
+
+func insertInterface(tx *sql.Tx, hostname string, record InterfaceRecord) error {
+	var taken int
+	err := tx.QueryRow(`SELECT COUNT(*) FROM interfaces WHERE hostname = ? AND device = ?`, hostname, record.Device).Scan(&taken)
+	if err != nil {
+		return err
+	}
+	if taken != 0 {
+		return ErrExists
+	}
+	_, err = tx.Exec(`INSERT INTO interfaces (hostname, device, remote_id, port, mac, ipv4, ipv4_gateway) VALUES (?, ?, ?, ?, ?, ?, ?)`,
+		hostname, record.Device, record.RemoteID, record.Port, record.MAC, record.Ipv4, record.Ipv4Gateway)
+	return err
+}
+
+func insertBMC(tx *sql.Tx, hostname string, record BMCRecord) error {
+	_, err := tx.Exec(`INSERT INTO bmcs (hostname, type, boot_mode, bmc_hostname, remote_id, port, mac, ipv4, ipv4_gateway) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		hostname, record.Type, record.BootMode, record.Hostname, record.RemoteID, record.Port, record.MAC, record.Ipv4, record.Ipv4Gateway)
+	return err
+}
+
+// readSQLite reads every host, in the order they were added.
+func readSQLite(q querier) ([]HostRecord, error) {
+	records := make([]HostRecord, 0)
+	index := make(map[string]int)
+
+	rows, err := q.Query(`SELECT hostname, tags FROM hosts ORDER BY rowid`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var record HostRecord
+		var tags string
+		if err := rows.Scan(&record.Hostname, &tags); err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal([]byte(tags), &record.Tags); err != nil {
+			return nil, fmt.Errorf("host %v tags: %v", record.Hostname, err)
+		}
+		record.Interfaces = make([]InterfaceRecord, 0)
+		index[record.Hostname] = len(records)
+		records = append(records, record)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	interfaces, err := q.Query(`SELECT hostname, device, remote_id, port, mac, ipv4, ipv4_gateway FROM interfaces ORDER BY rowid`)
+	if err != nil {
+		return nil, err
+	}
+	defer interfaces.Close()
+	for interfaces.Next() {
+		var hostname string
+		var interf InterfaceRecord
+		if err := interfaces.Scan(&hostname, &interf.Device, &interf.RemoteID, &interf.Port, &interf.MAC, &interf.Ipv4, &interf.Ipv4Gateway); err != nil {
+			return nil, err
+		}
+		record := &records[index[hostname]]
+		record.Interfaces = append(record.Interfaces, interf)
+	}
+	if err := interfaces.Err(); err != nil {
+		return nil, err
+	}
+
+	bmcs, err := q.Query(`SELECT hostname, type, boot_mode, bmc_hostname, remote_id, port, mac, ipv4, ipv4_gateway FROM bmcs`)
+	if err != nil {
+		return nil, err
+	}
+	defer bmcs.Close()
+	for bmcs.Next() {
+		var hostname string
+		var bmc BMCRecord
+		if err := bmcs.Scan(&hostname, &bmc.Type, &bmc.BootMode, &bmc.Hostname, &bmc.RemoteID, &bmc.Port, &bmc.MAC, &bmc.Ipv4, &bmc.Ipv4Gateway); err != nil {
+			return nil, err
+		}
+		records[index[hostname]].Bmc = bmc
+	}
+	return records, bmcs.Err()
+}
@@ -0,0 +1,200 @@
+//go:build cgo
+// +build cgo
+
+// The sqlite3 driver is a cgo package, so these tests only build with cgo
+// enabled; without it opening a database fails at run time.
+
+package ipam
+
+import (
+	"database/sql"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// testDBPath returns the path of a database file in a temporary directory.
+func testDBPath(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "sqlite")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	return filepath.Join(dir, "hosts.db")
+}
+
+// openTestSQLite opens a new database in a temporary directory, returning
+// it and its path.
+func openTestSQLite(t *testing.T) (*SQLite, string) {
+	path := testDBPath(t)
+	s, err := OpenSQLite(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Close() })
+	return s, path
+}
+
+func testRecord(hostname string, mac string, ipv4 string) HostRecord {
+	return HostRecord{
+		Hostname: hostname,
+		Tags:     []string{"compute"},
+		Interfaces: []InterfaceRecord{{
+			Device:      "eth0",
+			RemoteID:    "sw1",
+			Port:        "Ethernet1",
+			MAC:         mac,
+			Ipv4:        ipv4,
+			Ipv4Gateway: "10.0.0.254",
+		}},
+	}
+}
+
+func hostnames(hosts []Host) []string {
+	names := make([]string, 0, len(hosts))
+	for _, host := range hosts {
+		names = append(names, host.Hostname)
+	}
+	return names
+}
+
+func TestSQLiteMigrations(t *testing.T) {
+	s, path := openTestSQLite(t)
+	var version int
+	if err := s.db.QueryRow(`PRAGMA user_version`).Scan(&version); err != nil {
+		t.Fatal(err)
+	}
+	if version != len(sqliteMigrations) {
+		t.Errorf("new database is at version %d, want %d", version, len(sqliteMigrations))
+	}
+	record := testRecord("node1.example.com", "52:54:00:00:00:01", "10.0.0.1/24")
+	if err := s.CreateHost(record); err != nil {
+		t.Fatal(err)
+	}
+	s.Close()
+
+	// Reopening must neither apply the migrations again nor lose hosts.
+	s, err := OpenSQLite(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if hosts := s.Hosts(); len(hosts) != 1 || !reflect.DeepEqual(hosts[0].Record(), record) {
+		t.Errorf("reopened database has %+v, want %+v", hosts, record)
+	}
+}
+
+func TestSQLiteMigrateOldSchema(t *testing.T) {
+	path := testDBPath(t)
+	db, err := sql.Open("sqlite3", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.Exec(sqliteSchema + `
+INSERT INTO hosts (hostname) VALUES ('node1.example.com');
+INSERT INTO interfaces VALUES ('node1.example.com', 'eth0', 'Ethernet1', '10.0.0.1/24', '10.0.0.254');`)
+	db.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := OpenSQLite(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	host, err := s.GetByHostname("node1.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if interf := host.Interfaces[0]; interf.MAC != nil || interf.RemoteID != "" || interf.Port != "Ethernet1" {
+		t.Errorf("migrated interface is %+v", interf)
+	}
+}
+
+// TestSQLiteEditRollback checks edits which fail leave both the database
+// and the hosts in memory as they were.
+func TestSQLiteEditRollback(t *testing.T) {
+	s, _ := openTestSQLite(t)
+	node1 := testRecord("node1.example.com", "52:54:00:00:00:01", "10.0.0.1/24")
+	node2 := testRecord("node2.example.com", "52:54:00:00:00:02", "10.0.0.2/24")
+	node2.Interfaces[0].Port = "Ethernet2"
+	if err := s.CreateHost(node1); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.CreateHost(node2); err != nil {
+		t.Fatal(err)
+	}
+
+	sameMAC := testRecord("node3.example.com", "52:54:00:00:00:01", "10.0.0.3/24")
+	sameMAC.Interfaces[0].Port = "Ethernet3"
+	sameDevice := testRecord("node3.example.com", "52:54:00:00:00:03", "10.0.0.3/24")
+	sameDevice.Interfaces = append(sameDevice.Interfaces, sameDevice.Interfaces[0])
+	badGateway := node2
+	badGateway.Interfaces = []InterfaceRecord{node2.Interfaces[0]}
+	badGateway.Interfaces[0].Ipv4Gateway = "10.0.1.254"
+
+	var invalid *ValidationError
+	tests := []struct {
+		name  string
+		edit  func() error
+		check func(error) bool
+	}{
+		{"create with a MAC in use", func() error { return s.CreateHost(sameMAC) }, func(err error) bool { return errors.As(err, &invalid) }},
+		{"create with a device twice", func() error { return s.CreateHost(sameDevice) }, func(err error) bool { return err == ErrExists }},
+		{"create existing", func() error { return s.CreateHost(node1) }, func(err error) bool { return err == ErrExists }},
+		{"update with a gateway off network", func() error { return s.UpdateHost(node2.Hostname, badGateway) }, func(err error) bool { return errors.As(err, &invalid) }},
+		{"rename onto another host", func() error {
+			renamed := node2
+			renamed.Hostname = node1.Hostname
+			return s.UpdateHost(node2.Hostname, renamed)
+		}, func(err error) bool { return err == ErrExists }},
+		{"add an interface with an address in use", func() error {
+			return s.AddInterface(node2.Hostname, InterfaceRecord{Device: "eth1", Ipv4: "10.0.0.1/24"})
+		}, func(err error) bool { return errors.As(err, &invalid) }},
+		{"update an interface onto a port in use", func() error {
+			moved := node2.Interfaces[0]
+			moved.Port = "Ethernet1"
+			return s.UpdateInterface(node2.Hostname, "eth0", moved)
+		}, func(err error) bool { return errors.As(err, &invalid) }},
+		{"set a BMC with a hostname in use", func() error {
+			return s.SetBMC(node2.Hostname, BMCRecord{Type: "ipmi", Hostname: node1.Hostname, Ipv4: "10.0.1.2/24"})
+		}, func(err error) bool { return errors.As(err, &invalid) }},
+		{"delete a missing host", func() error { return s.DeleteHost("node3.example.com") }, func(err error) bool { return err == ErrNotFound }},
+		{"delete a missing interface", func() error { return s.DeleteInterface(node1.Hostname, "eth1") }, func(err error) bool { return err == ErrNotFound }},
+	}
+	want := []HostRecord{node1, node2}
+	for _, test := range tests {
+		if err := test.edit(); !test.check(err) {
+			t.Errorf("%v gave %v", test.name, err)
+		}
+		records, err := readSQLite(s.db)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(records, want) {
+			t.Errorf("%v left %+v in the database, want %+v", test.name, records, want)
+		}
+		if hosts := hostnames(s.Hosts()); !reflect.DeepEqual(hosts, []string{node1.Hostname, node2.Hostname}) {
+			t.Errorf("%v left hosts %v", test.name, hosts)
+		}
+	}
+
+	// Deleting a host deletes its interfaces too.
+	if err := s.DeleteHost(node1.Hostname); err != nil {
+		t.Fatal(err)
+	}
+	var interfaces int
+	if err := s.db.QueryRow(`SELECT COUNT(*) FROM interfaces WHERE hostname = ?`, node1.Hostname).Scan(&interfaces); err != nil {
+		t.Fatal(err)
+	}
+	if interfaces != 0 {
+		t.Errorf("%d interfaces of a deleted host are left", interfaces)
+	}
+	if hosts := hostnames(s.Hosts()); !reflect.DeepEqual(hosts, []string{node2.Hostname}) {
+		t.Errorf("delete left hosts %v", hosts)
+	}
+}
@@ -0,0 +1,51 @@
+package ipam
+
+import (
+	"errors"
+	"net"
+)
+
+var (
+	// ErrNotFound is returned by Store lookups which match no host.
+	ErrNotFound = errors.New("not found")
+	// ErrExists is returned by Editor when adding a host or interface which
+	// is already there.
+	ErrExists = errors.New("already exists")
+)
+
+// Store is a database of hosts. Lookups return ErrNotFound when no host
+// matches. Implementations must be safe for concurrent use.
+type Store interface {
+	// GetByPort finds the host with an interface or BMC plugged into port
+	// on the network the DHCP relay relayIP is on. Ports given a remote ID
+	// are only on the switch relaying with that remote ID, and win over
+	// ports given none.
+	GetByPort(remoteID string, port string, relayIP net.IP) (Host, error)
+	// Get finds the host with an interface or BMC addressed ip.
+	Get(ip net.IP) (Host, error)
+	// GetByHostname finds the host or BMC named hostname.
+	GetByHostname(hostname string) (Host, error)
+	// GetByMAC finds the host with an interface or BMC with the hardware
+	// address mac.
+	GetByMAC(mac net.HardwareAddr) (Host, error)
+	// Hosts returns every host.
+	Hosts() []Host
+}
+
+// Editor is a Store whose hosts can be changed one at a time. Each change is
+// checked against every host, and nothing is changed if it would leave them
+// invalid, in which case a *ValidationError is returned.
+type Editor interface {
+	Store
+	CreateHost(record HostRecord) error
+	// UpdateHost replaces the host named hostname, which may be renamed.
+	UpdateHost(hostname string, record HostRecord) error
+	DeleteHost(hostname string) error
+	AddInterface(hostname string, record InterfaceRecord) error
+	// UpdateInterface replaces the interface of the host named device.
+	UpdateInterface(hostname string, device string, record InterfaceRecord) error
+	DeleteInterface(hostname string, device string) error
+	// SetBMC adds or replaces the host's BMC.
+	SetBMC(hostname string, record BMCRecord) error
+	DeleteBMC(hostname string) error
+}
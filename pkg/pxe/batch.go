@@ -0,0 +1,353 @@
+package pxe
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"path"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/nik-johnson-net/rackdirector/pkg/ipam"
+)
+
+// batchPollInterval is how often a running batch checks on its hosts.
+const batchPollInterval = 10 * time.Second
+
+// batchStarts is how many hosts a batch without an in-flight limit starts at
+// once.
+const batchStarts = 32
+
+// HostSelector picks hosts from IPAM. A host is selected if it matches any of
+// Hostnames, Glob or Tag.
+type HostSelector struct {
+	Hostnames []string
+	Glob      string
+	Tag       string
+}
+
+func (s HostSelector) matches(host ipam.Host) bool {
+	for _, hostname := range s.Hostnames {
+		if hostname == host.Hostname {
+			return true
+		}
+	}
+	if s.Glob != "" {
+		if matched, _ := path.Match(s.Glob, host.Hostname); matched {
+			return true
+		}
+	}
+	return s.Tag != "" && host.HasTag(s.Tag)
+}
+
+// BatchRequest rolls Plan out to the hosts picked by Selector. At most
+// MaxInFlight hosts run the plan at once, zero meaning no limit. Once
+// MaxFailures hosts have failed no more hosts are started, zero meaning never
+// stop.
+type BatchRequest struct {
+	Selector    HostSelector
+	Plan        string
+	MaxInFlight uint
+	MaxFailures uint
+}
+
+// Batch host states.
+const (
+	BatchHostPending   = "pending"
+	BatchHostRunning   = "running"
+	BatchHostSucceeded = "succeeded"
+	BatchHostFailed    = "failed"
+	BatchHostSkipped   = "skipped"
+)
+
+// Batch states.
+const (
+	BatchRunning   = "running"
+	BatchCompleted = "completed"
+	BatchStopped   = "stopped"
+)
+
+// BatchHost is the progress of a single host in a batch.
+type BatchHost struct {
+	Hostname string
+	Address  string
+	State    string
+	Reason   string `json:",omitempty"`
+}
+
+// BatchStatus is the aggregate progress of a batch.
+type BatchStatus struct {
+	ID        string
+	Request   BatchRequest
+	State     string
+	StartTime time.Time
+	EndTime   time.Time
+	Total     uint
+	Pending   uint
+	Running   uint
+	Succeeded uint
+	Failed    uint
+	Skipped   uint
+	Hosts     []BatchHost
+}
+
+type batch struct {
+	mu     sync.Mutex
+	status BatchStatus
+}
+
+func (b *batch) snapshot() BatchStatus {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	status := b.status
+	status.Hosts = make([]BatchHost, len(b.status.Hosts))
+	copy(status.Hosts, b.status.Hosts)
+	return status
+}
+
+// StartBatch begins rolling a plan out across a group of hosts in the
+// background and returns its initial status. Batches are only kept in memory:
+// after a restart they are gone, although the plans they started carry on.
+func (p *Pxe) StartBatch(request BatchRequest) (BatchStatus, error) {
+	if _, exists := p.planDefinition(request.Plan); !exists {
+		return BatchStatus{}, fmt.Errorf("plan %v doesn't exist", request.Plan)
+	}
+
+	hosts := make([]BatchHost, 0)
+	for _, host := range p.IPAM.Hosts() {
+		if !request.Selector.matches(host) {
+			continue
+		}
+		if len(host.Interfaces) == 0 {
+			return BatchStatus{}, fmt.Errorf("host %v has no interfaces", host.Hostname)
+		}
+		hosts = append(hosts, BatchHost{
+			Hostname: host.Hostname,
+			Address:  host.Interfaces[0].Ipv4.String(),
+			State:    BatchHostPending,
+		})
+	}
+	if len(hosts) == 0 {
+		return BatchStatus{}, fmt.Errorf("no hosts match the selector")
+	}
+	sort.Slice(hosts, func(i, j int) bool {
+		return hosts[i].Hostname < hosts[j].Hostname
+	})
+
+	b := &batch{
+		status: BatchStatus{
+			Request:   request,
+			State:     BatchRunning,
+			StartTime: time.Now(),
+			Hosts:     hosts,
+		},
+	}
+	b.tally()
+
+	p.batchLock.Lock()
+	if p.batches == nil {
+		p.batches = make(map[string]*batch)
+	}
+	p.batchCount++
+	b.status.ID = fmt.Sprintf("%d", p.batchCount)
+	p.batches[b.status.ID] = b
+	p.batchLock.Unlock()
+
+	status := b.snapshot()
+	log.Printf("Batch %v: rolling plan %v out to %d hosts\n", status.ID, request.Plan, len(hosts))
+	go p.runBatch(b)
+	return status, nil
+}
+
+// Batch returns the status of the batch with id.
+func (p *Pxe) Batch(id string) (BatchStatus, error) {
+	p.batchLock.Lock()
+	b, exists := p.batches[id]
+	p.batchLock.Unlock()
+	if !exists {
+		return BatchStatus{}, fmt.Errorf("batch %v doesn't exist", id)
+	}
+	return b.snapshot(), nil
+}
+
+// ListBatches returns the status of every batch, oldest first.
+func (p *Pxe) ListBatches() []BatchStatus {
+	p.batchLock.Lock()
+	batches := make([]*batch, 0, len(p.batches))
+	for _, b := range p.batches {
+		batches = append(batches, b)
+	}
+	p.batchLock.Unlock()
+
+	statuses := make([]BatchStatus, 0, len(batches))
+	for _, b := range batches {
+		statuses = append(statuses, b.snapshot())
+	}
+	sort.Slice(statuses, func(i, j int) bool {
+		return statuses[i].StartTime.Before(statuses[j].StartTime)
+	})
+	return statuses
+}
+
+func (p *Pxe) runBatch(b *batch) {
+	ticker := time.NewTicker(batchPollInterval)
+	defer ticker.Stop()
+
+	for {
+		p.stepBatch(b)
+		if b.snapshot().State != BatchRunning {
+			return
+		}
+		<-ticker.C
+	}
+}
+
+// stepBatch collects the outcome of running hosts, then starts pending hosts
+// up to the in-flight limit. Starting a host power cycles it through its BMC,
+// which can take minutes, so the hosts are started in parallel and b.mu isn't
+// held meanwhile.
+func (p *Pxe) stepBatch(b *batch) {
+	b.mu.Lock()
+	id := b.status.ID
+	request := b.status.Request
+	for idx := range b.status.Hosts {
+		host := &b.status.Hosts[idx]
+		if host.State != BatchHostRunning {
+			continue
+		}
+		plan, exists := p.plans.get(host.Address)
+		if exists {
+			if plan.failed() {
+				host.State = BatchHostFailed
+				host.Reason = plan.FailureReason
+			}
+			continue
+		}
+		// A plan with no outcome yet is still being removed.
+		switch outcome, ended := p.plans.outcome(host.Address); {
+		case ended && outcome == planCompleted:
+			host.State = BatchHostSucceeded
+		case ended:
+			host.State = BatchHostFailed
+			host.Reason = fmt.Sprintf("plan %v", outcome)
+		}
+	}
+	b.tally()
+
+	failures := b.status.Failed
+	start := make([]int, 0)
+	for idx, host := range b.status.Hosts {
+		if batchStopped(request, failures) || host.State != BatchHostPending {
+			continue
+		}
+		if request.MaxInFlight != 0 && b.status.Running+uint(len(start)) >= request.MaxInFlight {
+			break
+		}
+		start = append(start, idx)
+	}
+	hosts := make([]BatchHost, len(b.status.Hosts))
+	copy(hosts, b.status.Hosts)
+	b.mu.Unlock()
+
+	starts := uint(batchStarts)
+	if request.MaxInFlight != 0 && request.MaxInFlight < starts {
+		starts = request.MaxInFlight
+	}
+	slots := make(chan struct{}, starts)
+	var wg sync.WaitGroup
+	var startedLock sync.Mutex
+	started := make(map[int]error, len(start))
+	for _, idx := range start {
+		wg.Add(1)
+		slots <- struct{}{}
+		go func(idx int) {
+			defer wg.Done()
+			defer func() { <-slots }()
+
+			// Hosts waiting for a slot aren't started once the batch has
+			// failed too often.
+			startedLock.Lock()
+			stopped := batchStopped(request, failures)
+			startedLock.Unlock()
+			if stopped {
+				return
+			}
+
+			err := p.SetPlan(net.ParseIP(hosts[idx].Address), request.Plan)
+			if err != nil {
+				log.Printf("Batch %v: failed to start plan on %v: %v\n", id, hosts[idx].Hostname, err)
+			}
+			startedLock.Lock()
+			if err != nil {
+				failures++
+			}
+			started[idx] = err
+			startedLock.Unlock()
+		}(idx)
+	}
+	wg.Wait()
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for idx, err := range started {
+		host := &b.status.Hosts[idx]
+		if err != nil {
+			host.State = BatchHostFailed
+			host.Reason = err.Error()
+		} else {
+			host.State = BatchHostRunning
+		}
+	}
+	b.tally()
+
+	stopped := batchStopped(request, b.status.Failed)
+	if stopped {
+		for idx := range b.status.Hosts {
+			if b.status.Hosts[idx].State == BatchHostPending {
+				b.status.Hosts[idx].State = BatchHostSkipped
+			}
+		}
+		b.tally()
+	}
+
+	if b.status.Pending == 0 && b.status.Running == 0 {
+		b.status.State = BatchCompleted
+		if stopped {
+			b.status.State = BatchStopped
+		}
+		b.status.EndTime = time.Now()
+		log.Printf("Batch %v %v: %d succeeded, %d failed, %d skipped\n",
+			b.status.ID, b.status.State, b.status.Succeeded, b.status.Failed, b.status.Skipped)
+	}
+}
+
+// batchStopped reports whether the batch has seen enough failures to stop
+// starting hosts.
+func batchStopped(request BatchRequest, failures uint) bool {
+	return request.MaxFailures != 0 && failures >= request.MaxFailures
+}
+
+// tally must be called with mu held.
+func (b *batch) tally() {
+	b.status.Total = uint(len(b.status.Hosts))
+	b.status.Pending = 0
+	b.status.Running = 0
+	b.status.Succeeded = 0
+	b.status.Failed = 0
+	b.status.Skipped = 0
+	for _, host := range b.status.Hosts {
+		switch host.State {
+		case BatchHostPending:
+			b.status.Pending++
+		case BatchHostRunning:
+			b.status.Running++
+		case BatchHostSucceeded:
+			b.status.Succeeded++
+		case BatchHostFailed:
+			b.status.Failed++
+		case BatchHostSkipped:
+			b.status.Skipped++
+		}
+	}
+}
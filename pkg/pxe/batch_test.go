@@ -0,0 +1,53 @@
+package pxe
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+// TestStepBatch checks a batch starts its hosts in waves no bigger than its
+// in-flight limit, and starts each wave in parallel.
+func TestStepBatch(t *testing.T) {
+	const hosts = 5
+	addresses := make([]string, 0, hosts)
+	for i := 1; i <= hosts; i++ {
+		addresses = append(addresses, fmt.Sprintf("10.0.0.%d", i))
+	}
+	p, fake := newTestPxe(t, addresses...)
+	fake.delay = 50 * time.Millisecond
+
+	b := &batch{status: BatchStatus{
+		ID:      "1",
+		Request: BatchRequest{Plan: "test", MaxInFlight: 3},
+		State:   BatchRunning,
+	}}
+	for _, address := range addresses {
+		b.status.Hosts = append(b.status.Hosts, BatchHost{Hostname: "host-" + address, Address: address, State: BatchHostPending})
+	}
+	b.tally()
+
+	p.stepBatch(b)
+	if status := b.snapshot(); status.Running != 3 || status.Pending != 2 {
+		t.Errorf("first wave left %d running and %d pending", status.Running, status.Pending)
+	}
+	if fake.peak != 3 {
+		t.Errorf("%d hosts power cycled at once, want 3", fake.peak)
+	}
+
+	// Nothing more starts until a host is done.
+	p.stepBatch(b)
+	if status := b.snapshot(); status.Running != 3 {
+		t.Errorf("%d running with none done", status.Running)
+	}
+	for _, address := range addresses[:2] {
+		if err := callback(p, address, CallbackFailed); err != nil {
+			t.Fatal(err)
+		}
+	}
+	p.stepBatch(b)
+	status := b.snapshot()
+	if status.Running != 3 || status.Failed != 2 || status.Pending != 0 || status.State != BatchRunning {
+		t.Errorf("second wave left %+v", status)
+	}
+}
@@ -0,0 +1,103 @@
+package pxe
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+
+	"github.com/nik-johnson-net/rackdirector/pkg/history"
+)
+
+// Callback statuses.
+const (
+	CallbackSuccess = "success"
+	CallbackFailed  = "failed"
+)
+
+// tokenBytes is the length of a callback token before hex encoding.
+const tokenBytes = 16
+
+// ErrInvalidToken is returned for callbacks whose token doesn't belong to the
+// current stage of any plan, including tokens which have already been used.
+var ErrInvalidToken = errors.New("invalid callback token")
+
+// CallbackRequest is sent by a host when its current stage completes. Token
+// is the one given to the stage in its template data. Payload is any JSON the
+// host wants recorded, such as its installed kernel version or disk layout.
+type CallbackRequest struct {
+	Token   string
+	Status  string
+	Message string          `json:",omitempty"`
+	Payload json.RawMessage `json:",omitempty"`
+}
+
+func newToken() (string, error) {
+	token := make([]byte, tokenBytes)
+	if _, err := rand.Read(token); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(token), nil
+}
+
+// Callback advances the plan holding the request's token on success, or
+// fails it. Each token is accepted once.
+func (p *Pxe) Callback(request CallbackRequest) error {
+	if request.Status != CallbackSuccess && request.Status != CallbackFailed {
+		return fmt.Errorf("unknown callback status %q", request.Status)
+	}
+	if len(request.Payload) != 0 && !json.Valid(request.Payload) {
+		return fmt.Errorf("callback payload isn't valid JSON")
+	}
+
+	host, ok := p.plans.findToken(request.Token)
+	if !ok {
+		return ErrInvalidToken
+	}
+	peer := net.ParseIP(host)
+
+	consume := func(plan *PlanRecord) error {
+		// The plan may have moved on since the token was found.
+		if !validToken(plan.Token, request.Token) {
+			return ErrInvalidToken
+		}
+		plan.Token = ""
+		return nil
+	}
+	if request.Status == CallbackSuccess {
+		return p.advancePlan(peer, consume, request.Payload)
+	}
+	return p.failOnCallback(peer, consume, request)
+}
+
+func (p *Pxe) failOnCallback(peer net.IP, consume func(plan *PlanRecord) error, request CallbackRequest) error {
+	plan, err := p.plans.update(peer.String(), func(plan *PlanRecord) (bool, error) {
+		if plan.failed() {
+			return false, ErrInvalidToken
+		}
+		if err := consume(plan); err != nil {
+			return false, err
+		}
+		reason := fmt.Sprintf("stage %v reported failure", plan.Stages[plan.CurrentStage].Name)
+		if request.Message != "" {
+			reason += ": " + request.Message
+		}
+		plan.State = planFailed
+		plan.FailureReason = reason
+		return true, nil
+	})
+	if err != nil {
+		return err
+	}
+	log.Printf("PLAN FAILED: plan %v for %v: %v\n", plan.Name, peer, plan.FailureReason)
+	p.recordPayload(peer, history.PlanFailed, plan, plan.FailureReason, request.Payload)
+	return nil
+}
+
+func validToken(expected string, token string) bool {
+	return expected != "" && subtle.ConstantTimeCompare([]byte(expected), []byte(token)) == 1
+}
@@ -0,0 +1,119 @@
+package pxe
+
+import (
+	"net"
+	"regexp"
+	"testing"
+)
+
+// seedNextToken matches the token an install seed leaves the installed
+// system to call back with.
+var seedNextToken = regexp.MustCompile(`-d '\{"Token": "([0-9a-f]+)", "Status": "success"\}'`)
+
+func TestCallbackTokens(t *testing.T) {
+	const host = "10.0.0.1"
+	ip := net.ParseIP(host)
+	p, _ := newTestPxe(t, host)
+	if err := p.SetPlan(ip, "test"); err != nil {
+		t.Fatal(err)
+	}
+
+	// A token is issued with the plan, and given to the host to call back
+	// with.
+	task, err := token(p, host)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(task) != 2*tokenBytes {
+		t.Fatalf("issued token %q", task)
+	}
+	if err := p.Callback(CallbackRequest{Token: "", Status: CallbackSuccess}); err != ErrInvalidToken {
+		t.Errorf("empty token gave %v", err)
+	}
+
+	// Using it advances the plan, which issues the next stage a new token.
+	if err := p.Callback(CallbackRequest{Token: task, Status: CallbackSuccess, Payload: []byte(`{"cpus": 2}`)}); err != nil {
+		t.Fatal(err)
+	}
+	if status, _ := plan(p, host); status.StageIndex != 1 {
+		t.Fatalf("callback left the plan at stage %d", status.StageIndex)
+	}
+	install, err := token(p, host)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if install == task {
+		t.Error("install stage reused the token of the task stage")
+	}
+
+	// A used token is rejected, whatever the status it reports.
+	for _, status := range []string{CallbackSuccess, CallbackFailed} {
+		if err := p.Callback(CallbackRequest{Token: task, Status: status}); err != ErrInvalidToken {
+			t.Errorf("replayed %v callback gave %v", status, err)
+		}
+	}
+
+	// The seed gives the installed system the localboot stage's token, which
+	// is rejected until the install stage has called back.
+	seed, err := p.InstallSeed(ip)
+	if err != nil {
+		t.Fatal(err)
+	}
+	match := seedNextToken.FindSubmatch(seed)
+	if match == nil {
+		t.Fatalf("seed has no token for the localboot stage:\n%s", seed)
+	}
+	localboot := string(match[1])
+	if localboot == install {
+		t.Fatal("seed gave the install token for the localboot stage")
+	}
+	if err := p.Callback(CallbackRequest{Token: localboot, Status: CallbackSuccess}); err != ErrInvalidToken {
+		t.Errorf("localboot token in the install stage gave %v", err)
+	}
+	if status, _ := plan(p, host); status.StageIndex != 1 || status.State != PlanStateRunning {
+		t.Fatalf("wrong stage token moved the plan to %+v", status)
+	}
+
+	if err := p.Callback(CallbackRequest{Token: install, Status: CallbackSuccess}); err != nil {
+		t.Fatal(err)
+	}
+	if current, err := token(p, host); err != nil || current != localboot {
+		t.Errorf("localboot stage has token %q, %v, want the one in the seed", current, err)
+	}
+	if err := p.Callback(CallbackRequest{Token: localboot, Status: CallbackSuccess}); err != nil {
+		t.Fatal(err)
+	}
+	if status, running := plan(p, host); running {
+		t.Errorf("finished plan is %+v", status)
+	}
+	if err := p.Callback(CallbackRequest{Token: localboot, Status: CallbackSuccess}); err != ErrInvalidToken {
+		t.Errorf("token of a finished plan gave %v", err)
+	}
+}
+
+// TestCallbackFailed checks a failure callback fails the plan and uses up
+// its token.
+func TestCallbackFailed(t *testing.T) {
+	const host = "10.0.0.1"
+	p, _ := newTestPxe(t, host)
+	if err := p.SetPlan(net.ParseIP(host), "test"); err != nil {
+		t.Fatal(err)
+	}
+	task, err := token(p, host)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Callback(CallbackRequest{Token: task, Status: "done"}); err == nil {
+		t.Error("unknown status accepted")
+	}
+	if err := p.Callback(CallbackRequest{Token: task, Status: CallbackFailed, Message: "disk missing"}); err != nil {
+		t.Fatal(err)
+	}
+	status, _ := plan(p, host)
+	if status.State != PlanStateFailed || status.FailureReason != "stage task-inventory reported failure: disk missing" {
+		t.Errorf("failed plan is %+v", status)
+	}
+	if err := p.Callback(CallbackRequest{Token: task, Status: CallbackSuccess}); err != ErrInvalidToken {
+		t.Errorf("token of a failed stage gave %v", err)
+	}
+}
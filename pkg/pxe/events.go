@@ -0,0 +1,37 @@
+package pxe
+
+import (
+	"encoding/json"
+	"log"
+	"net"
+
+	"github.com/nik-johnson-net/rackdirector/pkg/history"
+)
+
+// record adds an event for the host at address to the history log. Hosts
+// unknown to IPAM are recorded under their address.
+func (p *Pxe) record(address net.IP, eventType history.EventType, plan PlanRecord, message string) {
+	p.recordPayload(address, eventType, plan, message, nil)
+}
+
+// recordPayload records an event carrying data reported by the host.
+func (p *Pxe) recordPayload(address net.IP, eventType history.EventType, plan PlanRecord, message string, payload json.RawMessage) {
+	event := history.Event{
+		Hostname: address.String(),
+		Address:  address.String(),
+		Type:     eventType,
+		Plan:     plan.Name,
+		Message:  message,
+		Payload:  payload,
+	}
+	if peerInfo, err := p.IPAM.Get(address); err == nil {
+		event.Hostname = peerInfo.Hostname
+	}
+	if plan.CurrentStage < uint(len(plan.Stages)) {
+		event.Stage = plan.Stages[plan.CurrentStage].Name
+	}
+
+	if err := p.History.Record(event); err != nil {
+		log.Printf("Failed to record %v event for %v: %v\n", eventType, address, err)
+	}
+}
@@ -0,0 +1,134 @@
+package pxe
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/nik-johnson-net/rackdirector/pkg/history"
+)
+
+// Plan states reported in PlanStatus.
+const (
+	PlanStateRunning = string(planRunning)
+	PlanStateFailed  = string(planFailed)
+)
+
+// PlanStatus describes a host's active plan.
+type PlanStatus struct {
+	Address        string
+	Hostname       string
+	Plan           string
+	State          string
+	FailureReason  string
+	Stage          string
+	StageIndex     uint
+	StageCount     uint
+	Attempts       uint
+	StartTime      time.Time
+	StageStartTime time.Time
+	LastSeen       time.Time
+}
+
+// touch records that peer was just seen fetching something for its plan.
+func (p *Pxe) touch(peer net.IP) {
+	p.plans.touch(peer.String(), time.Now())
+}
+
+// ListPlans returns the status of every host with an active plan, ordered by
+// address.
+func (p *Pxe) ListPlans() []PlanStatus {
+	plans := p.plans.list()
+
+	statuses := make([]PlanStatus, 0, len(plans))
+	for host, plan := range plans {
+		status := PlanStatus{
+			Address:        host,
+			Plan:           plan.Name,
+			State:          PlanStateRunning,
+			FailureReason:  plan.FailureReason,
+			Stage:          plan.Stages[plan.CurrentStage].Name,
+			StageIndex:     plan.CurrentStage,
+			StageCount:     uint(len(plan.Stages)),
+			Attempts:       plan.Attempts,
+			StartTime:      plan.StartTime,
+			StageStartTime: plan.StageStartTime,
+			LastSeen:       plan.LastSeen,
+		}
+		if plan.failed() {
+			status.State = PlanStateFailed
+		}
+		if peerInfo, err := p.IPAM.Get(net.ParseIP(host)); err == nil {
+			status.Hostname = peerInfo.Hostname
+		}
+		statuses = append(statuses, status)
+	}
+
+	sort.Slice(statuses, func(i, j int) bool {
+		return statuses[i].Address < statuses[j].Address
+	})
+	return statuses
+}
+
+// CancelPlan aborts the plan for ip. The host is left as it is; it will
+// localboot the next time it netboots.
+func (p *Pxe) CancelPlan(ip net.IP) error {
+	plan, err := p.plans.update(ip.String(), func(plan *PlanRecord) (bool, error) {
+		plan.State = planCancelled
+		return false, nil
+	})
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stdout, "Plan %v for %v cancelled at stage %v.\n", plan.Name, ip, plan.Stages[plan.CurrentStage].Name)
+	p.record(ip, history.PlanCancelled, plan, "")
+	return nil
+}
+
+// RetryStage power cycles ip so it boots into its current stage again. A
+// failed plan resumes at the stage it failed in.
+func (p *Pxe) RetryStage(ip net.IP) error {
+	plan, err := p.plans.update(ip.String(), func(plan *PlanRecord) (bool, error) {
+		return true, plan.startStage(plan.CurrentStage)
+	})
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stdout, "Retrying stage %v of plan %v for %v.\n", plan.Stages[plan.CurrentStage].Name, plan.Name, ip)
+	p.record(ip, history.StageRetried, plan, "retried by operator")
+	return p.netboot(ip)
+}
+
+// JumpToStage moves the plan for ip to the stage at index and power cycles
+// the host so it boots into it.
+func (p *Pxe) JumpToStage(ip net.IP, index uint) error {
+	plan, err := p.plans.update(ip.String(), func(plan *PlanRecord) (bool, error) {
+		if index >= uint(len(plan.Stages)) {
+			return false, fmt.Errorf("plan %v has no stage %d", plan.Name, index)
+		}
+		return true, plan.startStage(index)
+	})
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stdout, "Plan %v for %v jumped to stage %v.\n", plan.Name, ip, plan.Stages[index].Name)
+	p.record(ip, history.StageJumped, plan, "")
+	return p.netboot(ip)
+}
+
+// CompletePlan marks the plan for ip finished without running its remaining
+// stages.
+func (p *Pxe) CompletePlan(ip net.IP) error {
+	plan, err := p.plans.update(ip.String(), func(plan *PlanRecord) (bool, error) {
+		plan.State = planCompleted
+		return false, nil
+	})
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stdout, "Plan %v for %v force completed at stage %v.\n", plan.Name, ip, plan.Stages[plan.CurrentStage].Name)
+	p.record(ip, history.PlanFinished, plan, "force completed by operator")
+	return nil
+}
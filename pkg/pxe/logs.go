@@ -0,0 +1,177 @@
+package pxe
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/nik-johnson-net/rackdirector/pkg/history"
+	"github.com/nik-johnson-net/rackdirector/pkg/syslogd"
+)
+
+const logSuffix = ".log"
+
+// runID names a single run of a plan, such as
+// reinstall-centos-8-20200301T101500Z.
+func runID(plan string, start time.Time) string {
+	return plan + "-" + start.UTC().Format("20060102T150405Z")
+}
+
+// RunID names this run of the plan.
+func (s PlanStatus) RunID() string {
+	return runID(s.Plan, s.StartTime)
+}
+
+func validatePatterns(patterns []string) error {
+	for _, pattern := range patterns {
+		if _, err := regexp.Compile(pattern); err != nil {
+			return fmt.Errorf("bad fail pattern %q: %v", pattern, err)
+		}
+	}
+	return nil
+}
+
+// HandleLog stores a log message from the host at peer with its plan run and
+// fails the current stage if the message matches one of its fail patterns.
+// Messages from hosts which aren't in a plan are dropped.
+func (p *Pxe) HandleLog(peer net.IP, message syslogd.Message) {
+	plan, exists := p.plans.get(peer.String())
+	if !exists {
+		return
+	}
+	peerInfo, err := p.IPAM.Get(peer)
+	if err != nil {
+		return
+	}
+
+	if err := p.writeLog(peerInfo.Hostname, runID(plan.Name, plan.StartTime), message); err != nil {
+		log.Printf("Failed to store log from %v: %v\n", peerInfo.Hostname, err)
+	}
+
+	if plan.failed() {
+		return
+	}
+	if pattern, matched := p.matchFailPattern(plan, message.Text); matched {
+		p.failOnLog(peer, plan, pattern, message)
+	}
+}
+
+func (p *Pxe) writeLog(hostname string, run string, message syslogd.Message) error {
+	if p.LogDirectory == "" {
+		return nil
+	}
+	p.logLock.Lock()
+	defer p.logLock.Unlock()
+
+	directory := filepath.Join(p.LogDirectory, hostname)
+	if err := os.MkdirAll(directory, 0755); err != nil {
+		return err
+	}
+	file, err := os.OpenFile(filepath.Join(directory, run+logSuffix), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := fmt.Fprintln(file, message.String()); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// matchFailPattern returns the first global, plan or stage fail pattern which
+// matches text.
+func (p *Pxe) matchFailPattern(plan PlanRecord, text string) (string, bool) {
+	patterns := p.failPatterns()
+	patterns = append(patterns, plan.FailPatterns...)
+	patterns = append(patterns, plan.Stages[plan.CurrentStage].FailPatterns...)
+
+	for _, pattern := range patterns {
+		re := p.compilePattern(pattern)
+		if re != nil && re.MatchString(text) {
+			return pattern, true
+		}
+	}
+	return "", false
+}
+
+// compilePattern compiles pattern once, returning nil if it is invalid.
+// Patterns are validated when plans are loaded, so that only happens for
+// plans persisted by an older version.
+func (p *Pxe) compilePattern(pattern string) *regexp.Regexp {
+	p.logLock.Lock()
+	defer p.logLock.Unlock()
+
+	if re, ok := p.patterns[pattern]; ok {
+		return re
+	}
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		log.Printf("Ignoring bad fail pattern %q: %v\n", pattern, err)
+	}
+	if p.patterns == nil {
+		p.patterns = make(map[string]*regexp.Regexp)
+	}
+	p.patterns[pattern] = re
+	return re
+}
+
+func (p *Pxe) failOnLog(peer net.IP, plan PlanRecord, pattern string, message syslogd.Message) {
+	updated, err := p.plans.update(peer.String(), func(current *PlanRecord) (bool, error) {
+		// Only fail the run and stage the message was matched against.
+		if current.failed() || !current.StartTime.Equal(plan.StartTime) || current.CurrentStage != plan.CurrentStage {
+			return true, nil
+		}
+		current.State = planFailed
+		current.FailureReason = fmt.Sprintf("stage %v logged %q, matching %q",
+			current.Stages[current.CurrentStage].Name, message.Text, pattern)
+		return true, nil
+	})
+	if err != nil || !updated.failed() || updated.FailureReason == plan.FailureReason {
+		return
+	}
+	log.Printf("PLAN FAILED: plan %v for %v: %v\n", updated.Name, peer, updated.FailureReason)
+	p.record(peer, history.PlanFailed, updated, updated.FailureReason)
+}
+
+// LogRuns lists the plan runs hostname has sent logs for, newest first.
+func (p *Pxe) LogRuns(hostname string) ([]string, error) {
+	if !validLogName(hostname) {
+		return nil, fmt.Errorf("invalid hostname %q", hostname)
+	}
+	files, err := ioutil.ReadDir(filepath.Join(p.LogDirectory, hostname))
+	if os.IsNotExist(err) {
+		return []string{}, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].ModTime().After(files[j].ModTime())
+	})
+	runs := make([]string, 0, len(files))
+	for _, file := range files {
+		if !file.IsDir() && strings.HasSuffix(file.Name(), logSuffix) {
+			runs = append(runs, strings.TrimSuffix(file.Name(), logSuffix))
+		}
+	}
+	return runs, nil
+}
+
+// ReadLog returns the logs hostname sent during a plan run.
+func (p *Pxe) ReadLog(hostname string, run string) ([]byte, error) {
+	if !validLogName(hostname) || !validLogName(run) {
+		return nil, fmt.Errorf("invalid log %v/%v", hostname, run)
+	}
+	return ioutil.ReadFile(filepath.Join(p.LogDirectory, hostname, run+logSuffix))
+}
+
+func validLogName(name string) bool {
+	return name != "" && name != "." && name != ".." && !strings.ContainsAny(name, `/\`)
+}
@@ -0,0 +1,65 @@
+package pxe
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nik-johnson-net/rackdirector/pkg/syslogd"
+)
+
+// TestHandleLogFailPattern checks logs are kept for the plan run, and a line
+// matching a fail pattern fails the current stage.
+func TestHandleLogFailPattern(t *testing.T) {
+	const host = "10.0.0.1"
+	ip := net.ParseIP(host)
+	p, _ := newTestPxe(t, host)
+	dir, err := ioutil.TempDir("", "logs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	p.LogDirectory = dir
+
+	if err := p.SetPlan(ip, "test"); err != nil {
+		t.Fatal(err)
+	}
+	task, err := token(p, host)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	received := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	p.HandleLog(ip, syslogd.ParseNetconsole([]byte("6,1,2,-;e1000e: eth0 NIC Link is Up"), received))
+	if status, _ := plan(p, host); status.State != PlanStateRunning {
+		t.Fatalf("plan is %v after an ordinary line", status.State)
+	}
+
+	p.HandleLog(ip, syslogd.ParseNetconsole([]byte("0,3,4,-;Kernel panic - not syncing: Fatal exception"), received))
+	status, _ := plan(p, host)
+	want := `stage task-inventory logged "Kernel panic - not syncing: Fatal exception", matching "Kernel panic"`
+	if status.State != PlanStateFailed || status.FailureReason != want {
+		t.Errorf("plan is %v: %v, want it failed: %v", status.State, status.FailureReason, want)
+	}
+	if err := p.Callback(CallbackRequest{Token: task, Status: CallbackSuccess}); err == nil {
+		t.Error("failed stage called back")
+	}
+
+	logged, err := p.ReadLog("host-"+host, status.RunID())
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(logged)), "\n")
+	if len(lines) != 2 || !strings.HasSuffix(lines[1], "emerg kernel: Kernel panic - not syncing: Fatal exception") {
+		t.Errorf("logged %q", logged)
+	}
+
+	// Hosts without a plan aren't logged.
+	p.HandleLog(net.ParseIP("10.0.0.2"), syslogd.ParseNetconsole([]byte("hello"), received))
+	if runs, err := p.LogRuns("host-10.0.0.2"); err != nil || len(runs) != 0 {
+		t.Errorf("host without a plan has logs %v, %v", runs, err)
+	}
+}
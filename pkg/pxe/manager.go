@@ -0,0 +1,185 @@
+package pxe
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// ErrNoPlan is returned for hosts which aren't in a plan.
+var ErrNoPlan = errors.New("not in a plan")
+
+// planManager owns the host plan map. All access goes through its methods,
+// which serialize on mu and write every change through to the store.
+type planManager struct {
+	mu    sync.Mutex
+	store PlanStore
+	plans map[string]PlanRecord
+	// ended holds the state the last plan removed for each host was left in,
+	// until the host starts another plan.
+	ended map[string]PlanState
+}
+
+// restore replaces the managed plans with those held in store, and uses store
+// for all subsequent writes.
+func (m *planManager) restore(store PlanStore) (map[string]PlanRecord, error) {
+	plans, err := store.Load()
+	if err != nil {
+		return nil, err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.store = store
+	m.plans = plans
+	return copyPlans(plans), nil
+}
+
+// flush writes every plan to the store.
+func (m *planManager) flush() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.save()
+}
+
+// get returns the plan for host.
+func (m *planManager) get(host string) (PlanRecord, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	plan, exists := m.plans[host]
+	return plan, exists
+}
+
+// list returns every plan keyed by host.
+func (m *planManager) list() map[string]PlanRecord {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return copyPlans(m.plans)
+}
+
+// outcome returns how the last plan removed for host ended, if host hasn't
+// started another plan since.
+func (m *planManager) outcome(host string) (PlanState, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	state, ended := m.ended[host]
+	return state, ended
+}
+
+// touch records that host was seen at now. Hosts fetch boot files often, so
+// this isn't written to the store; LastSeen is saved with the next change to
+// any plan, or when the plans are flushed.
+func (m *planManager) touch(host string, now time.Time) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if plan, exists := m.plans[host]; exists {
+		plan.LastSeen = now
+		m.plans[host] = plan
+	}
+}
+
+// findToken returns the host whose current stage holds the callback token.
+func (m *planManager) findToken(token string) (string, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for host, plan := range m.plans {
+		if validToken(plan.Token, token) {
+			return host, true
+		}
+	}
+	return "", false
+}
+
+// start records plan for host, failing if host is already in a plan which
+// has not failed.
+func (m *planManager) start(host string, plan PlanRecord) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if currentPlan, exists := m.plans[host]; exists && !currentPlan.failed() {
+		return fmt.Errorf("%v already in a plan (%v)", host, currentPlan.Name)
+	}
+	if err := m.set(host, plan); err != nil {
+		return err
+	}
+	delete(m.ended, host)
+	return nil
+}
+
+// update calls fn with the plan for host while holding the lock. fn modifies
+// the plan in place and reports whether the plan should be kept; returning
+// false removes it, after setting its State to how it ended. The plan as it
+// was left by fn is returned.
+func (m *planManager) update(host string, fn func(plan *PlanRecord) (bool, error)) (PlanRecord, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	plan, exists := m.plans[host]
+	if !exists {
+		return PlanRecord{}, fmt.Errorf("%v %w", host, ErrNoPlan)
+	}
+
+	keep, err := fn(&plan)
+	if err != nil {
+		return PlanRecord{}, err
+	}
+	if !keep {
+		if err := m.delete(host); err != nil {
+			return PlanRecord{}, err
+		}
+		if m.ended == nil {
+			m.ended = make(map[string]PlanState)
+		}
+		m.ended[host] = plan.State
+		return plan, nil
+	}
+	return plan, m.set(host, plan)
+}
+
+// set must be called with mu held. The in-memory state is rolled back if the
+// store rejects the write.
+func (m *planManager) set(host string, plan PlanRecord) error {
+	if m.plans == nil {
+		m.plans = make(map[string]PlanRecord)
+	}
+	previous, existed := m.plans[host]
+	m.plans[host] = plan
+	if err := m.save(); err != nil {
+		if existed {
+			m.plans[host] = previous
+		} else {
+			delete(m.plans, host)
+		}
+		return err
+	}
+	return nil
+}
+
+// delete must be called with mu held. The in-memory state is rolled back if
+// the store rejects the write.
+func (m *planManager) delete(host string) error {
+	previous, existed := m.plans[host]
+	if !existed {
+		return nil
+	}
+	delete(m.plans, host)
+	if err := m.save(); err != nil {
+		m.plans[host] = previous
+		return err
+	}
+	return nil
+}
+
+func (m *planManager) save() error {
+	if m.store == nil {
+		return nil
+	}
+	return m.store.Save(copyPlans(m.plans))
+}
+
+func copyPlans(plans map[string]PlanRecord) map[string]PlanRecord {
+	copied := make(map[string]PlanRecord, len(plans))
+	for host, plan := range plans {
+		copied[host] = plan
+	}
+	return copied
+}
@@ -0,0 +1,45 @@
+package pxe
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func newTestManager(t *testing.T) (*planManager, *FileStore) {
+	dir, err := ioutil.TempDir("", "planstore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	store := &FileStore{Path: filepath.Join(dir, "planstate.json")}
+	m := &planManager{}
+	if _, err := m.restore(store); err != nil {
+		t.Fatal(err)
+	}
+	return m, store
+}
+
+// TestPlanManagerRestore checks plans come back from the store as they were
+// left.
+func TestPlanManagerRestore(t *testing.T) {
+	m, store := newTestManager(t)
+	if err := m.start("10.0.0.1", PlanRecord{Name: "reinstall-centos-8", CurrentStage: 1, Token: "abc"}); err != nil {
+		t.Fatal(err)
+	}
+
+	restored := &planManager{}
+	plans, err := restored.restore(store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(plans, m.list()) {
+		t.Errorf("restored %+v, want %+v", plans, m.list())
+	}
+	if host, ok := restored.findToken("abc"); !ok || host != "10.0.0.1" {
+		t.Errorf("token found for %q, %v", host, ok)
+	}
+}
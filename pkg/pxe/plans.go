@@ -0,0 +1,181 @@
+package pxe
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// Duration is a time.Duration written in JSON as a string such as "90m".
+type Duration time.Duration
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var value string
+	if err := json.Unmarshal(data, &value); err != nil {
+		return err
+	}
+	parsed, err := time.ParseDuration(value)
+	if err != nil {
+		return err
+	}
+	*d = Duration(parsed)
+	return nil
+}
+
+// StageDefinition is a single step of a plan. Target is the OS to install for
+// install stages and the task to run for task stages. A host which stays in
+// the stage longer than Timeout is retried or failed, as is a host which logs
+// a line matching one of the FailPatterns regular expressions.
+type StageDefinition struct {
+	Name         string            `json:"name"`
+	Type         StageType         `json:"type"`
+	Target       string            `json:"target,omitempty"`
+	Params       map[string]string `json:"params,omitempty"`
+	Timeout      Duration          `json:"timeout,omitempty"`
+	FailPatterns []string          `json:"fail_patterns,omitempty"`
+}
+
+// UnmarshalJSON accepts either a stage object or a bare stage name, which is
+// how stages were stored before they carried parameters.
+func (s *StageDefinition) UnmarshalJSON(data []byte) error {
+	var name string
+	if err := json.Unmarshal(data, &name); err == nil {
+		*s = StageDefinition{Name: name}
+		s.normalize()
+		return nil
+	}
+
+	type plain StageDefinition
+	var stage plain
+	if err := json.Unmarshal(data, &stage); err != nil {
+		return err
+	}
+	*s = StageDefinition(stage)
+	s.normalize()
+	return nil
+}
+
+// planDefinition is a named, ordered list of stages loaded from the plan
+// directory. Retries is how many times a timed out stage is power cycled and
+// attempted again before the plan fails. FailPatterns apply to every stage.
+type planDefinition struct {
+	Name         string            `json:"name"`
+	Description  string            `json:"description"`
+	Retries      uint              `json:"retries"`
+	FailPatterns []string          `json:"fail_patterns,omitempty"`
+	Stages       []StageDefinition `json:"stages"`
+}
+
+// loadPlanDefinitions reads every *.json file in dir as a plan definition. A
+// plan without a name is named after its file.
+func loadPlanDefinitions(dir string) (map[string]planDefinition, error) {
+	files, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+
+	definitions := make(map[string]planDefinition)
+	for _, file := range files {
+		definition, err := loadPlanDefinition(file)
+		if err != nil {
+			return nil, fmt.Errorf("%v: %v", file, err)
+		}
+		if _, exists := definitions[definition.Name]; exists {
+			return nil, fmt.Errorf("%v: plan %v defined more than once", file, definition.Name)
+		}
+		definitions[definition.Name] = definition
+	}
+	return definitions, nil
+}
+
+func loadPlanDefinition(file string) (planDefinition, error) {
+	planFile, err := os.Open(file)
+	if err != nil {
+		return planDefinition{}, err
+	}
+	defer planFile.Close()
+
+	decoder := json.NewDecoder(planFile)
+	decoder.DisallowUnknownFields()
+
+	var definition planDefinition
+	err = decoder.Decode(&definition)
+	if err != nil {
+		return planDefinition{}, err
+	}
+	if definition.Name == "" {
+		definition.Name = strings.TrimSuffix(filepath.Base(file), filepath.Ext(file))
+	}
+	return definition, nil
+}
+
+// validatePlanDefinitions checks every plan against the stage templates and
+// global fail patterns, returning all problems found at once.
+func validatePlanDefinitions(definitions map[string]planDefinition, templates *template.Template, failPatterns []string) error {
+	names := make([]string, 0, len(definitions))
+	for name := range definitions {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	problems := make([]string, 0)
+	if err := validatePatterns(failPatterns); err != nil {
+		problems = append(problems, err.Error())
+	}
+	for _, name := range names {
+		definition := definitions[name]
+		if len(definition.Stages) == 0 {
+			problems = append(problems, fmt.Sprintf("plan %v has no stages", name))
+		}
+		if err := validatePatterns(definition.FailPatterns); err != nil {
+			problems = append(problems, fmt.Sprintf("plan %v: %v", name, err))
+		}
+		for idx, stage := range definition.Stages {
+			if err := stage.validate(templates); err != nil {
+				problems = append(problems, fmt.Sprintf("plan %v stage %d: %v", name, idx, err))
+			}
+		}
+	}
+
+	if len(problems) != 0 {
+		return fmt.Errorf("invalid plans: %v", strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+// ReloadPlans loads and validates the plan definitions in PlanDirectory. The
+// new definitions replace the current ones only if they are all valid. Hosts
+// already in a plan keep the stages they started with.
+func (p *Pxe) ReloadPlans() error {
+	definitions, err := loadPlanDefinitions(p.PlanDirectory)
+	if err != nil {
+		return err
+	}
+
+	// Validate under the lock so the templates can't change meanwhile.
+	p.definitionsLock.Lock()
+	defer p.definitionsLock.Unlock()
+	if err := validatePlanDefinitions(definitions, p.templates(), p.failPatterns()); err != nil {
+		return err
+	}
+	p.definitions = definitions
+
+	fmt.Fprintf(os.Stdout, "Loaded %d plans from %v\n", len(definitions), p.PlanDirectory)
+	return nil
+}
+
+func (p *Pxe) planDefinition(name string) (planDefinition, bool) {
+	p.definitionsLock.RLock()
+	defer p.definitionsLock.RUnlock()
+	definition, exists := p.definitions[name]
+	return definition, exists
+}
@@ -2,31 +2,88 @@ package pxe
 
 import (
 	"bytes"
+	"encoding/json"
 	"fmt"
 	"log"
 	"math/rand"
 	"net"
 	"os"
-	"os/exec"
+	"regexp"
 	"strings"
+	"sync"
 	"text/template"
+	"time"
 
+	"github.com/nik-johnson-net/rackdirector/pkg/bmc"
+	"github.com/nik-johnson-net/rackdirector/pkg/history"
 	"github.com/nik-johnson-net/rackdirector/pkg/ipam"
 )
 
-var planMap = map[string][]string{
-	"reinstall-centos-8": {
-		"install-centos-8",
-	},
-	"reinstall-centos-7": {
-		"install-centos-7",
-	},
+// PlanState is how far a plan has got.
+type PlanState string
+
+const (
+	planRunning PlanState = "running"
+	// planFailed is terminal. The plan is kept so the failure can be seen
+	// until it is retried or cancelled, and the host localboots meanwhile.
+	planFailed PlanState = "failed"
+	// planCompleted and planCancelled are how plans which have been removed
+	// ended.
+	planCompleted PlanState = "completed"
+	planCancelled PlanState = "cancelled"
+)
+
+// PlanRecord is the state of a host's plan, as kept by a PlanStore. Its
+// fields all marshal to JSON, which is how stores outside this package are
+// expected to persist it.
+type PlanRecord struct {
+	Name           string            `json:"name"`
+	Stages         []StageDefinition `json:"stages"`
+	CurrentStage   uint              `json:"current_stage"`
+	StartTime      time.Time         `json:"start_time"`
+	LastSeen       time.Time         `json:"last_seen"`
+	StageStartTime time.Time         `json:"stage_start_time"`
+	Retries        uint              `json:"retries"`
+	Attempts       uint              `json:"attempts"`
+	State          PlanState         `json:"state"`
+	FailureReason  string            `json:"failure_reason,omitempty"`
+	FailPatterns   []string          `json:"fail_patterns,omitempty"`
+	// Token authenticates callbacks for the current stage. It is replaced
+	// whenever a stage starts and cleared once used.
+	Token string `json:"token,omitempty"`
+	// NextToken is the token the next stage will be given, issued early so
+	// an installer can leave it for the system it installs to call back
+	// with from a localboot stage.
+	NextToken string `json:"next_token,omitempty"`
 }
 
-type plandef struct {
-	Name         string
-	Stages       []string
-	CurrentStage uint
+func (p PlanRecord) failed() bool {
+	return p.State == planFailed
+}
+
+// startStage moves the plan to the stage at index, resets its timeout and
+// retry accounting and issues a new callback token. Advancing to the next
+// stage gives it the token issued in advance as NextToken.
+func (p *PlanRecord) startStage(index uint) error {
+	token := p.NextToken
+	if token == "" || index != p.CurrentStage+1 {
+		var err error
+		if token, err = newToken(); err != nil {
+			return err
+		}
+	}
+	next, err := newToken()
+	if err != nil {
+		return err
+	}
+	p.NextToken = next
+	p.CurrentStage = index
+	p.StageStartTime = time.Now()
+	p.Attempts = 0
+	p.State = planRunning
+	p.FailureReason = ""
+	p.Token = token
+	return nil
 }
 
 type interfaceTemplate struct {
@@ -41,55 +98,144 @@ type stageTemplate struct {
 	DNS          []string
 	DomainSearch string
 	Server       string
+	HTTPServer   string
+	SyslogPort   int
 	Interfaces   []interfaceTemplate
+	Params       map[string]string
+	Token        string
+	// NextToken is set when the next stage localboots the installed system,
+	// which must call back with it once booted.
+	NextToken string
 }
 
 type pxeTemplate struct {
-	Hostname  string
-	Address   string
-	Stage     string
-	Default   string
-	Server    string
-	OSServer  string
-	Netmask   string
-	Gateway   string
-	Interface string
+	Hostname       string
+	Address        string
+	Stage          string
+	StageType      string
+	Task           string
+	Default        string
+	Server         string
+	OSServer       string
+	HTTPServer     string
+	SyslogPort     int
+	NetconsolePort int
+	Netmask        string
+	Gateway        string
+	Interface      string
+	Params         map[string]string
+	Token          string
 }
 
 type Pxe struct {
 	StageTemplates *template.Template
-	IPAM           *ipam.StaticIpam
-	hostPlans      map[string]plandef
+	IPAM           ipam.Store
+	Store          PlanStore
+	PlanDirectory  string
+	History        *history.Log
+	// Server is the address hosts reach rackdirector on, and HTTPServer the
+	// host and port they fetch from its HTTP server on.
+	Server     string
+	HTTPServer string
+	// OSServer serves installer images and repositories.
+	OSServer    string
+	Nameservers []net.IP
+	// Interface is the device installers booted by hand configure.
+	Interface string
+	// UnknownHostname names hosts missing from IPAM, with the * replaced by
+	// random letters.
+	UnknownHostname string
+	// SyslogPort and NetconsolePort are where hosts send their logs.
+	SyslogPort     int
+	NetconsolePort int
+	BMC            bmc.Connector
+	// BMCStatus, if set, stops plans starting on hosts whose BMC was
+	// unreachable when last polled.
+	BMCStatus *bmc.Poller
+	// LogDirectory holds the logs hosts send while running plans.
+	LogDirectory string
+	// FailPatterns fail the current stage of any plan whose host logs a
+	// matching line, in addition to the patterns of the plan and stage.
+	FailPatterns []string
+
+	plans planManager
+	// settingsLock guards StageTemplates and FailPatterns, which can be
+	// replaced while running.
+	settingsLock    sync.RWMutex
+	definitionsLock sync.RWMutex
+	definitions     map[string]planDefinition
+	batchLock       sync.Mutex
+	batches         map[string]*batch
+	batchCount      uint
+	// logLock guards the host log files and the compiled fail patterns.
+	logLock  sync.Mutex
+	patterns map[string]*regexp.Regexp
+}
+
+// Restore loads the plans held in Store, resuming any plans that were in
+// flight when the daemon last stopped.
+func (p *Pxe) Restore() error {
+	plans, err := p.plans.restore(p.store())
+	if err != nil {
+		return err
+	}
+	for host, plan := range plans {
+		fmt.Fprintf(os.Stdout, "Restored plan %v for %v at stage %v\n", plan.Name, host, plan.CurrentStage)
+	}
+	return nil
+}
+
+// Flush writes every plan to Store, for a final save on shutdown.
+func (p *Pxe) Flush() error {
+	return p.plans.flush()
+}
+
+func (p *Pxe) store() PlanStore {
+	if p.Store == nil {
+		return memoryStore{}
+	}
+	return p.Store
 }
 
 func (p *Pxe) InstallSeed(peer net.IP) ([]byte, error) {
-	plan, exists := p.hostPlans[peer.String()]
+	plan, exists := p.plans.get(peer.String())
 	if !exists {
-		return nil, fmt.Errorf("%v not in a plan", peer)
+		return nil, fmt.Errorf("%v %w", peer, ErrNoPlan)
+	}
+	if plan.failed() {
+		return nil, fmt.Errorf("%v plan %v failed: %v", peer, plan.Name, plan.FailureReason)
 	}
+	p.touch(peer)
+	p.record(peer, history.SeedFetched, plan, "")
 	stage := plan.Stages[plan.CurrentStage]
 
-	if !strings.HasPrefix(stage, "install-") {
-		return nil, fmt.Errorf("%v not in an install stage. Current stage is %v", peer, stage)
+	if stage.Type != stageInstall {
+		return nil, fmt.Errorf("%v not in an install stage. Current stage is %v", peer, stage.Name)
 	}
-	return p.installTemplate(peer, stage)
+	var nextToken string
+	if next := plan.CurrentStage + 1; next < uint(len(plan.Stages)) && plan.Stages[next].Type == stageLocalboot {
+		nextToken = plan.NextToken
+	}
+	return p.installTemplate(peer, stage, plan.Token, nextToken)
 }
 
-func (p *Pxe) installTemplate(peer net.IP, stage string) ([]byte, error) {
+func (p *Pxe) installTemplate(peer net.IP, stage StageDefinition, token string, nextToken string) ([]byte, error) {
 	var buffer bytes.Buffer
 	peerInfo, err := p.IPAM.Get(peer)
 	if err != nil {
 		return nil, err
 	}
 
-	templateName := fmt.Sprintf("%s.template", stage)
+	templateName := stage.seedTemplate()
 
-	dns := []string{
-		"1.1.1.1",
+	dns := make([]string, 0, len(p.Nameservers))
+	for _, nameserver := range p.Nameservers {
+		dns = append(dns, nameserver.String())
 	}
 
-	if p.StageTemplates.Lookup(templateName) == nil {
-		return buffer.Bytes(), fmt.Errorf("Stage doesn't exist %v", stage)
+	templates := p.templates()
+	if templates.Lookup(templateName) == nil {
+		return buffer.Bytes(), fmt.Errorf("Stage doesn't exist %v", stage.Name)
 	}
 	interfaces := make([]interfaceTemplate, 0)
 	for _, interf := range peerInfo.Interfaces {
@@ -104,11 +250,16 @@ func (p *Pxe) installTemplate(peer net.IP, stage string) ([]byte, error) {
 			IPv4Netmask: networkToNetmask(interf.Network.Mask),
 		})
 	}
-	err = p.StageTemplates.ExecuteTemplate(&buffer, templateName, stageTemplate{
+	err = templates.ExecuteTemplate(&buffer, templateName, stageTemplate{
 		Hostname:   peerInfo.Hostname,
 		DNS:        dns,
-		Server:     "10.0.1.10",
+		Server:     p.Server,
+		HTTPServer: p.HTTPServer,
+		SyslogPort: p.SyslogPort,
 		Interfaces: interfaces,
+		Params:     stage.Params,
+		Token:      token,
+		NextToken:  nextToken,
 	})
 	fmt.Fprintf(os.Stdout, "Delivering kickstart to %v:\n%v\n", peerInfo.Hostname, buffer.String())
 	return buffer.Bytes(), err
@@ -130,17 +281,13 @@ func networkToNetmask(network net.IPMask) string {
 }
 
 func (p *Pxe) PxeConfig(peer net.IP) ([]byte, error) {
-	plan, exists := p.hostPlans[peer.String()]
-	defaultMenu := "localboot"
-	stage := ""
-	if exists {
-		stage := plan.Stages[plan.CurrentStage]
-		if strings.HasPrefix(stage, "install-") {
-			split := strings.SplitN(stage, "-", 2)
-			defaultMenu = split[1]
-		} else {
-			defaultMenu = "rackdirector-environment"
-		}
+	plan, exists := p.plans.get(peer.String())
+	stage := StageDefinition{Type: stageLocalboot}
+	var token string
+	if exists && !plan.failed() {
+		p.touch(peer)
+		stage = plan.Stages[plan.CurrentStage]
+		token = plan.Token
 	}
 
 	peerInfo, err := p.IPAM.Get(peer)
@@ -148,38 +295,43 @@ func (p *Pxe) PxeConfig(peer net.IP) ([]byte, error) {
 		return nil, err
 	}
 
+	p.record(peer, history.BootScriptFetched, plan, fmt.Sprintf("pxemenu default %v", stage.bootMenu()))
+
 	var buffer bytes.Buffer
-	err = p.StageTemplates.ExecuteTemplate(&buffer, "pxemenu.template", pxeTemplate{
-		Hostname:  peerInfo.Hostname,
-		Address:   peer.String(),
-		Stage:     stage,
-		Default:   defaultMenu,
-		Server:    "10.0.1.10",
-		OSServer:  "storage.echo1.jnstw.net",
-		Netmask:   networkToNetmask(peerInfo.Interfaces[0].Network.Mask),
-		Gateway:   peerInfo.Interfaces[0].Ipv4Gateway.String(),
-		Interface: "eth0",
+	err = p.templates().ExecuteTemplate(&buffer, "pxemenu.template", pxeTemplate{
+		Hostname:       peerInfo.Hostname,
+		Address:        peer.String(),
+		Stage:          stage.Name,
+		StageType:      string(stage.Type),
+		Task:           stage.task(),
+		Default:        stage.bootMenu(),
+		Server:         p.Server,
+		OSServer:       p.OSServer,
+		HTTPServer:     p.HTTPServer,
+		SyslogPort:     p.SyslogPort,
+		NetconsolePort: p.NetconsolePort,
+		Netmask:        networkToNetmask(peerInfo.Interfaces[0].Network.Mask),
+		Gateway:        peerInfo.Interfaces[0].Ipv4Gateway.String(),
+		Interface:      p.Interface,
+		Params:         stage.Params,
+		Token:          token,
 	})
 	return buffer.Bytes(), err
 }
 
 func (p *Pxe) IPxeConfig(peer net.IP) ([]byte, error) {
-	plan, exists := p.hostPlans[peer.String()]
-	defaultMenu := "localboot"
-	stage := ""
-	if exists {
-		stage := plan.Stages[plan.CurrentStage]
-		if strings.HasPrefix(stage, "install-") {
-			split := strings.SplitN(stage, "-", 2)
-			defaultMenu = split[1]
-		} else {
-			defaultMenu = "rackdirector-environment"
-		}
+	plan, exists := p.plans.get(peer.String())
+	stage := StageDefinition{Type: stageLocalboot}
+	var token string
+	if exists && !plan.failed() {
+		p.touch(peer)
+		stage = plan.Stages[plan.CurrentStage]
+		token = plan.Token
 	}
 
 	peerInfo, err := p.IPAM.Get(peer)
 	if err != nil {
-		peerInfo.Hostname = fmt.Sprintf("echo-%s.echo.jnstw.net", randomString(8))
+		peerInfo.Hostname = strings.Replace(p.UnknownHostname, "*", randomString(8), 1)
 		log.Println("server not found. Assigning random hostname", peerInfo.Hostname)
 		peerInfo.Interfaces = []ipam.Interface{
 			{
@@ -192,98 +344,179 @@ func (p *Pxe) IPxeConfig(peer net.IP) ([]byte, error) {
 		}
 	}
 
+	p.record(peer, history.BootScriptFetched, plan, fmt.Sprintf("ipxemenu default %v", stage.bootMenu()))
+
 	var buffer bytes.Buffer
-	err = p.StageTemplates.ExecuteTemplate(&buffer, "ipxemenu.template", pxeTemplate{
-		Hostname:  peerInfo.Hostname,
-		Address:   peer.String(),
-		Stage:     stage,
-		Default:   defaultMenu,
-		Server:    "10.0.1.10",
-		OSServer:  "storage.echo1.jnstw.net",
-		Netmask:   networkToNetmask(peerInfo.Interfaces[0].Network.Mask),
-		Gateway:   peerInfo.Interfaces[0].Ipv4Gateway.String(),
-		Interface: "eth0",
+	err = p.templates().ExecuteTemplate(&buffer, "ipxemenu.template", pxeTemplate{
+		Hostname:       peerInfo.Hostname,
+		Address:        peer.String(),
+		Stage:          stage.Name,
+		StageType:      string(stage.Type),
+		Task:           stage.task(),
+		Default:        stage.bootMenu(),
+		Server:         p.Server,
+		OSServer:       p.OSServer,
+		HTTPServer:     p.HTTPServer,
+		SyslogPort:     p.SyslogPort,
+		NetconsolePort: p.NetconsolePort,
+		Netmask:        networkToNetmask(peerInfo.Interfaces[0].Network.Mask),
+		Gateway:        peerInfo.Interfaces[0].Ipv4Gateway.String(),
+		Interface:      p.Interface,
+		Params:         stage.Params,
+		Token:          token,
 	})
 	return buffer.Bytes(), err
 }
 
 func (p *Pxe) CurrentPlan(peer net.IP) (string, error) {
-	plan, exists := p.hostPlans[peer.String()]
+	plan, exists := p.plans.get(peer.String())
 	if !exists {
-		return "", fmt.Errorf("%v not in a plan", peer)
+		return "", fmt.Errorf("%v %w", peer, ErrNoPlan)
 	}
 	return plan.Name, nil
 }
 
 func (p *Pxe) SetPlan(ip net.IP, plan string) error {
-	currentPlan, exists := p.hostPlans[ip.String()]
-	if exists {
-		return fmt.Errorf("%v already in a plan (%v)", ip, currentPlan.Name)
-	}
-
 	newplan, err := p.newPlan(plan)
 	if err != nil {
 		return err
 	}
+	if err := p.checkBMC(ip); err != nil {
+		return err
+	}
 
-	if p.hostPlans == nil {
-		p.hostPlans = make(map[string]plandef)
+	if err := p.plans.start(ip.String(), newplan); err != nil {
+		return err
 	}
-	p.hostPlans[ip.String()] = newplan
-	if err := p.ipmireboot(ip); err != nil {
+	p.record(ip, history.PlanStarted, newplan, "")
+	if err := p.netboot(ip); err != nil {
 		return err
 	}
 	return nil
 }
 
-func (p *Pxe) newPlan(plan string) (plandef, error) {
-	stages, ok := planMap[plan]
+func (p *Pxe) newPlan(plan string) (PlanRecord, error) {
+	definition, ok := p.planDefinition(plan)
 	if !ok {
-		return plandef{}, fmt.Errorf("plan %v doesn't exist", plan)
+		return PlanRecord{}, fmt.Errorf("plan %v doesn't exist", plan)
 	}
 
-	return plandef{
+	newplan := PlanRecord{
 		Name:         plan,
-		Stages:       stages,
-		CurrentStage: 0,
-	}, nil
+		Stages:       definition.Stages,
+		StartTime:    time.Now(),
+		Retries:      definition.Retries,
+		FailPatterns: definition.FailPatterns,
+	}
+	if err := newplan.startStage(0); err != nil {
+		return PlanRecord{}, err
+	}
+	return newplan, nil
 }
 
-func (p *Pxe) AdvancePlan(peer net.IP) error {
+// advancePlan moves the plan of peer on to its next stage, or finishes it
+// after the last. check is called with the plan before it advances and
+// aborts the advance if it fails. payload is recorded with the event.
+func (p *Pxe) advancePlan(peer net.IP, check func(plan *PlanRecord) error, payload json.RawMessage) error {
 	peerInfo, err := p.IPAM.Get(peer)
 	if err != nil {
 		return err
 	}
-	plan, exists := p.hostPlans[peer.String()]
-	if !exists {
-		return fmt.Errorf("%v not in a plan", peer)
+	var completed PlanRecord
+	var finished bool
+	plan, err := p.plans.update(peer.String(), func(plan *PlanRecord) (bool, error) {
+		if plan.failed() {
+			return false, fmt.Errorf("%v plan %v failed: %v", peer, plan.Name, plan.FailureReason)
+		}
+		if err := check(plan); err != nil {
+			return false, err
+		}
+		plan.LastSeen = time.Now()
+		completed = *plan
+		if plan.CurrentStage+1 == uint(len(plan.Stages)) {
+			// Plan done
+			fmt.Fprintf(os.Stdout, "Plan for %v finished.\n", peerInfo.Hostname)
+			finished = true
+			plan.State = planCompleted
+			return false, nil
+		}
+		return true, plan.startStage(plan.CurrentStage + 1)
+	})
+	if err != nil {
+		return err
 	}
-	plan.CurrentStage++
-	if plan.CurrentStage == uint(len(plan.Stages)) {
-		// Plan done
-		fmt.Fprintf(os.Stdout, "Plan for %v finished.\n", peerInfo.Hostname)
-		delete(p.hostPlans, peer.String())
+
+	took := fmt.Sprintf("stage took %v", time.Since(completed.StageStartTime).Round(time.Second))
+	if finished {
+		p.recordPayload(peer, history.PlanFinished, completed, fmt.Sprintf("%v, plan took %v", took, time.Since(completed.StartTime).Round(time.Second)), payload)
 	} else {
-		p.hostPlans[peer.String()] = plan
+		p.recordPayload(peer, history.StageAdvanced, plan, fmt.Sprintf("completed %v, %v", completed.Stages[completed.CurrentStage].Name, took), payload)
 	}
-
 	return nil
 }
 
-func (p *Pxe) ipmireboot(ip net.IP) error {
-	mgmtHostname := p.findMgmt(ip)
-	cmd := exec.Command("ipmitool", "-I", "lanplus", "-H", mgmtHostname, "-U", "ADMIN", "-E", "power", "cycle")
-	cmd.Env = []string{"IPMI_PASSWORD=ADMIN"}
-	fmt.Fprintf(os.Stdout, "Running %s\n", cmd.String())
-	return cmd.Run()
+// checkBMC fails if the BMC of the host at ip was unreachable when last
+// polled. Hosts which haven't been polled yet are given the benefit of the
+// doubt.
+func (p *Pxe) checkBMC(ip net.IP) error {
+	peerInfo, err := p.IPAM.Get(ip)
+	if err != nil {
+		return fmt.Errorf("looking up bmc for %v: %v", ip, err)
+	}
+	status, polled := p.BMCStatus.Status(peerInfo.Hostname)
+	if polled && !status.Reachable {
+		return fmt.Errorf("bmc of %v is unreachable: %v", peerInfo.Hostname, status.Error)
+	}
+	return nil
 }
 
-func (p *Pxe) findMgmt(ip net.IP) string {
+// netboot sets the host at ip to boot from the network once and power cycles
+// it through its BMC.
+func (p *Pxe) netboot(ip net.IP) error {
 	peerInfo, err := p.IPAM.Get(ip)
 	if err != nil {
-		panic(err)
+		return fmt.Errorf("looking up bmc for %v: %v", ip, err)
+	}
+	if p.BMC == nil {
+		return fmt.Errorf("no bmc connector configured")
+	}
+	driver, err := p.BMC.Connect(peerInfo)
+	if err != nil {
+		return fmt.Errorf("connecting to bmc of %v: %v", peerInfo.Hostname, err)
+	}
+	fmt.Fprintf(os.Stdout, "Netbooting %v through %v\n", peerInfo.Hostname, peerInfo.Bmc.Hostname)
+	if err := driver.SetNextBoot(bmc.BootPXE); err != nil {
+		return fmt.Errorf("setting %v to netboot: %v", peerInfo.Hostname, err)
 	}
-	return peerInfo.Bmc.Hostname
+	return driver.PowerCycle()
+}
+
+// RotateBMCPassword sets a new random password on the BMC of hostname and
+// records it with the BMC credentials.
+func (p *Pxe) RotateBMCPassword(hostname string) error {
+	host, err := p.IPAM.GetByHostname(hostname)
+	if err != nil {
+		return err
+	}
+	rotator, ok := p.BMC.(bmc.Rotator)
+	if !ok {
+		return fmt.Errorf("bmc connector can't rotate passwords")
+	}
+	if err := rotator.Rotate(host); err != nil {
+		return err
+	}
+
+	event := history.Event{
+		Hostname: host.Hostname,
+		Type:     history.BMCPasswordRotated,
+	}
+	if len(host.Interfaces) > 0 {
+		event.Address = host.Interfaces[0].Ipv4.String()
+	}
+	if err := p.History.Record(event); err != nil {
+		log.Printf("Failed to record %v event for %v: %v\n", event.Type, hostname, err)
+	}
+	return nil
 }
 
 const charset = "abcdefghijklmnopqrstuvwxyz"
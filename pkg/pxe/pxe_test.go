@@ -0,0 +1,396 @@
+package pxe
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/nik-johnson-net/rackdirector/pkg/bmc"
+	"github.com/nik-johnson-net/rackdirector/pkg/ipam"
+)
+
+// testPlan runs a task and an install, then boots the installed system, so
+// it has stages of every kind, an install seed to fetch and a token issued
+// in advance.
+const testPlan = `{
+	"name": "test",
+	"retries": 1,
+	"fail_patterns": ["Kernel panic"],
+	"stages": [
+		{"type": "task", "target": "inventory", "timeout": "30m"},
+		{"type": "install", "target": "centos-8", "timeout": "1h"},
+		{"type": "localboot", "timeout": "2h"}
+	]
+}`
+
+// fakeIPAM is an ipam.Store of hosts keyed by address.
+type fakeIPAM struct {
+	hosts map[string]ipam.Host
+}
+
+func (f *fakeIPAM) GetByPort(remoteID string, port string, relayIP net.IP) (ipam.Host, error) {
+	return ipam.Host{}, fmt.Errorf("no host on port %v", port)
+}
+
+func (f *fakeIPAM) Get(ip net.IP) (ipam.Host, error) {
+	host, ok := f.hosts[ip.String()]
+	if !ok {
+		return ipam.Host{}, fmt.Errorf("no host at %v", ip)
+	}
+	return host, nil
+}
+
+func (f *fakeIPAM) GetByHostname(hostname string) (ipam.Host, error) {
+	for _, host := range f.hosts {
+		if host.Hostname == hostname {
+			return host, nil
+		}
+	}
+	return ipam.Host{}, fmt.Errorf("no host named %v", hostname)
+}
+
+func (f *fakeIPAM) GetByMAC(mac net.HardwareAddr) (ipam.Host, error) {
+	return ipam.Host{}, fmt.Errorf("no host with mac %v", mac)
+}
+
+func (f *fakeIPAM) Hosts() []ipam.Host {
+	hosts := make([]ipam.Host, 0, len(f.hosts))
+	for _, host := range f.hosts {
+		hosts = append(hosts, host)
+	}
+	return hosts
+}
+
+func (f *fakeIPAM) add(address string) {
+	_, network, _ := net.ParseCIDR("10.0.0.0/16")
+	f.hosts[address] = ipam.Host{
+		Hostname: "host-" + address,
+		Interfaces: []ipam.Interface{{
+			Device:      "eth0",
+			Ipv4:        net.ParseIP(address),
+			Ipv4Gateway: net.ParseIP("10.0.255.254"),
+			Network:     *network,
+		}},
+	}
+}
+
+// fakeBMC counts the times each host was power cycled into netbooting. Power
+// cycles take delay, and peak is the most there have been at once.
+type fakeBMC struct {
+	delay time.Duration
+
+	mu       sync.Mutex
+	next     map[string]bmc.BootDevice
+	netboots map[string]int
+	cycling  int
+	peak     int
+}
+
+func (f *fakeBMC) Connect(host ipam.Host) (bmc.Driver, error) {
+	return &fakeDriver{bmc: f, hostname: host.Hostname}, nil
+}
+
+func (f *fakeBMC) count(hostname string) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.netboots[hostname]
+}
+
+type fakeDriver struct {
+	bmc      *fakeBMC
+	hostname string
+}
+
+func (d *fakeDriver) PowerOn() error  { return nil }
+func (d *fakeDriver) PowerOff() error { return nil }
+
+func (d *fakeDriver) PowerCycle() error {
+	d.bmc.mu.Lock()
+	d.bmc.cycling++
+	if d.bmc.cycling > d.bmc.peak {
+		d.bmc.peak = d.bmc.cycling
+	}
+	d.bmc.mu.Unlock()
+	time.Sleep(d.bmc.delay)
+
+	d.bmc.mu.Lock()
+	defer d.bmc.mu.Unlock()
+	d.bmc.cycling--
+	if d.bmc.next[d.hostname] == bmc.BootPXE {
+		d.bmc.netboots[d.hostname]++
+	}
+	delete(d.bmc.next, d.hostname)
+	return nil
+}
+
+func (d *fakeDriver) PowerStatus() (bmc.PowerState, error) { return bmc.PowerOn, nil }
+
+func (d *fakeDriver) SetNextBoot(device bmc.BootDevice) error {
+	d.bmc.mu.Lock()
+	defer d.bmc.mu.Unlock()
+	d.bmc.next[d.hostname] = device
+	return nil
+}
+
+func (d *fakeDriver) SetPassword(username string, password string) error { return nil }
+
+// newTestPxe returns a Pxe with the repository's templates and testPlan,
+// which keeps its plans in a temporary file and knows the hosts at
+// addresses.
+func newTestPxe(t *testing.T, addresses ...string) (*Pxe, *fakeBMC) {
+	dir, err := ioutil.TempDir("", "pxe")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	if err := ioutil.WriteFile(filepath.Join(dir, "test.json"), []byte(testPlan), 0644); err != nil {
+		t.Fatal(err)
+	}
+	templates, err := LoadTemplates(filepath.Join("..", "..", "templates"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	hosts := &fakeIPAM{hosts: make(map[string]ipam.Host)}
+	for _, address := range addresses {
+		hosts.add(address)
+	}
+	fake := &fakeBMC{next: make(map[string]bmc.BootDevice), netboots: make(map[string]int)}
+	p := &Pxe{
+		StageTemplates: templates,
+		IPAM:           hosts,
+		Store:          &FileStore{Path: filepath.Join(dir, "planstate.json")},
+		PlanDirectory:  dir,
+		Server:         "10.0.255.253",
+		HTTPServer:     "10.0.255.253:8080",
+		OSServer:       "10.0.255.253",
+		BMC:            fake,
+	}
+	if err := p.ReloadPlans(); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Restore(); err != nil {
+		t.Fatal(err)
+	}
+	return p, fake
+}
+
+// menuToken matches the callback token the boot menus give the live
+// environment, which is the token of the current stage whatever its type.
+var menuToken = regexp.MustCompile(`rackdirector\.token=(\S*)`)
+
+// token returns the callback token of the current stage of the host at
+// address, as its boot menu gives it.
+func token(p *Pxe, address string) (string, error) {
+	menu, err := p.IPxeConfig(net.ParseIP(address))
+	if err != nil {
+		return "", err
+	}
+	match := menuToken.FindSubmatch(menu)
+	if match == nil {
+		return "", fmt.Errorf("%v boot menu has no token", address)
+	}
+	return string(match[1]), nil
+}
+
+// callback sends a callback for the current stage of the host at address.
+func callback(p *Pxe, address string, status string) error {
+	current, err := token(p, address)
+	if err != nil {
+		return err
+	}
+	return p.Callback(CallbackRequest{Token: current, Status: status})
+}
+
+// plan returns the status of the plan of the host at address.
+func plan(p *Pxe, address string) (PlanStatus, bool) {
+	for _, status := range p.ListPlans() {
+		if status.Address == address {
+			return status, true
+		}
+	}
+	return PlanStatus{}, false
+}
+
+// TestControllerConcurrent drives every host through its plan at once, each
+// ending it a different way, while all of them also race over one shared
+// host. It checks every host ended up where its own calls left it and the
+// store holds the same. Run it with -race.
+func TestControllerConcurrent(t *testing.T) {
+	const (
+		workers = 8
+		rounds  = 12
+		shared  = "10.0.255.1"
+	)
+	address := func(w int, r int) string {
+		return fmt.Sprintf("10.0.%d.%d", w, r+1)
+	}
+	addresses := []string{shared}
+	for w := 0; w < workers; w++ {
+		for r := 0; r < rounds; r++ {
+			addresses = append(addresses, address(w, r))
+		}
+	}
+	p, fake := newTestPxe(t, addresses...)
+
+	if err := p.SetPlan(net.ParseIP(shared), "test"); err != nil {
+		t.Fatal(err)
+	}
+	sharedToken, err := token(p, shared)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	var accepted sync.Map
+	errs := make(chan error, workers*rounds*8)
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			// Every worker tries to advance the shared host with the same
+			// token, which only one may use.
+			if err := p.Callback(CallbackRequest{Token: sharedToken, Status: CallbackSuccess}); err == nil {
+				accepted.Store(w, true)
+			} else if err != ErrInvalidToken {
+				errs <- err
+			}
+
+			for r := 0; r < rounds; r++ {
+				host := address(w, r)
+				ip := net.ParseIP(host)
+				if err := p.SetPlan(ip, "test"); err != nil {
+					errs <- err
+					continue
+				}
+				if err := p.SetPlan(ip, "test"); err == nil {
+					errs <- fmt.Errorf("%v started twice", host)
+				}
+				if _, err := p.PxeConfig(ip); err != nil {
+					errs <- err
+				}
+				first, err := token(p, host)
+				if err != nil {
+					errs <- err
+					continue
+				}
+				if err := p.Callback(CallbackRequest{Token: first, Status: CallbackSuccess, Payload: []byte(`{"cpus": 2}`)}); err != nil {
+					errs <- err
+				}
+				if _, err := p.InstallSeed(ip); err != nil {
+					errs <- err
+				}
+				if err := p.Callback(CallbackRequest{Token: first, Status: CallbackSuccess}); err != ErrInvalidToken {
+					errs <- fmt.Errorf("%v replayed a token: %v", host, err)
+				}
+
+				// Rounds end the plan in turn by finishing it, by jumping
+				// to its last stage and finishing that, by cancelling it,
+				// and by failing it and retrying, which leaves it running.
+				switch r % 4 {
+				case 0:
+					if err := callback(p, host, CallbackSuccess); err != nil {
+						errs <- err
+					}
+					err = p.CompletePlan(ip)
+				case 1:
+					if err := p.RetryStage(ip); err != nil {
+						errs <- err
+					}
+					if err := p.JumpToStage(ip, 2); err != nil {
+						errs <- err
+					}
+					err = callback(p, host, CallbackSuccess)
+				case 2:
+					err = p.CancelPlan(ip)
+				case 3:
+					if err := callback(p, host, CallbackFailed); err != nil {
+						errs <- err
+					}
+					err = p.RetryStage(ip)
+				}
+				if err != nil {
+					errs <- fmt.Errorf("%v round %d: %v", host, r, err)
+				}
+
+				sharedIP := net.ParseIP(shared)
+				if err := p.JumpToStage(sharedIP, uint(r%3)); err != nil {
+					errs <- err
+				}
+				if err := p.RetryStage(sharedIP); err != nil {
+					errs <- err
+				}
+				if _, err := p.PxeConfig(sharedIP); err != nil {
+					errs <- err
+				}
+				if _, err := p.CurrentPlan(sharedIP); err != nil {
+					errs <- err
+				}
+				p.ListPlans()
+			}
+		}(w)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+
+	var winners int
+	accepted.Range(func(key, value interface{}) bool {
+		winners++
+		return true
+	})
+	if winners != 1 {
+		t.Errorf("shared token accepted %d times", winners)
+	}
+
+	if status, ok := plan(p, shared); !ok || status.State != PlanStateRunning {
+		t.Errorf("shared plan is %+v, %v", status, ok)
+	}
+	if got, want := fake.count("host-"+shared), 1+2*workers*rounds; got != want {
+		t.Errorf("shared host netbooted %d times, want %d", got, want)
+	}
+	for w := 0; w < workers; w++ {
+		for r := 0; r < rounds; r++ {
+			host := address(w, r)
+			status, running := plan(p, host)
+			netboots := 1
+			switch r % 4 {
+			case 1:
+				netboots = 3
+			case 3:
+				netboots = 2
+				if !running || status.State != PlanStateRunning || status.StageIndex != 1 || status.Attempts != 0 {
+					t.Errorf("%v is %+v, want it retrying stage 1", host, status)
+				}
+			}
+			if r%4 != 3 && running {
+				t.Errorf("%v is still in a plan: %+v", host, status)
+			}
+			if got := fake.count("host-" + host); got != netboots {
+				t.Errorf("%v netbooted %d times, want %d", host, got, netboots)
+			}
+		}
+	}
+
+	restored := &Pxe{IPAM: p.IPAM, Store: p.Store}
+	if err := restored.Restore(); err != nil {
+		t.Fatal(err)
+	}
+	plans, stored := p.ListPlans(), restored.ListPlans()
+	if len(stored) != len(plans) {
+		t.Fatalf("store holds %d plans, want %d", len(stored), len(plans))
+	}
+	for i := range plans {
+		if stored[i].Address != plans[i].Address || stored[i].Stage != plans[i].Stage || stored[i].State != plans[i].State {
+			t.Errorf("store holds %+v, want %+v", stored[i], plans[i])
+		}
+	}
+}
@@ -0,0 +1,89 @@
+package pxe
+
+import (
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"text/template"
+)
+
+// menuTemplates are the boot menus every template set must have.
+var menuTemplates = []string{"pxemenu.template", "ipxemenu.template"}
+
+// menuEntries match the start of each entry in a boot menu, capturing the
+// label stages boot it by.
+var menuEntries = map[string]*regexp.Regexp{
+	"pxemenu.template":  regexp.MustCompile(`(?m)^LABEL\s+(\S+)`),
+	"ipxemenu.template": regexp.MustCompile(`(?m)^:(\S+)`),
+}
+
+// hasMenuEntry reports whether the boot menu in templates has an entry
+// labelled label.
+func hasMenuEntry(templates *template.Template, menu string, label string) bool {
+	t := templates.Lookup(menu)
+	if t == nil || t.Tree == nil {
+		return false
+	}
+	for _, entry := range menuEntries[menu].FindAllStringSubmatch(t.Tree.Root.String(), -1) {
+		if entry[1] == label {
+			return true
+		}
+	}
+	return false
+}
+
+// LoadTemplates parses every *.template file in dir.
+func LoadTemplates(dir string) (*template.Template, error) {
+	files, err := filepath.Glob(filepath.Join(dir, "*.template"))
+	if err != nil {
+		return nil, err
+	}
+	if len(files) == 0 {
+		return nil, fmt.Errorf("no templates in %v", dir)
+	}
+	return template.ParseFiles(files...)
+}
+
+func (p *Pxe) templates() *template.Template {
+	p.settingsLock.RLock()
+	defer p.settingsLock.RUnlock()
+	return p.StageTemplates
+}
+
+func (p *Pxe) failPatterns() []string {
+	p.settingsLock.RLock()
+	defer p.settingsLock.RUnlock()
+	return append([]string(nil), p.FailPatterns...)
+}
+
+// SetTemplates replaces the stage templates, provided they have the boot
+// menus and every loaded plan can be booted with them.
+func (p *Pxe) SetTemplates(templates *template.Template) error {
+	for _, name := range menuTemplates {
+		if templates.Lookup(name) == nil {
+			return fmt.Errorf("missing template %v", name)
+		}
+	}
+
+	p.definitionsLock.RLock()
+	defer p.definitionsLock.RUnlock()
+	if err := validatePlanDefinitions(p.definitions, templates, p.failPatterns()); err != nil {
+		return err
+	}
+
+	p.settingsLock.Lock()
+	p.StageTemplates = templates
+	p.settingsLock.Unlock()
+	return nil
+}
+
+// SetFailPatterns replaces the fail patterns applied to every plan.
+func (p *Pxe) SetFailPatterns(patterns []string) error {
+	if err := validatePatterns(patterns); err != nil {
+		return err
+	}
+	p.settingsLock.Lock()
+	p.FailPatterns = patterns
+	p.settingsLock.Unlock()
+	return nil
+}
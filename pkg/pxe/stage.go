@@ -0,0 +1,124 @@
+package pxe
+
+import (
+	"fmt"
+	"strings"
+	"text/template"
+)
+
+// StageType is what a stage boots the host into.
+type StageType string
+
+const (
+	// stageInstall boots an OS installer which fetches its seed from
+	// /installseed, rendered from install-<target>.template.
+	stageInstall StageType = "install"
+	// stageTask boots the rackdirector live environment and runs the task
+	// named by the stage target.
+	stageTask StageType = "task"
+	// stageLocalboot boots from the local drive and waits for the host to call
+	// back before advancing. Only an install stage right before it can give
+	// the installed system the token to call back with, as the seed's
+	// NextToken; otherwise the stage needs a timeout, or an operator to
+	// complete it.
+	stageLocalboot StageType = "localboot"
+)
+
+// environmentMenu is the boot menu entry for the rackdirector live
+// environment.
+const environmentMenu = "rackdirector-environment"
+
+// environmentTasks are the tasks the rackdirector live environment knows how
+// to run. The live environment posts the result of a task to /api/callback
+// with the token given on its kernel command line.
+var environmentTasks = map[string]string{
+	"wipe":      "Wipe all local disks",
+	"firmware":  "Update BIOS and BMC firmware",
+	"burnin":    "Memory and CPU burn-in",
+	"inventory": "Collect a hardware inventory",
+}
+
+// normalize fills in the type and target of stages declared by name alone,
+// such as "install-centos-8", and names stages declared by type alone.
+func (s *StageDefinition) normalize() {
+	if s.Type == "" {
+		if strings.HasPrefix(s.Name, "install-") {
+			s.Type = stageInstall
+			if s.Target == "" {
+				s.Target = strings.TrimPrefix(s.Name, "install-")
+			}
+		} else if s.Name == string(stageLocalboot) {
+			s.Type = stageLocalboot
+		}
+	}
+
+	if s.Name == "" {
+		switch s.Type {
+		case stageInstall:
+			s.Name = "install-" + s.Target
+		case stageTask:
+			s.Name = "task-" + s.Target
+		case stageLocalboot:
+			s.Name = string(stageLocalboot)
+		}
+	}
+}
+
+// validate checks the stage can be booted with templates, which includes
+// every boot menu having an entry for it.
+func (s StageDefinition) validate(templates *template.Template) error {
+	if s.Timeout < 0 {
+		return fmt.Errorf("stage %v has a negative timeout", s.Name)
+	}
+	if err := validatePatterns(s.FailPatterns); err != nil {
+		return fmt.Errorf("stage %v: %v", s.Name, err)
+	}
+
+	switch s.Type {
+	case stageInstall:
+		if s.Target == "" {
+			return fmt.Errorf("install stage %v has no target", s.Name)
+		}
+		if templates.Lookup(s.seedTemplate()) == nil {
+			return fmt.Errorf("stage %v has no template %v", s.Name, s.seedTemplate())
+		}
+	case stageTask:
+		if _, ok := environmentTasks[s.Target]; !ok {
+			return fmt.Errorf("stage %v has unknown task %q", s.Name, s.Target)
+		}
+	case stageLocalboot:
+	default:
+		return fmt.Errorf("stage %v has unknown type %q", s.Name, s.Type)
+	}
+
+	for _, menu := range menuTemplates {
+		if !hasMenuEntry(templates, menu, s.bootMenu()) {
+			return fmt.Errorf("stage %v boots %v, which %v has no entry for", s.Name, s.bootMenu(), menu)
+		}
+	}
+	return nil
+}
+
+// bootMenu returns the boot menu entry a host in this stage should boot.
+func (s StageDefinition) bootMenu() string {
+	switch s.Type {
+	case stageInstall:
+		return s.Target
+	case stageTask:
+		return environmentMenu
+	default:
+		return "localboot"
+	}
+}
+
+// task returns the live environment task to run, if any.
+func (s StageDefinition) task() string {
+	if s.Type == stageTask {
+		return s.Target
+	}
+	return ""
+}
+
+func (s StageDefinition) seedTemplate() string {
+	return fmt.Sprintf("install-%s.template", s.Target)
+}
@@ -0,0 +1,78 @@
+package pxe
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// PlanStore persists host plans so in-flight plans survive a restart.
+type PlanStore interface {
+	// Load returns every stored plan keyed by host address.
+	Load() (map[string]PlanRecord, error)
+	// Save replaces the stored plans with plans.
+	Save(plans map[string]PlanRecord) error
+}
+
+// FileStore is a PlanStore which keeps plans in a JSON file on disk.
+type FileStore struct {
+	Path string
+}
+
+// Load reads the plan file. A missing file is treated as an empty store.
+func (f *FileStore) Load() (map[string]PlanRecord, error) {
+	plans := make(map[string]PlanRecord)
+
+	file, err := os.Open(f.Path)
+	if os.IsNotExist(err) {
+		return plans, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	err = json.NewDecoder(file).Decode(&plans)
+	if err != nil {
+		return nil, err
+	}
+	return plans, nil
+}
+
+// Save writes plans to a temporary file and renames it over the plan file,
+// so a crash mid-write never leaves a truncated store behind.
+func (f *FileStore) Save(plans map[string]PlanRecord) error {
+	data, err := json.MarshalIndent(plans, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(f.Path), filepath.Base(f.Path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), f.Path)
+}
+
+type memoryStore struct{}
+
+func (memoryStore) Load() (map[string]PlanRecord, error) {
+	return make(map[string]PlanRecord), nil
+}
+
+func (memoryStore) Save(plans map[string]PlanRecord) error {
+	return nil
+}
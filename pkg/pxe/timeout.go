@@ -0,0 +1,92 @@
+package pxe
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"time"
+
+	"github.com/nik-johnson-net/rackdirector/pkg/history"
+)
+
+// timeoutInterval is how often Watch checks plans for stage timeouts.
+const timeoutInterval = 30 * time.Second
+
+// Watch checks for hosts which have overrun their stage timeout until ctx is
+// done. A timed out stage is power cycled and attempted again while the plan
+// has retries left, after which the plan fails.
+func (p *Pxe) Watch(ctx context.Context) {
+	ticker := time.NewTicker(timeoutInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			p.checkTimeouts(now)
+		}
+	}
+}
+
+func (p *Pxe) checkTimeouts(now time.Time) {
+	for host, plan := range p.plans.list() {
+		if plan.failed() || !stageTimedOut(plan, now) {
+			continue
+		}
+
+		var retry, timedOut bool
+		updated, err := p.plans.update(host, func(plan *PlanRecord) (bool, error) {
+			// The plan may have moved on since it was listed.
+			if plan.failed() || !stageTimedOut(*plan, now) {
+				return true, nil
+			}
+			stage := plan.Stages[plan.CurrentStage]
+			if plan.Attempts < plan.Retries {
+				// Each attempt gets a token of its own, so a callback from
+				// the attempt which timed out can't advance the plan.
+				attempts := plan.Attempts + 1
+				if err := plan.startStage(plan.CurrentStage); err != nil {
+					return false, err
+				}
+				plan.Attempts = attempts
+				plan.StageStartTime = now
+				retry = true
+				return true, nil
+			}
+			plan.State = planFailed
+			plan.FailureReason = fmt.Sprintf("stage %v timed out after %v", stage.Name, time.Duration(stage.Timeout))
+			timedOut = true
+			return true, nil
+		})
+		if err != nil {
+			continue
+		}
+
+		address := net.ParseIP(host)
+		if retry {
+			log.Printf("Plan %v for %v timed out in stage %v, retrying (attempt %d of %d)\n",
+				updated.Name, host, updated.Stages[updated.CurrentStage].Name, updated.Attempts, updated.Retries)
+			p.record(address, history.StageRetried, updated, fmt.Sprintf("timed out, attempt %d of %d", updated.Attempts, updated.Retries))
+			if err := p.netboot(address); err != nil {
+				log.Printf("Plan %v for %v failed to power cycle for retry: %v\n", updated.Name, host, err)
+			}
+		} else if timedOut {
+			log.Printf("PLAN FAILED: plan %v for %v: %v\n", updated.Name, host, updated.FailureReason)
+			p.record(address, history.PlanFailed, updated, updated.FailureReason)
+		}
+	}
+}
+
+func stageTimedOut(plan PlanRecord, now time.Time) bool {
+	timeout := time.Duration(plan.Stages[plan.CurrentStage].Timeout)
+	if timeout == 0 {
+		return false
+	}
+	started := plan.StageStartTime
+	if started.IsZero() {
+		started = plan.StartTime
+	}
+	return now.Sub(started) > timeout
+}
@@ -0,0 +1,57 @@
+package pxe
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestCheckTimeouts checks a timed out stage is retried with a new token
+// until the plan runs out of retries, and then fails.
+func TestCheckTimeouts(t *testing.T) {
+	const host = "10.0.0.1"
+	p, fake := newTestPxe(t, host)
+	if err := p.SetPlan(net.ParseIP(host), "test"); err != nil {
+		t.Fatal(err)
+	}
+	first, err := token(p, host)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now()
+	p.checkTimeouts(now.Add(10 * time.Minute))
+	if status, _ := plan(p, host); status.Attempts != 0 || fake.count("host-"+host) != 1 {
+		t.Fatalf("stage retried before timing out: %+v", status)
+	}
+
+	retried := now.Add(31 * time.Minute)
+	p.checkTimeouts(retried)
+	status, _ := plan(p, host)
+	if status.State != PlanStateRunning || status.StageIndex != 0 || status.Attempts != 1 || !status.StageStartTime.Equal(retried) {
+		t.Errorf("retried plan is %+v", status)
+	}
+	if got := fake.count("host-" + host); got != 2 {
+		t.Errorf("host netbooted %d times, want 2", got)
+	}
+	second, err := token(p, host)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if second == first {
+		t.Error("retry kept the token of the timed out attempt")
+	}
+	if err := p.Callback(CallbackRequest{Token: first, Status: CallbackSuccess}); err != ErrInvalidToken {
+		t.Errorf("callback from the timed out attempt gave %v", err)
+	}
+
+	p.checkTimeouts(retried.Add(31 * time.Minute))
+	status, _ = plan(p, host)
+	if status.State != PlanStateFailed || status.Attempts != 1 || !strings.Contains(status.FailureReason, "timed out") {
+		t.Errorf("plan out of retries is %+v", status)
+	}
+	if err := p.Callback(CallbackRequest{Token: second, Status: CallbackSuccess}); err == nil {
+		t.Error("failed plan advanced")
+	}
+}
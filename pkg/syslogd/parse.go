@@ -0,0 +1,210 @@
+package syslogd
+
+import (
+	"bytes"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Sources of a Message.
+const (
+	SourceSyslog     = "syslog"
+	SourceNetconsole = "netconsole"
+)
+
+// Severity levels, as in RFC 5424 and the kernel log.
+const (
+	SeverityEmergency = iota
+	SeverityAlert
+	SeverityCritical
+	SeverityError
+	SeverityWarning
+	SeverityNotice
+	SeverityInfo
+	SeverityDebug
+)
+
+// facilityKernel is the syslog facility of kernel messages.
+const facilityKernel = 0
+
+var severityNames = []string{"emerg", "alert", "crit", "err", "warning", "notice", "info", "debug"}
+
+// Message is a single log line received from a host.
+type Message struct {
+	Time     time.Time
+	Source   string
+	Facility int
+	Severity int
+	Hostname string `json:",omitempty"`
+	App      string `json:",omitempty"`
+	Text     string
+}
+
+// String formats the message as a log file line.
+func (m Message) String() string {
+	severity := strconv.Itoa(m.Severity)
+	if m.Severity >= 0 && m.Severity < len(severityNames) {
+		severity = severityNames[m.Severity]
+	}
+	app := m.App
+	if app == "" {
+		app = m.Source
+	}
+	return m.Time.Format(time.RFC3339) + " " + severity + " " + app + ": " + m.Text
+}
+
+// ParseSyslog parses an RFC 5424 or RFC 3164 message. Messages in neither
+// format are kept whole as the text of a user.notice message.
+func ParseSyslog(data []byte, received time.Time) Message {
+	m := Message{
+		Time:     received,
+		Source:   SourceSyslog,
+		Facility: 1,
+		Severity: SeverityNotice,
+	}
+	line := strings.TrimRight(string(data), "\r\n\x00")
+
+	priority, rest, ok := parsePriority(line)
+	if !ok {
+		m.Text = line
+		return m
+	}
+	m.Facility = priority / 8
+	m.Severity = priority % 8
+
+	if strings.HasPrefix(rest, "1 ") {
+		parse5424(&m, rest[2:])
+	} else {
+		parse3164(&m, rest, received)
+	}
+	return m
+}
+
+// parsePriority splits "<PRI>" off the start of line.
+func parsePriority(line string) (int, string, bool) {
+	if !strings.HasPrefix(line, "<") {
+		return 0, line, false
+	}
+	end := strings.IndexByte(line, '>')
+	if end < 2 || end > 4 {
+		return 0, line, false
+	}
+	priority, err := strconv.Atoi(line[1:end])
+	if err != nil || priority > 191 {
+		return 0, line, false
+	}
+	return priority, line[end+1:], true
+}
+
+// parse5424 parses "TIMESTAMP HOSTNAME APP-NAME PROCID MSGID SD MSG".
+func parse5424(m *Message, rest string) {
+	fields := strings.SplitN(rest, " ", 6)
+	if len(fields) < 6 {
+		m.Text = rest
+		return
+	}
+	if t, err := time.Parse(time.RFC3339Nano, fields[0]); err == nil {
+		m.Time = t
+	}
+	m.Hostname = nilValue(fields[1])
+	m.App = nilValue(fields[2])
+
+	// Skip the structured data, which is either "-" or a run of [...]
+	// elements which may contain escaped brackets and spaces.
+	text := fields[5]
+	if strings.HasPrefix(text, "-") {
+		text = text[1:]
+	} else {
+		for strings.HasPrefix(text, "[") {
+			end := structuredDataEnd(text)
+			if end < 0 {
+				break
+			}
+			text = text[end+1:]
+		}
+	}
+	// MSG may start with a byte order mark to say it is UTF-8.
+	text = strings.TrimPrefix(text, " ")
+	m.Text = strings.TrimPrefix(text, "\ufeff")
+}
+
+func structuredDataEnd(text string) int {
+	escaped := false
+	quoted := false
+	for i := 1; i < len(text); i++ {
+		switch {
+		case escaped:
+			escaped = false
+		case text[i] == '\\':
+			escaped = true
+		case text[i] == '"':
+			quoted = !quoted
+		case text[i] == ']' && !quoted:
+			return i
+		}
+	}
+	return -1
+}
+
+func nilValue(field string) string {
+	if field == "-" {
+		return ""
+	}
+	return field
+}
+
+// parse3164 parses "Mmm dd hh:mm:ss HOSTNAME TAG: MSG". Any part may be
+// missing, as senders are loose with the format.
+func parse3164(m *Message, rest string, received time.Time) {
+	if len(rest) >= 16 && rest[15] == ' ' {
+		if t, err := time.ParseInLocation(time.Stamp, rest[:15], received.Location()); err == nil {
+			m.Time = t.AddDate(received.Year(), 0, 0)
+			rest = rest[16:]
+
+			if space := strings.IndexByte(rest, ' '); space > 0 && !strings.HasSuffix(rest[:space], ":") {
+				m.Hostname = rest[:space]
+				rest = rest[space+1:]
+			}
+		}
+	}
+
+	if colon := strings.Index(rest, ": "); colon > 0 && !strings.ContainsAny(rest[:colon], " ") {
+		tag := rest[:colon]
+		if bracket := strings.IndexByte(tag, '['); bracket > 0 {
+			tag = tag[:bracket]
+		}
+		m.App = tag
+		rest = rest[colon+2:]
+	}
+	m.Text = rest
+}
+
+// ParseNetconsole parses a line from the kernel's netconsole, either plain or
+// in the extended "level,sequence,timestamp,flags;text" format.
+func ParseNetconsole(data []byte, received time.Time) Message {
+	m := Message{
+		Time:     received,
+		Source:   SourceNetconsole,
+		Facility: facilityKernel,
+		Severity: SeverityInfo,
+		App:      "kernel",
+	}
+	line := string(bytes.TrimRight(data, "\r\n\x00"))
+
+	if semicolon := strings.IndexByte(line, ';'); semicolon > 0 {
+		header := strings.Split(line[:semicolon], ",")
+		if len(header) >= 3 {
+			if level, err := strconv.Atoi(header[0]); err == nil {
+				m.Severity = level & 7
+				m.Facility = level >> 3
+				line = line[semicolon+1:]
+			}
+		}
+	} else if level, rest, ok := parsePriority(line); ok {
+		m.Severity = level & 7
+		line = rest
+	}
+	m.Text = line
+	return m
+}
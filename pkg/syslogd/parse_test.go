@@ -0,0 +1,134 @@
+package syslogd
+
+import (
+	"testing"
+	"time"
+)
+
+var received = time.Date(2020, 6, 1, 12, 0, 0, 0, time.UTC)
+
+func TestParseSyslog(t *testing.T) {
+	tests := []struct {
+		name string
+		line string
+		want Message
+	}{
+		{
+			name: "rfc 5424",
+			line: "<165>1 2003-10-11T22:14:15.003Z mymachine.example.com evntslog - ID47 [exampleSDID@32473 iut=\"3\" eventSource=\"Application\" eventID=\"1011\"] \ufeffAn application event log entry\n",
+			want: Message{Time: time.Date(2003, 10, 11, 22, 14, 15, 3000000, time.UTC), Facility: 20, Severity: SeverityNotice, Hostname: "mymachine.example.com", App: "evntslog", Text: "An application event log entry"},
+		},
+		{
+			name: "rfc 5424 nil values",
+			line: "<34>1 - - - - - - plain text",
+			want: Message{Time: received, Facility: 4, Severity: SeverityCritical, Text: "plain text"},
+		},
+		{
+			name: "rfc 5424 escaped structured data",
+			line: `<14>1 2020-01-02T03:04:05Z node1 anaconda 12 - [a b="x\]y"][c d="e f"] install failed`,
+			want: Message{Time: time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC), Facility: 1, Severity: SeverityInfo, Hostname: "node1", App: "anaconda", Text: "install failed"},
+		},
+		{
+			name: "rfc 5424 truncated",
+			line: "<14>1 2020-01-02T03:04:05Z node1",
+			want: Message{Time: received, Facility: 1, Severity: SeverityInfo, Text: "2020-01-02T03:04:05Z node1"},
+		},
+		{
+			name: "rfc 3164",
+			line: "<34>Oct 11 22:14:15 mymachine su: 'su root' failed for lonvick on /dev/pts/8",
+			want: Message{Time: time.Date(2020, 10, 11, 22, 14, 15, 0, time.UTC), Facility: 4, Severity: SeverityCritical, Hostname: "mymachine", App: "su", Text: "'su root' failed for lonvick on /dev/pts/8"},
+		},
+		{
+			name: "rfc 3164 with pid",
+			line: "<11>Jan  2 03:04:05 node1 anaconda[123]: Installation failed",
+			want: Message{Time: time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC), Facility: 1, Severity: SeverityError, Hostname: "node1", App: "anaconda", Text: "Installation failed"},
+		},
+		{
+			name: "rfc 3164 without hostname",
+			line: "<30>Jan  2 03:04:05 systemd: Started foo.service.",
+			want: Message{Time: time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC), Facility: 3, Severity: SeverityInfo, App: "systemd", Text: "Started foo.service."},
+		},
+		{
+			name: "rfc 3164 without timestamp",
+			line: "<30>systemd: Started foo.service.",
+			want: Message{Time: received, Facility: 3, Severity: SeverityInfo, App: "systemd", Text: "Started foo.service."},
+		},
+		{
+			name: "rfc 3164 without tag",
+			line: "<13>something happened: badly",
+			want: Message{Time: received, Facility: 1, Severity: SeverityNotice, Text: "something happened: badly"},
+		},
+		{
+			name: "no priority",
+			line: "just some text\r\n",
+			want: Message{Time: received, Facility: 1, Severity: SeverityNotice, Text: "just some text"},
+		},
+		{
+			name: "priority out of range",
+			line: "<999>text",
+			want: Message{Time: received, Facility: 1, Severity: SeverityNotice, Text: "<999>text"},
+		},
+	}
+	for _, test := range tests {
+		test.want.Source = SourceSyslog
+		got := ParseSyslog([]byte(test.line), received)
+		if got != test.want {
+			t.Errorf("%v parsed as %+v, want %+v", test.name, got, test.want)
+		}
+	}
+}
+
+func TestParseNetconsole(t *testing.T) {
+	tests := []struct {
+		name string
+		line string
+		want Message
+	}{
+		{
+			name: "extended",
+			line: "6,1234,5678901,-;usb 1-1: new high-speed USB device\n",
+			want: Message{Facility: facilityKernel, Severity: SeverityInfo, Text: "usb 1-1: new high-speed USB device"},
+		},
+		{
+			name: "extended with facility",
+			line: "12,1,2,-;hello",
+			want: Message{Facility: 1, Severity: SeverityWarning, Text: "hello"},
+		},
+		{
+			name: "priority",
+			line: "<0>Kernel panic - not syncing: Fatal exception",
+			want: Message{Facility: facilityKernel, Severity: SeverityEmergency, Text: "Kernel panic - not syncing: Fatal exception"},
+		},
+		{
+			name: "plain",
+			line: "[    1.234567] e1000e: eth0 NIC Link is Up\x00",
+			want: Message{Facility: facilityKernel, Severity: SeverityInfo, Text: "[    1.234567] e1000e: eth0 NIC Link is Up"},
+		},
+		{
+			name: "plain with semicolon",
+			line: "mounting /; done",
+			want: Message{Facility: facilityKernel, Severity: SeverityInfo, Text: "mounting /; done"},
+		},
+	}
+	for _, test := range tests {
+		test.want.Time = received
+		test.want.Source = SourceNetconsole
+		test.want.App = "kernel"
+		got := ParseNetconsole([]byte(test.line), received)
+		if got != test.want {
+			t.Errorf("%v parsed as %+v, want %+v", test.name, got, test.want)
+		}
+	}
+}
+
+func TestMessageString(t *testing.T) {
+	m := Message{Time: time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC), Source: SourceSyslog, Severity: SeverityError, App: "anaconda", Text: "failed"}
+	if got, want := m.String(), "2020-01-02T03:04:05Z err anaconda: failed"; got != want {
+		t.Errorf("formatted as %q, want %q", got, want)
+	}
+	m.App = ""
+	m.Severity = 9
+	if got, want := m.String(), "2020-01-02T03:04:05Z 9 syslog: failed"; got != want {
+		t.Errorf("formatted as %q, want %q", got, want)
+	}
+}
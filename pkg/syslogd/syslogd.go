@@ -0,0 +1,190 @@
+// Package syslogd receives logs from hosts over syslog and netconsole.
+package syslogd
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// maxMessageSize bounds a single message, as RFC 5425 suggests.
+const maxMessageSize = 8192
+
+// Handler is given every message received.
+type Handler interface {
+	HandleLog(peer net.IP, message Message)
+}
+
+// Server listens for syslog over UDP and TCP and for netconsole over UDP.
+// Listeners with an empty address are not started.
+type Server struct {
+	Handler        Handler
+	UDPAddr        string
+	TCPAddr        string
+	NetconsoleAddr string
+
+	mu      sync.Mutex
+	closers []io.Closer
+	closed  bool
+}
+
+// ListenAndServe opens every configured listener and serves them in the
+// background.
+func (s *Server) ListenAndServe() error {
+	if s.UDPAddr != "" {
+		conn, err := net.ListenPacket("udp", s.UDPAddr)
+		if err != nil {
+			return fmt.Errorf("syslog udp: %v", err)
+		}
+		s.track(conn)
+		go s.servePackets(conn, ParseSyslog)
+	}
+	if s.NetconsoleAddr != "" {
+		conn, err := net.ListenPacket("udp", s.NetconsoleAddr)
+		if err != nil {
+			return fmt.Errorf("netconsole udp: %v", err)
+		}
+		s.track(conn)
+		go s.servePackets(conn, ParseNetconsole)
+	}
+	if s.TCPAddr != "" {
+		listener, err := net.Listen("tcp", s.TCPAddr)
+		if err != nil {
+			return fmt.Errorf("syslog tcp: %v", err)
+		}
+		s.track(listener)
+		go s.serveStreams(listener)
+	}
+	return nil
+}
+
+// Close stops every listener and connection.
+func (s *Server) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closed = true
+	for _, closer := range s.closers {
+		closer.Close()
+	}
+	s.closers = nil
+	return nil
+}
+
+// track adds closer to those closed by Close, closing it at once if the
+// server is already closed.
+func (s *Server) track(closer io.Closer) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		closer.Close()
+		return false
+	}
+	s.closers = append(s.closers, closer)
+	return true
+}
+
+func (s *Server) untrack(closer io.Closer) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i, c := range s.closers {
+		if c == closer {
+			s.closers = append(s.closers[:i], s.closers[i+1:]...)
+			return
+		}
+	}
+}
+
+func (s *Server) isClosed() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.closed
+}
+
+func (s *Server) servePackets(conn net.PacketConn, parse func([]byte, time.Time) Message) {
+	buffer := make([]byte, maxMessageSize)
+	for {
+		n, addr, err := conn.ReadFrom(buffer)
+		if err != nil {
+			if !s.isClosed() {
+				log.Printf("syslogd: %v\n", err)
+			}
+			return
+		}
+		udpAddr, ok := addr.(*net.UDPAddr)
+		if !ok || n == 0 {
+			continue
+		}
+		s.Handler.HandleLog(udpAddr.IP, parse(buffer[:n], time.Now()))
+	}
+}
+
+func (s *Server) serveStreams(listener net.Listener) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if !s.isClosed() {
+				log.Printf("syslogd: %v\n", err)
+			}
+			return
+		}
+		if s.track(conn) {
+			go s.serveStream(conn)
+		}
+	}
+}
+
+// serveStream reads messages framed either by octet counting or by newlines,
+// as RFC 6587 describes.
+func (s *Server) serveStream(conn net.Conn) {
+	defer s.untrack(conn)
+	defer conn.Close()
+	peer := conn.RemoteAddr().(*net.TCPAddr).IP
+	reader := bufio.NewReaderSize(conn, maxMessageSize)
+
+	for {
+		message, err := readFrame(reader)
+		if len(message) > 0 {
+			s.Handler.HandleLog(peer, ParseSyslog(message, time.Now()))
+		}
+		if err == io.EOF {
+			return
+		} else if err != nil {
+			if !s.isClosed() {
+				log.Printf("syslogd: %v: %v\n", peer, err)
+			}
+			return
+		}
+	}
+}
+
+func readFrame(reader *bufio.Reader) ([]byte, error) {
+	first, err := reader.Peek(1)
+	if err != nil {
+		return nil, err
+	}
+	if first[0] < '1' || first[0] > '9' {
+		line, err := reader.ReadSlice('\n')
+		if err == bufio.ErrBufferFull {
+			// Pass overlong lines on in pieces rather than dropping them.
+			return line, nil
+		}
+		return line, err
+	}
+
+	length, err := reader.ReadString(' ')
+	if err != nil {
+		return nil, err
+	}
+	size, err := strconv.Atoi(length[:len(length)-1])
+	if err != nil || size > maxMessageSize {
+		return nil, fmt.Errorf("bad frame length %q", length)
+	}
+	message := make([]byte, size)
+	_, err = io.ReadFull(reader, message)
+	return message, err
+}
@@ -3,10 +3,12 @@ package tftpd
 import (
 	"fmt"
 	"io"
+	"net"
 	"os"
 	"path"
 	"path/filepath"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/pin/tftp"
@@ -38,12 +40,29 @@ const (
 	FilenameIPXE = "ipxe.efi"
 )
 
+// startTimeout is how long Close waits for a server Serve was called on to
+// start reading requests.
+const startTimeout = 5 * time.Second
+
+// startFilename is requested by Close to find out the server has started.
+const startFilename = "rackdirector-tftpd-start"
+
 // Tftpd runs a TFTP server for serving chainload netboot files.
 type Tftpd struct {
 	Basedir string
 	Listen  string
 	Timeout time.Duration
+
+	mu      sync.Mutex
 	s       *tftp.Server
+	conn    *net.UDPConn
+	serving bool
+	closed  bool
+	// started is closed once the tftp.Server answers a request. It can't be
+	// shut down before it has started reading requests, and answering one is
+	// the only sign it has.
+	started     chan struct{}
+	startedOnce sync.Once
 }
 
 func (t *Tftpd) fileMapping(filename string) (string, error) {
@@ -81,6 +100,10 @@ func (t *Tftpd) fileMapping(filename string) (string, error) {
 
 // readHandler is called when client starts file download from server
 func (t *Tftpd) readHandler(filename string, rf io.ReaderFrom) error {
+	t.startedOnce.Do(func() { close(t.started) })
+	if filename == startFilename {
+		return os.ErrNotExist
+	}
 	fileToOpen, err := t.fileMapping(filename)
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "TFTP: Error answering request for %s: %v\n", filename, err)
@@ -107,35 +130,106 @@ func (t *Tftpd) readHandler(filename string, rf io.ReaderFrom) error {
 	return nil
 }
 
-// ListenAndServe starts listening for TFTP requests in the background
-func (t *Tftpd) ListenAndServe() {
-	// Set default to :69
+// Open opens the TFTP port, :69 unless Listen is set.
+func (t *Tftpd) Open() error {
 	listenAddr := t.Listen
 	if listenAddr == "" {
 		listenAddr = ":69"
 	}
+	addr, err := net.ResolveUDPAddr("udp", listenAddr)
+	if err != nil {
+		return err
+	}
+	conn, err := net.ListenUDP("udp", addr)
+	if err != nil {
+		return err
+	}
 
 	// Read only server, don't define a write handler
-	t.s = tftp.NewServer(t.readHandler, nil)
-
+	server := tftp.NewServer(t.readHandler, nil)
 	if t.Timeout != 0 {
-		t.s.SetTimeout(t.Timeout)
+		server.SetTimeout(t.Timeout)
 	}
 
-	go func() {
-		fmt.Fprintf(os.Stdout, "tftp server on: %v\n", listenAddr)
-		err := t.s.ListenAndServe(listenAddr) // blocks until s.Shutdown() is called
-		if err != nil {
-			fmt.Fprintf(os.Stdout, "server: %v\n", err)
-			os.Exit(1)
-		}
-	}()
+	t.mu.Lock()
+	t.s = server
+	t.conn = conn
+	t.started = make(chan struct{})
+	t.mu.Unlock()
+	fmt.Fprintf(os.Stdout, "tftp server on: %v\n", conn.LocalAddr())
+	return nil
 }
 
-// Close stops the running TFTP server
+// Serve answers requests on the port opened by Open until Close is called,
+// returning at once if Close was called first.
+func (t *Tftpd) Serve() error {
+	t.mu.Lock()
+	server, conn := t.s, t.conn
+	if server == nil {
+		t.mu.Unlock()
+		return fmt.Errorf("tftp server isn't open")
+	}
+	if t.closed {
+		t.mu.Unlock()
+		return nil
+	}
+	t.serving = true
+	t.mu.Unlock()
+
+	// tftp.Server.Serve has no error to return; it keeps reading until
+	// shut down.
+	server.Serve(conn)
+	return nil
+}
+
+// Close stops the TFTP server once the transfers in flight finish. A server
+// which isn't serving yet has its port closed, and won't serve.
 func (t *Tftpd) Close() error {
-	if t.s != nil {
-		t.s.Shutdown()
+	t.mu.Lock()
+	server, conn, serving := t.s, t.conn, t.serving
+	if server == nil || t.closed {
+		t.mu.Unlock()
+		return nil
+	}
+	t.closed = true
+	t.mu.Unlock()
+
+	if !serving {
+		return conn.Close()
+	}
+
+	// Serve may not have got as far as reading requests, and shutting the
+	// server down before then would block forever.
+	if err := requestStart(conn); err != nil {
+		return fmt.Errorf("waking tftp server to close it: %v", err)
 	}
+	select {
+	case <-t.started:
+	case <-time.After(startTimeout):
+		return fmt.Errorf("tftp server didn't start serving within %v", startTimeout)
+	}
+	server.Shutdown()
 	return nil
 }
+
+// requestStart sends the server listening on conn a read request for
+// startFilename.
+func requestStart(conn *net.UDPConn) error {
+	addr := *conn.LocalAddr().(*net.UDPAddr)
+	if addr.IP.IsUnspecified() {
+		addr.IP = net.IPv4(127, 0, 0, 1)
+	}
+	client, err := net.DialUDP("udp", nil, &addr)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	request := []byte{0, 1}
+	request = append(request, startFilename...)
+	request = append(request, 0)
+	request = append(request, "octet"...)
+	request = append(request, 0)
+	_, err = client.Write(request)
+	return err
+}
@@ -0,0 +1,105 @@
+package tftpd
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/pin/tftp"
+)
+
+func newTestTftpd(t *testing.T) *Tftpd {
+	dir, err := ioutil.TempDir("", "tftpd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	if err := ioutil.WriteFile(filepath.Join(dir, FilenameUndionly), []byte("undionly"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	server := &Tftpd{Basedir: dir, Listen: "127.0.0.1:0", Timeout: time.Second}
+	if err := server.Open(); err != nil {
+		t.Fatal(err)
+	}
+	return server
+}
+
+// serve runs Serve in the background, returning a channel which gets its
+// result.
+func serve(server *Tftpd) chan error {
+	served := make(chan error, 1)
+	go func() { served <- server.Serve() }()
+	return served
+}
+
+// waitServed fails t unless Serve returns nil soon.
+func waitServed(t *testing.T, served chan error) {
+	select {
+	case err := <-served:
+		if err != nil {
+			t.Errorf("Serve returned %v", err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("Serve didn't return after Close")
+	}
+}
+
+func TestServe(t *testing.T) {
+	server := newTestTftpd(t)
+	served := serve(server)
+
+	client, err := tftp.NewClient(server.conn.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	transfer, err := client.Receive(FilenameUndionly, "octet")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var file bytes.Buffer
+	if _, err := transfer.WriteTo(&file); err != nil {
+		t.Fatal(err)
+	}
+	if file.String() != "undionly" {
+		t.Errorf("received %q", file.String())
+	}
+
+	if err := server.Close(); err != nil {
+		t.Fatal(err)
+	}
+	waitServed(t, served)
+}
+
+func TestCloseBeforeServe(t *testing.T) {
+	server := newTestTftpd(t)
+	if err := server.Close(); err != nil {
+		t.Fatal(err)
+	}
+	waitServed(t, serve(server))
+	if err := server.Close(); err != nil {
+		t.Errorf("second Close gave %v", err)
+	}
+}
+
+// TestCloseWhileStarting closes servers as Serve starts them, which must
+// neither hang nor race. Run it with -race.
+func TestCloseWhileStarting(t *testing.T) {
+	for i := 0; i < 20; i++ {
+		server := newTestTftpd(t)
+		served := serve(server)
+		if err := server.Close(); err != nil {
+			t.Fatal(err)
+		}
+		waitServed(t, served)
+	}
+}
+
+func TestServeUnopened(t *testing.T) {
+	if err := (&Tftpd{}).Serve(); err == nil {
+		t.Error("Serve without Open succeeded")
+	}
+}
@@ -1,11 +1,21 @@
 #!/usr/bin/env bash
 
+RACKDIRECTOR_SERVER="${RACKDIRECTOR_SERVER:-10.0.1.10}"
+
 function start() {
+    local host_ipv4=""
+
+    host_ipv4=$(host_ipv4 "$1") || return 1
+
+    echo "Starting plan $2 on $1"
+    curl -s -d "{\"Address\": \"$host_ipv4\", \"Plan\": \"$2\"}" http://${RACKDIRECTOR_SERVER}/api/plan
+}
+
+function show() {
     local hostinfo=""
     local host_ipv4=""
-    local bmc_ipv4=""
 
-    hostinfo=$(curl -s "http://10.0.1.10/api/lookup?hostname=$1")
+    hostinfo=$(curl -s "http://${RACKDIRECTOR_SERVER}/api/lookup?hostname=$1")
     if [[ $? -ne 0 ]]; then
         echo "Error looking up $1:" >&2
         echo "$result" >&2
@@ -13,33 +23,136 @@ function start() {
     fi
 
     host_ipv4=$(echo "$hostinfo" | jq -r '.Interfaces[0] | .Ipv4')
-    bmc_ipv4=$(echo "$hostinfo" | jq -r '.Bmc.Ipv4')
 
-    echo "Starting plan $2 on $1"
-    curl -s -d "{\"Address\": \"$host_ipv4\", \"Plan\": \"$2\"}" http://10.0.1.10/api/plan
-    echo "Rebooting $1"
-    ipmitool -Ilanplus -U ADMIN -P ADMIN -H "$bmc_ipv4" power cycle
+    curl -s -X GET -d "{\"Address\": \"$host_ipv4\", \"Plan\": \"\"}" http://${RACKDIRECTOR_SERVER}/api/plan
+
 }
 
-function show() {
+function host_ipv4() {
     local hostinfo=""
-    local host_ipv4=""
 
-    hostinfo=$(curl -s "http://10.0.1.10/api/lookup?hostname=$1")
+    hostinfo=$(curl -s "http://${RACKDIRECTOR_SERVER}/api/lookup?hostname=$1")
     if [[ $? -ne 0 ]]; then
         echo "Error looking up $1:" >&2
-        echo "$result" >&2
+        echo "$hostinfo" >&2
         return 1
     fi
 
-    host_ipv4=$(echo "$hostinfo" | jq -r '.Interfaces[0] | .Ipv4')
+    echo "$hostinfo" | jq -r '.Interfaces[0] | .Ipv4'
+}
+
+function cancel() {
+    local host_ipv4=""
+
+    host_ipv4=$(host_ipv4 "$1") || return 1
+    curl -s -X DELETE -d "{\"Address\": \"$host_ipv4\"}" http://${RACKDIRECTOR_SERVER}/api/plan
+}
+
+function retry() {
+    local host_ipv4=""
+
+    host_ipv4=$(host_ipv4 "$1") || return 1
+    curl -s -d "{\"Address\": \"$host_ipv4\"}" http://${RACKDIRECTOR_SERVER}/api/plan/retry
+}
+
+function jump() {
+    local host_ipv4=""
+
+    host_ipv4=$(host_ipv4 "$1") || return 1
+    curl -s -d "{\"Address\": \"$host_ipv4\", \"Stage\": $2}" http://${RACKDIRECTOR_SERVER}/api/plan/jump
+}
+
+function complete() {
+    local host_ipv4=""
+
+    host_ipv4=$(host_ipv4 "$1") || return 1
+    curl -s -d "{\"Address\": \"$host_ipv4\"}" http://${RACKDIRECTOR_SERVER}/api/plan/complete
+}
+
+function list() {
+    curl -s http://${RACKDIRECTOR_SERVER}/api/plans | jq .
+}
+
+function batch() {
+    local selector="$1"
+    local plan="$2"
+    local max_in_flight="${3:-0}"
+    local max_failures="${4:-0}"
+    local field="Glob"
+
+    if [[ "$selector" == tag:* ]]; then
+        field="Tag"
+        selector="${selector#tag:}"
+    fi
+
+    curl -s -d "{\"Selector\": {\"$field\": \"$selector\"}, \"Plan\": \"$plan\", \"MaxInFlight\": $max_in_flight, \"MaxFailures\": $max_failures}" http://${RACKDIRECTOR_SERVER}/api/batch | jq .
+}
+
+function batch_status() {
+    if [[ -z "$1" ]]; then
+        curl -s http://${RACKDIRECTOR_SERVER}/api/batches | jq .
+    else
+        curl -s "http://${RACKDIRECTOR_SERVER}/api/batch?id=$1" | jq .
+    fi
+}
+
+function history() {
+    curl -s "http://${RACKDIRECTOR_SERVER}/api/history?hostname=$1" | jq .
+}
+
+function power() {
+    curl -s "http://${RACKDIRECTOR_SERVER}/api/hosts/$1/power" | jq .
+}
+
+function console() {
+    if [[ -z "$2" ]]; then
+        curl -sN "http://${RACKDIRECTOR_SERVER}/api/hosts/$1/console?follow=true"
+    else
+        curl -s "http://${RACKDIRECTOR_SERVER}/api/hosts/$1/console?run=$2"
+    fi
+}
+
+function consoles() {
+    curl -s "http://${RACKDIRECTOR_SERVER}/api/hosts/$1/consoles" | jq .
+}
+
+function logs() {
+    if [[ -z "$2" ]]; then
+        curl -s "http://${RACKDIRECTOR_SERVER}/api/hosts/$1/logs" | jq .
+    else
+        curl -s "http://${RACKDIRECTOR_SERVER}/api/hosts/$1/logs?run=$2"
+    fi
+}
 
-    curl -s -X GET -d "{\"Address\": \"$host_ipv4\", \"Plan\": \"\"}" http://10.0.1.10/api/plan
+function rotate_bmc() {
+    curl -s -d "{\"Hostname\": \"$1\"}" http://${RACKDIRECTOR_SERVER}/api/bmc/rotate
+}
+
+function reload_plans() {
+    curl -s -X POST http://${RACKDIRECTOR_SERVER}/api/reloadplans
+}
 
+function reload() {
+    curl -s -X POST http://${RACKDIRECTOR_SERVER}/api/reload
 }
 
 case "$1" in
 start) start "$2" "$3" ;;
 show) show "$2" ;;
+cancel) cancel "$2" ;;
+retry) retry "$2" ;;
+jump) jump "$2" "$3" ;;
+complete) complete "$2" ;;
+list) list ;;
+history) history "$2" ;;
+batch) batch "$2" "$3" "$4" "$5" ;;
+batch-status) batch_status "$2" ;;
+reload-plans) reload_plans ;;
+reload) reload ;;
+rotate-bmc) rotate_bmc "$2" ;;
+power) power "$2" ;;
+console) console "$2" "$3" ;;
+consoles) consoles "$2" ;;
+logs) logs "$2" "$3" ;;
 *) echo "Unknown subcommand $1" >&2; exit 1 ;;
 esac